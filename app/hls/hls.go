@@ -0,0 +1,278 @@
+package hls
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/protocol/httpflv"
+)
+
+/*
+	hls直播, mpeg-ts切片
+	1. GET /app/stream.m3u8, 和http-flv一样Host作为vhost, 鉴权参数加到切片的地址后面
+	2. 第一次请求m3u8的时候注册一个sink开始切片, 等第一个切片生成之后才回复, 等待推流超时回复404
+	3. 切片在关键帧切换, 纯音频任何一帧都可以切换, 地址是/app/stream-序号.ts, 只有已经在切片的流可以下载
+	4. 推流结束之后m3u8加上EXT-X-ENDLIST, 之后再请求m3u8重新开始切片
+	5. 没有请求超过IdleTimeout之后停止切片, 删除磁盘上的文件
+	6. 配置了LowLatency是ll-hls, 见llhls.go
+*/
+
+const (
+	playlistExt = ".m3u8"
+	segmentExt  = ".ts"
+)
+
+type Server struct {
+	pad     exchange.Pad
+	lock    sync.Mutex
+	streams map[string]*stream
+}
+
+func NewServer(pad exchange.Pad) *Server {
+	return &Server{
+		pad:     pad,
+		streams: make(map[string]*stream),
+	}
+}
+
+// IsHlsPath m3u8 ts和ll-hls的m4s mp4请求交给Server
+func IsHlsPath(p string) bool {
+	switch path.Ext(p) {
+	case playlistExt, segmentExt, fmp4SegmentExt, initExt:
+		return true
+	}
+	return false
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	httpflv.SetCorsHeader(w)
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch path.Ext(r.URL.Path) {
+	case playlistExt:
+		s.servePlaylist(w, r)
+	case segmentExt, fmp4SegmentExt:
+		s.serveSegment(w, r)
+	case initExt:
+		s.serveInit(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authErrorStatus 鉴权失败对应的http状态码
+func authErrorStatus(err error) int {
+	if _, ok := err.(*exchange.AuthError); ok {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	key, err := httpflv.StreamKeyFromRequest(r, playlistExt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err = httpflv.Authorize(r, exchange.AuthActionPlay, key); err != nil {
+		log.Println(key.String(), err)
+		http.Error(w, err.Error(), authErrorStatus(err))
+		return
+	}
+
+	st, err := s.getStream(key)
+	if err != nil {
+		log.Println(key.String(), "hls:", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// 推流还没有上来的时候exchange等PlayWait.Timeout, 之后还要等一个切片
+	var timeout time.Duration
+	config := exchange.GetAppConfig(key)
+	if config.PlayWait.Timeout > 0 {
+		timeout = config.PlayWait.Timeout + 3*config.Hls.SegmentDuration
+	}
+	if err = st.waitReady(r.Context(), timeout); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if st.config.LowLatency {
+		if status, err := st.holdPlaylist(r); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	data := st.playlist(playlistQuery(r.URL.RawQuery))
+	if data == nil {
+		http.Error(w, exchange.ErrStreamNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// lookup 切片地址里面的流, 流名里面可以有-, 序号在最后一个-后面, 返回序号部分
+func (s *Server) lookup(r *http.Request, ext string) (*stream, string) {
+	name := strings.TrimSuffix(r.URL.Path, ext)
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return nil, ""
+	}
+	sr := r.Clone(r.Context())
+	sr.URL.Path = name[:i] + ext
+	key, err := httpflv.StreamKeyFromRequest(sr, ext)
+	if err != nil {
+		return nil, ""
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[key.String()], name[i+1:]
+}
+
+// serveSegment /app/stream-序号.ts, ll-hls是/app/stream-序号.m4s和/app/stream-序号.分片序号.m4s
+func (s *Server) serveSegment(w http.ResponseWriter, r *http.Request) {
+	ext := path.Ext(r.URL.Path)
+	st, name := s.lookup(r, ext)
+	if st == nil || st.segmentExt() != ext {
+		http.NotFound(w, r)
+		return
+	}
+	var index string
+	if i := strings.IndexByte(name, '.'); i >= 0 && ext == fmp4SegmentExt {
+		name, index = name[:i], name[i+1:]
+	}
+	seq, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if index != "" {
+		s.servePart(w, r, st, seq, index)
+		return
+	}
+	seg := st.getSegment(seq)
+	if seg == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if ext == segmentExt {
+		w.Header().Set("Content-Type", "video/mp2t")
+	} else {
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	if seg.path != "" {
+		http.ServeFile(w, r, seg.path)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(seg.bytes()))
+}
+
+// servePart EXT-X-PRELOAD-HINT的分片还没有生成的时候等到生成为止
+func (s *Server) servePart(w http.ResponseWriter, r *http.Request, st *stream, seq uint64, index string) {
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	p := st.getPart(seq, i)
+	if p == nil && !st.tooFarAhead(seq) {
+		err = st.wait(r.Context(), st.holdTimeout(), func() bool {
+			return st.hasPart(seq, i)
+		})
+		if err == nil {
+			p = st.getPart(seq, i)
+		}
+	}
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(p.data))
+}
+
+// serveInit /app/stream-序号.mp4, fmp4的ftyp moov
+func (s *Server) serveInit(w http.ResponseWriter, r *http.Request) {
+	st, name := s.lookup(r, initExt)
+	if st == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	init := st.getInit(id)
+	if init == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(init.data))
+}
+
+// getStream 没有在切片的流注册sink开始切片
+func (s *Server) getStream(key exchange.StreamKey) (*stream, error) {
+	s.lock.Lock()
+	old := s.streams[key.String()]
+	if old != nil && !old.isEnded() {
+		s.lock.Unlock()
+		old.touch()
+		return old, nil
+	}
+
+	var nextSeq uint64
+	if old != nil {
+		// 推流结束之后重新请求, 序号接着用, 播放器缓存的地址不会拿到别的内容
+		nextSeq = old.nextSequence()
+	}
+	st, err := newStream(s, key, exchange.GetAppConfig(key).Hls, nextSeq)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	s.streams[key.String()] = st
+	s.lock.Unlock()
+	if old != nil {
+		old.stop()
+	}
+
+	if err = s.pad.OnSinkDetermined(st, st.ctx); err != nil {
+		s.remove(st)
+		st.stop()
+		return nil, err
+	}
+	log.Println(key.String(), "hls start")
+	go st.run()
+	return st, nil
+}
+
+func (s *Server) remove(st *stream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.streams[st.key.String()] == st {
+		delete(s.streams, st.key.String())
+	}
+}
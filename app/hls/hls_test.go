@@ -0,0 +1,436 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chinasarft/golive/container/ts"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/exchange/exchangetest"
+)
+
+func testConfig() exchange.AppConfig {
+	config := exchange.DefaultAppConfig()
+	config.Hls.SegmentDuration = time.Second
+	config.Hls.PlaylistLength = 3
+	config.Hls.IdleTimeout = 200 * time.Millisecond
+	config.PlayWait.Timeout = time.Second
+	return config
+}
+
+func TestSegmenter(t *testing.T) {
+	key, _ := exchange.NewStreamKey("rtmp://127.0.0.1/hlsseg", "hlsseg", "s")
+	config := testConfig().Hls
+	st, _ := newStream(NewServer(exchange.GetExchanger()), key, config, 10)
+
+	for _, m := range exchangetest.Frames(0, 5000, true) {
+		st.WriteData(m)
+	}
+	// 切片1秒一个
+	if len(st.segments) != 4 {
+		t.Fatalf("segments:%d", len(st.segments))
+	}
+	for i, seg := range st.segments {
+		if seg.seq != 10+uint64(i) || seg.duration != 1000 || seg.discontinuity {
+			t.Fatalf("segment %d:%+v", i, seg)
+		}
+		if len(seg.data)%ts.PacketSize != 0 || seg.data[0] != 0x47 || seg.data[1]&0x1f != 0 {
+			t.Fatalf("segment %d data:%x", i, seg.data[:4])
+		}
+	}
+
+	// 换了sequence header, 下一个关键帧切换, 有EXT-X-DISCONTINUITY
+	st.WriteData(&exchange.ExData{DataType: exchange.DataTypeAudioConfig, Payload: []byte{0xaf, 0, 0x11, 0x90}})
+	for _, m := range exchangetest.Frames(5000, 5600, true) {
+		st.WriteData(m)
+	}
+	st.lock.Lock()
+	st.end()
+	st.lock.Unlock()
+
+	playlist := string(st.playlist("token=abc"))
+	expect := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-TARGETDURATION:1\n" +
+		"#EXT-X-MEDIA-SEQUENCE:13\n" +
+		"#EXTINF:1.000,\ns-13.ts?token=abc\n" +
+		"#EXTINF:1.000,\ns-14.ts?token=abc\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXTINF:0.560,\ns-15.ts?token=abc\n" +
+		"#EXT-X-ENDLIST\n"
+	if playlist != expect {
+		t.Fatalf("playlist:\n%s", playlist)
+	}
+	// 移出m3u8的切片还可以下载
+	if st.getSegment(11) == nil || st.getSegment(10) != nil {
+		t.Fatal("extra segments")
+	}
+	if err := st.WriteData(exchangetest.Frames(5600, 5640, true)[0]); err != errStreamEnded {
+		t.Fatal(err)
+	}
+}
+
+func TestHlsPlay(t *testing.T) {
+	exchange.SetAppConfig("hlsplay", testConfig())
+	pub, put := exchangetest.Publish(t, exchange.GetExchanger(), "hlsplay")
+	defer pub.Unpublish()
+	go exchangetest.PutFrames(pub.Context(), put, true, 20*time.Millisecond)
+
+	s := NewServer(exchange.GetExchanger())
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/hlsplay/s.m3u8?token=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Fatalf("playlist response:%d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var uri string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "s-") {
+			uri = line
+		}
+	}
+	if !strings.HasSuffix(uri, ".ts?token=abc") {
+		t.Fatalf("segment uri:%s", uri)
+	}
+
+	seg, err := http.Get(srv.URL + "/hlsplay/" + uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(seg.Body)
+	seg.Body.Close()
+	if seg.StatusCode != http.StatusOK || len(data) == 0 || len(data)%ts.PacketSize != 0 {
+		t.Fatalf("segment response:%d %d", seg.StatusCode, len(data))
+	}
+
+	// 不在切片的流和不存在的切片
+	for _, p := range []string{"/hlsplay/other-0.ts", "/hlsplay/s-100.ts", "/hlsplay/s.flv"} {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s status:%d", p, resp.StatusCode)
+		}
+	}
+}
+
+func TestHlsNotFound(t *testing.T) {
+	config := testConfig()
+	config.PlayWait.Timeout = 100 * time.Millisecond
+	exchange.SetAppConfig("hlsnotfound", config)
+
+	srv := httptest.NewServer(NewServer(exchange.GetExchanger()))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/hlsnotfound/s.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status:%d", resp.StatusCode)
+	}
+}
+
+func TestHlsIdle(t *testing.T) {
+	dir := t.TempDir()
+	config := testConfig()
+	config.Hls.Dir = filepath.Join(dir, "{app}")
+	exchange.SetAppConfig("hlsidle", config)
+	pub, put := exchangetest.Publish(t, exchange.GetExchanger(), "hlsidle")
+	defer pub.Unpublish()
+	go exchangetest.PutFrames(pub.Context(), put, true, 20*time.Millisecond)
+
+	s := NewServer(exchange.GetExchanger())
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/hlsidle/s.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status:%d", resp.StatusCode)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "hlsidle", "*"))
+	if len(files) < 2 {
+		t.Fatalf("files:%v", files)
+	}
+
+	// 没有请求之后停止切片, 删除文件
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.lock.Lock()
+		n := len(s.streams)
+		s.lock.Unlock()
+		if _, err := os.Stat(filepath.Join(dir, "hlsidle")); n == 0 && os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hls not stopped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestHlsRejectPathName(t *testing.T) {
+	config := testConfig().Hls
+	config.Dir = filepath.Join(t.TempDir(), "{vhost}", "{app}")
+	// 切片写磁盘的时候名字不能跑到目录外面, 只在内存里面没关系
+	for _, key := range []exchange.StreamKey{
+		{Vhost: exchange.DefaultVhost, App: "live/../..", Stream: "s"},
+		{Vhost: "..", App: "live", Stream: "s"},
+		{Vhost: exchange.DefaultVhost, App: "live", Stream: "../s"},
+	} {
+		if _, err := newStream(NewServer(exchange.GetExchanger()), key, config, 0); err == nil {
+			t.Fatalf("%s should be rejected", key.String())
+		}
+	}
+	config.Dir = ""
+	if _, err := newStream(NewServer(exchange.GetExchanger()), exchange.StreamKey{App: "live", Stream: "../s"}, config, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testLowLatencyConfig() exchange.AppConfig {
+	config := testConfig()
+	config.Hls.LowLatency = true
+	config.Hls.PartDuration = 300 * time.Millisecond
+	return config
+}
+
+func TestLowLatencySegmenter(t *testing.T) {
+	key, _ := exchange.NewStreamKey("rtmp://127.0.0.1/llhlsseg", "llhlsseg", "s")
+	st, _ := newStream(NewServer(exchange.GetExchanger()), key, testLowLatencyConfig().Hls, 0)
+
+	for _, m := range exchangetest.Frames(0, 2500, true) {
+		st.WriteData(m)
+	}
+	if len(st.segments) != 2 || st.cur == nil || len(st.cur.parts) != 1 {
+		t.Fatalf("segments:%d", len(st.segments))
+	}
+	// 关键帧开始的分片是INDEPENDENT, 分片不超过PART-TARGET
+	for _, seg := range st.segments {
+		if seg.duration != 1000 || len(seg.parts) != 4 || seg.init == nil || seg.init.id != 0 {
+			t.Fatalf("segment %d:%+v", seg.seq, seg)
+		}
+		var duration uint64
+		for i, p := range seg.parts {
+			if p.duration > 300 || p.independent != (i == 0) || len(p.data) == 0 {
+				t.Fatalf("segment %d part %d:%d %v", seg.seq, i, p.duration, p.independent)
+			}
+			duration += p.duration
+		}
+		if duration != seg.duration || !bytes.Equal(seg.bytes(), append(append(append(append([]byte{},
+			seg.parts[0].data...), seg.parts[1].data...), seg.parts[2].data...), seg.parts[3].data...)) {
+			t.Fatalf("segment %d parts", seg.seq)
+		}
+	}
+	if init := st.getInit(0); init == nil || string(init.data[4:8]) != "ftyp" {
+		t.Fatal("init segment")
+	}
+	if !st.hasPart(1, 10) || !st.hasPart(2, 0) || st.hasPart(2, 1) || st.hasPart(2, -1) {
+		t.Fatal("hasPart")
+	}
+
+	playlist := string(st.playlist("token=abc"))
+	for _, line := range []string{
+		"#EXT-X-VERSION:6\n",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.900\n",
+		"#EXT-X-PART-INF:PART-TARGET=0.300\n",
+		"#EXT-X-MAP:URI=\"s-0.mp4?token=abc\"\n",
+		"#EXT-X-PART:DURATION=0.280,URI=\"s-0.0.m4s?token=abc\",INDEPENDENT=YES\n",
+		"#EXT-X-PART:DURATION=0.160,URI=\"s-1.3.m4s?token=abc\"\n",
+		"#EXTINF:1.000,\ns-1.m4s?token=abc\n",
+		"#EXT-X-PART:DURATION=0.280,URI=\"s-2.0.m4s?token=abc\",INDEPENDENT=YES\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"s-2.1.m4s?token=abc\"\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Fatalf("missing %q in playlist:\n%s", line, playlist)
+		}
+	}
+	if strings.Count(playlist, "#EXT-X-MAP") != 1 {
+		t.Fatalf("playlist:\n%s", playlist)
+	}
+
+	st.lock.Lock()
+	st.end()
+	st.lock.Unlock()
+	playlist = string(st.playlist(""))
+	if !strings.HasSuffix(playlist, "#EXTINF:0.480,\ns-2.m4s\n#EXT-X-ENDLIST\n") || strings.Contains(playlist, "PRELOAD-HINT") {
+		t.Fatalf("playlist:\n%s", playlist)
+	}
+}
+
+func TestLowLatencyAudioOnly(t *testing.T) {
+	key, _ := exchange.NewStreamKey("rtmp://127.0.0.1/llhlsaudio", "llhlsaudio", "s")
+	st, _ := newStream(NewServer(exchange.GetExchanger()), key, testLowLatencyConfig().Hls, 0)
+
+	// 纯音频每一帧都可以切换, 分片还是按照PartDuration
+	st.WriteData(&exchange.ExData{DataType: exchange.DataTypeAudioConfig, AvFormat: exchange.AvFormatAAC, Payload: exchangetest.AudioConfig})
+	for ts := uint64(0); ts < 2500; ts += 23 {
+		st.WriteData(&exchange.ExData{Timestamp: ts, DataType: exchange.DataTypeAudio, AvFormat: exchange.AvFormatAAC, Payload: []byte{0xaf, 1, 0x21, 0x10}})
+	}
+	if len(st.segments) != 2 {
+		t.Fatalf("segments:%d", len(st.segments))
+	}
+	for _, seg := range st.segments {
+		if len(seg.parts) != 4 {
+			t.Fatalf("segment %d parts:%d", seg.seq, len(seg.parts))
+		}
+		for i, p := range seg.parts {
+			if p.duration > 300 || (i < 3 && p.duration < 250) || !p.independent {
+				t.Fatalf("segment %d part %d:%d %v", seg.seq, i, p.duration, p.independent)
+			}
+		}
+	}
+}
+
+func TestPlaylistQuery(t *testing.T) {
+	for raw, expect := range map[string]string{
+		"":                               "",
+		"_HLS_msn=3&_HLS_part=1":         "",
+		"token=abc&_HLS_msn=3":           "token=abc",
+		"_HLS_skip=YES&token=abc&sign=x": "token=abc&sign=x",
+	} {
+		if q := playlistQuery(raw); q != expect {
+			t.Fatalf("%s:%s", raw, q)
+		}
+	}
+}
+
+func getStatus(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+// preloadHint m3u8里面EXT-X-PRELOAD-HINT的切片序号和分片序号
+func preloadHint(t *testing.T, playlist string) (uint64, int) {
+	i := strings.Index(playlist, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"s-")
+	if i < 0 {
+		t.Fatalf("playlist:\n%s", playlist)
+	}
+	var msn uint64
+	var part int
+	if _, err := fmt.Sscanf(playlist[i:], "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"s-%d.%d.m4s", &msn, &part); err != nil {
+		t.Fatal(err)
+	}
+	return msn, part
+}
+
+func TestLowLatencyPlay(t *testing.T) {
+	exchange.SetAppConfig("llhlsplay", testLowLatencyConfig())
+	pub, put := exchangetest.Publish(t, exchange.GetExchanger(), "llhlsplay")
+	defer pub.Unpublish()
+	go exchangetest.PutFrames(pub.Context(), put, true, 20*time.Millisecond)
+
+	srv := httptest.NewServer(NewServer(exchange.GetExchanger()))
+	defer srv.Close()
+	base := srv.URL + "/llhlsplay/"
+
+	status, playlist := getStatus(t, base+"s.m3u8")
+	if status != http.StatusOK {
+		t.Fatalf("status:%d", status)
+	}
+	if status, _ := getStatus(t, base+"s-0.mp4"); status != http.StatusOK {
+		t.Fatalf("init status:%d", status)
+	}
+
+	// 请求还没有生成的分片等到生成
+	msn, part := preloadHint(t, playlist)
+	status, data := getStatus(t, fmt.Sprintf("%ss-%d.%d.m4s", base, msn, part))
+	if status != http.StatusOK || data[4:8] != "moof" {
+		t.Fatalf("part status:%d", status)
+	}
+
+	// 阻塞刷新, 下一个分片生成之后才回复
+	status, playlist = getStatus(t, fmt.Sprintf("%ss.m3u8?_HLS_msn=%d&_HLS_part=%d", base, msn, part+1))
+	if status != http.StatusOK {
+		t.Fatalf("status:%d", status)
+	}
+	if next, index := preloadHint(t, playlist); next == msn && index <= part+1 {
+		t.Fatalf("preload hint:%d.%d after %d.%d", next, index, msn, part+1)
+	}
+	if !strings.Contains(playlist, fmt.Sprintf("s-%d.%d.m4s", msn, part)) {
+		t.Fatalf("playlist:\n%s", playlist)
+	}
+
+	for _, p := range []string{
+		fmt.Sprintf("s.m3u8?_HLS_msn=%d", msn+10),
+		"s.m3u8?_HLS_part=1",
+		"s.m3u8?_HLS_msn=abc",
+	} {
+		if status, _ := getStatus(t, base+p); status != http.StatusBadRequest {
+			t.Fatalf("%s status:%d", p, status)
+		}
+	}
+	for _, p := range []string{"s-0.ts", "s-100.mp4", fmt.Sprintf("s-%d.0.m4s", msn+10)} {
+		if status, _ := getStatus(t, base+p); status != http.StatusNotFound {
+			t.Fatalf("%s status:%d", p, status)
+		}
+	}
+}
+
+func TestTsMuxerNegativeCts(t *testing.T) {
+	avc, err := ts.ParseAvcConfig(exchangetest.VideoConfig[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pes头里面的pts, 33位分成3段
+	pesPts := func(data []byte) uint64 {
+		i := bytes.Index(data, []byte{0, 0, 1, 0xe0})
+		if i < 0 {
+			t.Fatal("no video pes")
+		}
+		b := data[i+9:]
+		return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+	}
+
+	for _, c := range []struct {
+		ts  uint64
+		cts int32
+		pts uint64
+	}{
+		{1000, 40, 1040 * 90},
+		{1000, -40, 960 * 90},
+		{20, -40, 0},
+	} {
+		var buf bytes.Buffer
+		muxer := newTsMuxer(avc, nil)
+		muxer.startSegment(&buf)
+		m := &exchange.ExData{
+			Timestamp:       c.ts,
+			CompositionTime: c.cts,
+			DataType:        exchange.DataTypeVideoNonKeyFrame,
+			AvFormat:        exchange.AvFormatAVC,
+			Payload:         []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x88},
+		}
+		if err := muxer.writeVideo(m, false); err != nil {
+			t.Fatal(err)
+		}
+		if pts := pesPts(buf.Bytes()); pts != c.pts {
+			t.Fatalf("ts:%d cts:%d expect pts %d but %d", c.ts, c.cts, c.pts, pts)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	ll-hls, app配置Hls.LowLatency
+	1. 切片是fmp4, ftyp moov是单独的init放在EXT-X-MAP里面, 地址是/app/stream-序号.mp4
+	2. 每PartDuration左右生成一个分片(EXT-X-PART), 关键帧开始新的分片, 地址是/app/stream-切片序号.分片序号.m4s
+	3. 还没有生成的下一个分片放在EXT-X-PRELOAD-HINT里面, 请求它的时候等到生成再回复
+	4. m3u8带_HLS_msn和_HLS_part的时候等到这个分片生成再回复, 超过3个target duration回复503
+	5. 磁盘上只写完整的切片和不带分片的m3u8
+*/
+
+const (
+	fmp4SegmentExt = ".m4s"
+	initExt        = ".mp4"
+)
+
+func (st *stream) initName(id uint64) string {
+	return fmt.Sprintf("%s-%d%s", st.key.Stream, id, initExt)
+}
+
+func (st *stream) partName(seq uint64, index int) string {
+	return fmt.Sprintf("%s-%d.%d%s", st.key.Stream, seq, index, fmp4SegmentExt)
+}
+
+// partFull 估计下一帧之后会超过PartDuration就在这一帧之前切换, 分片不会比PART-TARGET长
+func (st *stream) partFull(ts uint64) bool {
+	if ts <= st.partStart {
+		return false
+	}
+	var interval uint64
+	if ts > st.prev {
+		interval = ts - st.prev
+	}
+	return ts-st.partStart+interval > uint64(st.config.PartDuration/time.Millisecond)
+}
+
+// closePart next是下一帧的时间戳, 缓存的帧生成一个分片
+func (st *stream) closePart(next uint64) error {
+	if !st.config.LowLatency || st.cur == nil || next <= st.partStart {
+		return nil
+	}
+	var b bytes.Buffer
+	if err := st.muxer.flush(&b, next); err != nil {
+		return err
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	st.cur.parts = append(st.cur.parts, &part{
+		duration:    next - st.partStart,
+		independent: st.partIndependent,
+		data:        b.Bytes(),
+	})
+	st.partStart = next
+	st.notify()
+	return nil
+}
+
+// hasPart 切片msn的第index个分片已经生成, index小于0表示整个切片
+// 切片已经结束的时候分片没有那么多也算
+func (st *stream) hasPart(msn uint64, index int) bool {
+	if msn < st.nextSeq {
+		return true
+	}
+	if msn > st.nextSeq || index < 0 || st.cur == nil {
+		return false
+	}
+	return len(st.cur.parts) > index
+}
+
+// getPart 正在写的切片和保留的切片里面找
+func (st *stream) getPart(seq uint64, index int) *part {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.lastAccess = time.Now()
+	segments := st.segments
+	if st.cur != nil {
+		segments = append(segments[:len(segments):len(segments)], st.cur)
+	}
+	for _, seg := range segments {
+		if seg.seq == seq {
+			if index < len(seg.parts) {
+				return seg.parts[index]
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (st *stream) getInit(id uint64) *initSegment {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.lastAccess = time.Now()
+	if st.init != nil && st.init.id == id {
+		return st.init
+	}
+	for _, seg := range st.segments {
+		if seg.init != nil && seg.init.id == id {
+			return seg.init
+		}
+	}
+	return nil
+}
+
+// holdTimeout 阻塞的请求最多等3个target duration
+func (st *stream) holdTimeout() time.Duration {
+	return 3 * st.config.SegmentDuration
+}
+
+// tooFarAhead 请求的切片超过下一个切片之后两个
+func (st *stream) tooFarAhead(msn uint64) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return msn > st.nextSeq+2
+}
+
+// holdPlaylist _HLS_msn和_HLS_part, 等到请求的分片生成, 出错的时候返回http状态码
+func (st *stream) holdPlaylist(r *http.Request) (int, error) {
+	q := r.URL.Query()
+	msnParam, partParam := q.Get("_HLS_msn"), q.Get("_HLS_part")
+	if msnParam == "" {
+		if partParam != "" {
+			return http.StatusBadRequest, fmt.Errorf("_HLS_part without _HLS_msn")
+		}
+		return 0, nil
+	}
+	msn, err := strconv.ParseUint(msnParam, 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("wrong _HLS_msn:%s", msnParam)
+	}
+	index := -1
+	if partParam != "" {
+		if index, err = strconv.Atoi(partParam); err != nil || index < 0 {
+			return http.StatusBadRequest, fmt.Errorf("wrong _HLS_part:%s", partParam)
+		}
+	}
+	if st.tooFarAhead(msn) {
+		return http.StatusBadRequest, fmt.Errorf("_HLS_msn too far ahead:%d", msn)
+	}
+
+	err = st.wait(r.Context(), st.holdTimeout(), func() bool {
+		return st.hasPart(msn, index)
+	})
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+	return 0, nil
+}
+
+func (st *stream) writeServerControl(b *bytes.Buffer) {
+	partTarget := st.config.PartDuration.Seconds()
+	fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+	fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+}
+
+func (st *stream) writeParts(b *bytes.Buffer, seg *segment, query string) {
+	for i, p := range seg.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s%s\"", float64(p.duration)/1000, st.partName(seg.seq, i), query)
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// writeLiveEdge 正在写的切片已经生成的分片和下一个分片的EXT-X-PRELOAD-HINT
+func (st *stream) writeLiveEdge(b *bytes.Buffer, init *initSegment, query string) {
+	index := 0
+	if cur := st.cur; cur != nil && len(cur.parts) > 0 {
+		if cur.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if cur.init != init {
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s%s\"\n", st.initName(cur.init.id), query)
+		}
+		st.writeParts(b, cur, query)
+		index = len(cur.parts)
+	}
+	fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s%s\"\n", st.partName(st.nextSeq, index), query)
+}
+
+// playlistQuery 切片地址带上m3u8请求的参数, 去掉ll-hls的_HLS_msn这些
+func playlistQuery(rawQuery string) string {
+	var params []string
+	for _, p := range strings.Split(rawQuery, "&") {
+		if p != "" && !strings.HasPrefix(p, "_HLS_") {
+			params = append(params, p)
+		}
+	}
+	return strings.Join(params, "&")
+}
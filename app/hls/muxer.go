@@ -0,0 +1,132 @@
+package hls
+
+import (
+	"io"
+	"log"
+
+	"github.com/chinasarft/golive/container/mp4"
+	"github.com/chinasarft/golive/container/ts"
+	"github.com/chinasarft/golive/exchange"
+)
+
+// segmentMuxer 切片的封装格式, 普通hls是mpeg-ts, ll-hls是fmp4
+// ExData的Payload是flv tag data, 视频去掉5个字节的头就是带长度的nalu, aac去掉2个字节就是裸的aac帧
+type segmentMuxer interface {
+	// initSegment fmp4的ftyp moov, 放在EXT-X-MAP里面, ts是nil
+	initSegment() ([]byte, error)
+	// startSegment 新切片开始, ts之后的数据直接写到w
+	startSegment(w io.Writer) error
+	writeVideo(m *exchange.ExData, keyFrame bool) error
+	writeAudio(m *exchange.ExData) error
+	// flush fmp4把缓存的帧生成一个分片写到w, next是下一帧的时间戳
+	flush(w io.Writer, next uint64) error
+}
+
+// tsMuxer avc或者aac是nil表示没有这个track
+type tsMuxer struct {
+	muxer *ts.Muxer
+	avc   *ts.AvcConfig
+	aac   *ts.AacConfig
+	frame []byte // Annex-B或者ADTS的帧, 重复使用
+}
+
+func newTsMuxer(avc *ts.AvcConfig, aac *ts.AacConfig) *tsMuxer {
+	var videoType, audioType uint8
+	if avc != nil {
+		videoType = ts.StreamTypeH264
+	}
+	if aac != nil {
+		audioType = ts.StreamTypeAAC
+	}
+	return &tsMuxer{
+		muxer: ts.NewMuxer(nil, videoType, audioType),
+		avc:   avc,
+		aac:   aac,
+	}
+}
+
+func (t *tsMuxer) initSegment() ([]byte, error) {
+	return nil, nil
+}
+
+// startSegment 每个切片开头写PAT PMT, 连续计数器接着用
+func (t *tsMuxer) startSegment(w io.Writer) error {
+	t.muxer.Reset(w)
+	return t.muxer.WriteTables()
+}
+
+func (t *tsMuxer) writeVideo(m *exchange.ExData, keyFrame bool) error {
+	frame, err := ts.AvccToAnnexB(t.frame[:0], m.Payload[5:], t.avc, keyFrame)
+	if err != nil {
+		log.Println("hls drop video frame:", err)
+		return nil
+	}
+	t.frame = frame
+	dts := m.Timestamp * 90
+	// CompositionTime可以是负的, 和fmp4一样pts = dts + cts, 不能小于0
+	var pts uint64
+	if p := int64(dts) + int64(m.CompositionTime)*90; p > 0 {
+		pts = uint64(p)
+	}
+	return t.muxer.WriteVideo(pts, dts, keyFrame, frame)
+}
+
+func (t *tsMuxer) writeAudio(m *exchange.ExData) error {
+	t.frame = t.aac.AppendAdts(t.frame[:0], m.Payload[2:])
+	return t.muxer.WriteAudio(m.Timestamp*90, t.frame)
+}
+
+func (t *tsMuxer) flush(w io.Writer, next uint64) error {
+	return nil
+}
+
+// fmp4Muxer 每个分片单独下载, 数据偏移从moof开始算
+type fmp4Muxer struct {
+	fmp4 *mp4.Fmp4
+}
+
+// newFmp4Muxer videoConfig audioConfig是sequence header, nil表示没有这个track
+func newFmp4Muxer(videoConfig, audioConfig []byte) (*fmp4Muxer, error) {
+	f := mp4.NewFmp4(0)
+	f.SetDefaultBaseIsMoof()
+	f.AppendCompatibleBrand(mp4.Mp4BoxBrandISOM)
+	f.AppendCompatibleBrand(mp4.Mp4BoxBrandISO6)
+	if videoConfig != nil {
+		if err := f.AddVideoH264Track(videoConfig[5:]); err != nil {
+			return nil, err
+		}
+		f.AppendCompatibleBrand(mp4.Mp4BoxBrandAVC1)
+	}
+	if audioConfig != nil {
+		if err := f.AddAudioTrack(audioConfig[2:]); err != nil {
+			return nil, err
+		}
+	}
+	return &fmp4Muxer{fmp4: f}, nil
+}
+
+func (f *fmp4Muxer) initSegment() ([]byte, error) {
+	return f.fmp4.InitSegment()
+}
+
+func (f *fmp4Muxer) startSegment(w io.Writer) error {
+	return nil
+}
+
+func (f *fmp4Muxer) writeVideo(m *exchange.ExData, keyFrame bool) error {
+	return f.fmp4.AddVideoFrameWithCts(m.Payload[5:], int64(m.Timestamp), m.CompositionTime, keyFrame)
+}
+
+func (f *fmp4Muxer) writeAudio(m *exchange.ExData) error {
+	// 第一个关键帧之前的音频返回错误, 丢掉
+	f.fmp4.AddAudioFrameWithoutLen(m.Payload[2:], int64(m.Timestamp))
+	return nil
+}
+
+func (f *fmp4Muxer) flush(w io.Writer, next uint64) error {
+	if err := f.fmp4.FlushBefore(int64(next)); err != nil {
+		return err
+	}
+	_, err := f.fmp4.WriteMoofMdat(w)
+	return err
+}
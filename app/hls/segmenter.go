@@ -0,0 +1,647 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chinasarft/golive/container/ts"
+	"github.com/chinasarft/golive/exchange"
+)
+
+// 已经移出m3u8的切片再多保留几个, 播放器可能还在下载
+const extraSegments = 2
+
+var (
+	errStreamEnded = errors.New("hls stream ended")
+	errWaitTimeout = errors.New("wait hls segment timeout")
+)
+
+// initSegment fmp4的ftyp moov, sequence header变了之后换一个
+// id是第一个用它的切片的序号
+type initSegment struct {
+	id   uint64
+	data []byte
+}
+
+// part ll-hls的一个分片, 一个moof mdat
+type part struct {
+	duration    uint64 // 毫秒
+	independent bool   // 关键帧开始
+	data        []byte
+}
+
+// segment 一个切片, 生成之后不再改变
+type segment struct {
+	seq           uint64
+	duration      uint64 // 毫秒
+	discontinuity bool
+	init          *initSegment // 普通hls是nil
+	parts         []*part      // ll-hls的切片由这些分片组成
+	data          []byte       // 切片放在内存里面
+	path          string       // 切片放在磁盘上
+}
+
+// bytes ll-hls的切片就是分片拼起来
+func (seg *segment) bytes() []byte {
+	if seg.data != nil || seg.parts == nil {
+		return seg.data
+	}
+	var b bytes.Buffer
+	for _, p := range seg.parts {
+		b.Write(p.data)
+	}
+	return b.Bytes()
+}
+
+// stream 一路流的切片, 作为sink的StreamHandler
+type stream struct {
+	server *Server
+	key    exchange.StreamKey
+	config exchange.HlsConfig
+	dir    string // 空表示切片放在内存里面
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // stop的时候close
+
+	lock            sync.Mutex // WriteData在sink的协程, http请求和空闲检查在别的协程
+	ended           bool
+	stopped         bool
+	lastAccess      time.Time
+	waiting         int           // 等切片的请求, 不算空闲
+	updated         chan struct{} // 生成分片或者切片的时候close, 换一个新的
+	videoConfig     []byte
+	audioConfig     []byte
+	avc             *ts.AvcConfig // 不支持的编码是nil
+	aac             *ts.AacConfig
+	changed         bool // sequence header变了, 下一个可以切换的帧开始新切片
+	muxer           segmentMuxer
+	init            *initSegment
+	initPaths       []string // 磁盘上的init文件, stop的时候删除
+	hasVideo        bool     // muxer里面有没有视频
+	hasAudio        bool
+	buf             *bytes.Buffer
+	cur             *segment // 正在写的切片, 序号是nextSeq
+	start           uint64   // cur第一帧的时间戳
+	last            uint64   // 最后一帧的时间戳
+	prev            uint64   // 决定切换的track上一帧的时间戳, 用来估计帧间隔
+	partStart       uint64
+	partIndependent bool
+	nextSeq         uint64
+	segments        []*segment
+	discontinuity   uint64 // 已经删掉的切片里面EXT-X-DISCONTINUITY的个数
+}
+
+// dirPath 展开目录模板, 切片和m3u8的文件名也用流名, 名字不能作为路径的时候返回错误
+func dirPath(tmpl string, key exchange.StreamKey) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+	return exchange.ExpandPath(tmpl, key)
+}
+
+// newStream nextSeq是切片的起始序号, 重新开始切片的时候接着上一次的序号
+func newStream(s *Server, key exchange.StreamKey, config exchange.HlsConfig, nextSeq uint64) (*stream, error) {
+	dir, err := dirPath(config.Dir, key)
+	if err != nil {
+		return nil, err
+	}
+	st := &stream{
+		server:     s,
+		key:        key,
+		config:     config,
+		dir:        dir,
+		done:       make(chan struct{}),
+		lastAccess: time.Now(),
+		updated:    make(chan struct{}),
+		nextSeq:    nextSeq,
+	}
+	st.ctx, st.cancel = context.WithCancel(context.Background())
+	return st, nil
+}
+
+func (st *stream) GetStreamKey() exchange.StreamKey {
+	return st.key
+}
+
+func (st *stream) Cancel() {
+	st.cancel()
+}
+
+// run 推流结束之后还保留切片, 没有请求超过IdleTimeout之后stop
+func (st *stream) run() {
+	interval := st.config.IdleTimeout / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	sinkDone := st.ctx.Done()
+	for {
+		select {
+		case <-sinkDone:
+			// 推流结束或者等待推流超时
+			sinkDone = nil
+			st.lock.Lock()
+			st.end()
+			st.lock.Unlock()
+			st.server.pad.OnDestroySink(st)
+		case <-ticker.C:
+			if st.idle() {
+				log.Println(st.key.String(), "hls idle")
+				st.server.remove(st)
+				st.stop()
+			}
+		case <-st.done:
+			if sinkDone != nil {
+				st.server.pad.OnDestroySink(st)
+			}
+			return
+		}
+	}
+}
+
+func (st *stream) touch() {
+	st.lock.Lock()
+	st.lastAccess = time.Now()
+	st.lock.Unlock()
+}
+
+func (st *stream) idle() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.config.IdleTimeout > 0 && st.waiting == 0 && time.Since(st.lastAccess) > st.config.IdleTimeout
+}
+
+func (st *stream) isEnded() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.ended
+}
+
+func (st *stream) nextSequence() uint64 {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.nextSeq
+}
+
+// wait 等到ok返回true或者结束, timeout是0表示一直等
+// ok在持有锁的时候调用
+func (st *stream) wait(ctx context.Context, timeout time.Duration, ok func() bool) error {
+	st.lock.Lock()
+	st.waiting++
+	st.lock.Unlock()
+	defer func() {
+		st.lock.Lock()
+		st.waiting--
+		st.lastAccess = time.Now()
+		st.lock.Unlock()
+	}()
+
+	var expire <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expire = timer.C
+	}
+	for {
+		st.lock.Lock()
+		done := st.ended || ok()
+		updated := st.updated
+		st.lock.Unlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-expire:
+			return errWaitTimeout
+		}
+	}
+}
+
+// waitReady 等第一个切片
+func (st *stream) waitReady(ctx context.Context, timeout time.Duration) error {
+	return st.wait(ctx, timeout, func() bool {
+		return len(st.segments) > 0
+	})
+}
+
+// notify 唤醒等待的请求
+func (st *stream) notify() {
+	close(st.updated)
+	st.updated = make(chan struct{})
+}
+
+// stop 停止切片, 删除磁盘上的文件
+func (st *stream) stop() {
+	st.lock.Lock()
+	if st.stopped {
+		st.lock.Unlock()
+		return
+	}
+	st.stopped = true
+	st.end()
+	segments := st.segments
+	st.segments = nil
+	st.lock.Unlock()
+
+	close(st.done)
+	st.cancel()
+	if st.dir == "" {
+		return
+	}
+	for _, seg := range segments {
+		os.Remove(seg.path)
+	}
+	for _, path := range st.initPaths {
+		os.Remove(path)
+	}
+	os.Remove(filepath.Join(st.dir, st.key.Stream+playlistExt))
+	// 目录里面还有别的流的时候删不掉
+	os.Remove(st.dir)
+}
+
+func (st *stream) WriteData(m *exchange.ExData) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.ended {
+		return errStreamEnded
+	}
+
+	var err error
+	switch m.DataType {
+	case exchange.DataTypeVideoConfig:
+		st.setVideoConfig(m.Payload)
+	case exchange.DataTypeAudioConfig:
+		st.setAudioConfig(m.Payload)
+	case exchange.DataTypeVideoKeyFrame:
+		err = st.writeVideo(m, true)
+	case exchange.DataTypeVideo, exchange.DataTypeVideoNonKeyFrame:
+		err = st.writeVideo(m, false)
+	case exchange.DataTypeAudio:
+		err = st.writeAudio(m)
+	}
+	if err != nil {
+		// 写切片出错不影响推流, 只结束切片
+		log.Println(st.key.String(), "hls error:", err)
+		st.end()
+		st.cancel()
+	}
+	return nil
+}
+
+// setVideoConfig 只支持h264, 别的编码只切音频
+func (st *stream) setVideoConfig(payload []byte) {
+	if bytes.Equal(payload, st.videoConfig) {
+		return
+	}
+	st.videoConfig = append([]byte(nil), payload...)
+	st.avc = nil
+	st.changed = st.cur != nil
+	if len(payload) <= 5 || payload[0]&0x0f != 7 {
+		log.Println(st.key.String(), "hls only support h264")
+		return
+	}
+	avc, err := ts.ParseAvcConfig(payload[5:])
+	if err != nil {
+		log.Println(st.key.String(), "hls video config:", err)
+		return
+	}
+	st.avc = avc
+}
+
+// setAudioConfig 只支持aac
+func (st *stream) setAudioConfig(payload []byte) {
+	if bytes.Equal(payload, st.audioConfig) {
+		return
+	}
+	st.audioConfig = append([]byte(nil), payload...)
+	st.aac = nil
+	st.changed = st.cur != nil
+	if len(payload) < 4 || payload[0]>>4 != 10 {
+		log.Println(st.key.String(), "hls only support aac")
+		return
+	}
+	aac, err := ts.ParseAacConfig(payload[2:])
+	if err != nil {
+		log.Println(st.key.String(), "hls audio config:", err)
+		return
+	}
+	st.aac = aac
+}
+
+// full 超过SegmentDuration, 下一个可以切换的帧开始新切片
+func (st *stream) full(ts uint64) bool {
+	return ts > st.start && ts-st.start >= uint64(st.config.SegmentDuration/time.Millisecond)
+}
+
+// cut 在这一帧之前切换切片或者分片, 切片在关键帧开始, 纯音频任何一帧都可以
+// 分片满了PartDuration切换, 视频关键帧也开始新的分片, 纯音频每一帧都是keyFrame, 只看PartDuration
+func (st *stream) cut(ts uint64, keyFrame bool) error {
+	if keyFrame && (st.cur == nil || st.changed || st.full(ts)) {
+		if err := st.openSegment(ts); err != nil {
+			return err
+		}
+	} else if st.cur != nil && st.config.LowLatency && (keyFrame && st.avc != nil || st.partFull(ts)) {
+		if err := st.closePart(ts); err != nil {
+			return err
+		}
+		st.partIndependent = keyFrame
+	}
+	st.prev = ts
+	return nil
+}
+
+func (st *stream) writeVideo(m *exchange.ExData, keyFrame bool) error {
+	if st.avc == nil || len(m.Payload) <= 5 || m.Payload[1] != 1 {
+		return nil
+	}
+	if err := st.cut(m.Timestamp, keyFrame); err != nil {
+		return err
+	}
+	if st.cur == nil || !st.hasVideo {
+		// 等关键帧
+		return nil
+	}
+	st.last = m.Timestamp
+	return st.muxer.writeVideo(m, keyFrame)
+}
+
+// writeAudio 纯音频的流任何一帧都可以切换切片
+func (st *stream) writeAudio(m *exchange.ExData) error {
+	if st.aac == nil || len(m.Payload) <= 2 || m.Payload[1] != 1 {
+		return nil
+	}
+	if st.avc == nil {
+		if err := st.cut(m.Timestamp, true); err != nil {
+			return err
+		}
+	}
+	if st.cur == nil || !st.hasAudio {
+		return nil
+	}
+	if m.Timestamp > st.last {
+		st.last = m.Timestamp
+	}
+	return st.muxer.writeAudio(m)
+}
+
+// openSegment sequence header变了之后重新建muxer, 切片前面加EXT-X-DISCONTINUITY
+func (st *stream) openSegment(ts uint64) error {
+	if err := st.closeSegment(ts); err != nil {
+		return err
+	}
+
+	discontinuity := st.changed
+	if st.muxer == nil || st.changed {
+		if err := st.newMuxer(); err != nil {
+			return err
+		}
+	}
+	st.changed = false
+	size := 0
+	if st.buf != nil {
+		size = st.buf.Len()
+	}
+	st.buf = bytes.NewBuffer(make([]byte, 0, size))
+	st.cur = &segment{
+		seq:           st.nextSeq,
+		discontinuity: discontinuity,
+		init:          st.init,
+	}
+	st.start = ts
+	st.last = ts
+	st.partStart = ts
+	st.partIndependent = true
+	return st.muxer.startSegment(st.buf)
+}
+
+// newMuxer ll-hls用fmp4, 每个muxer一个init
+func (st *stream) newMuxer() error {
+	st.hasVideo = st.avc != nil
+	st.hasAudio = st.aac != nil
+	if !st.config.LowLatency {
+		st.muxer = newTsMuxer(st.avc, st.aac)
+		return nil
+	}
+
+	var videoConfig, audioConfig []byte
+	if st.hasVideo {
+		videoConfig = st.videoConfig
+	}
+	if st.hasAudio {
+		audioConfig = st.audioConfig
+	}
+	muxer, err := newFmp4Muxer(videoConfig, audioConfig)
+	if err != nil {
+		return err
+	}
+	data, err := muxer.initSegment()
+	if err != nil {
+		return err
+	}
+	st.muxer = muxer
+	st.init = &initSegment{
+		id:   st.nextSeq,
+		data: data,
+	}
+	if st.dir != "" {
+		path := filepath.Join(st.dir, st.initName(st.init.id))
+		if err = writeFile(path, data); err != nil {
+			return err
+		}
+		st.initPaths = append(st.initPaths, path)
+	}
+	return nil
+}
+
+func (st *stream) segmentExt() string {
+	if st.config.LowLatency {
+		return fmp4SegmentExt
+	}
+	return segmentExt
+}
+
+func (st *stream) segmentName(seq uint64) string {
+	return fmt.Sprintf("%s-%d%s", st.key.Stream, seq, st.segmentExt())
+}
+
+// closeSegment next是下一个切片第一帧的时间戳, 切片的时长是两个切片开始的时间差
+func (st *stream) closeSegment(next uint64) error {
+	seg := st.cur
+	if seg == nil {
+		return nil
+	}
+	if err := st.closePart(next); err != nil {
+		return err
+	}
+	st.cur = nil
+	if next <= st.start {
+		// 只有一帧或者时间戳回退, 序号给下一个切片用
+		return nil
+	}
+	seg.duration = next - st.start
+	st.nextSeq++
+
+	if !st.config.LowLatency {
+		seg.data = st.buf.Bytes()
+	}
+	if st.dir != "" {
+		seg.path = filepath.Join(st.dir, st.segmentName(seg.seq))
+		if err := writeFile(seg.path, seg.bytes()); err != nil {
+			return err
+		}
+		seg.data = nil
+	}
+	st.segments = append(st.segments, seg)
+	for len(st.segments) > st.config.PlaylistLength+extraSegments {
+		old := st.segments[0]
+		st.segments = st.segments[1:]
+		if old.discontinuity {
+			st.discontinuity++
+		}
+		if old.path != "" {
+			os.Remove(old.path)
+		}
+	}
+	st.notify()
+	return st.writePlaylistFile()
+}
+
+// end 推流结束, 最后一个切片的时长算到最后一帧, m3u8加上EXT-X-ENDLIST
+func (st *stream) end() {
+	if st.ended {
+		return
+	}
+	st.ended = true
+	if err := st.closeSegment(st.last); err != nil {
+		log.Println(st.key.String(), "hls close segment:", err)
+	}
+	if err := st.writePlaylistFile(); err != nil {
+		log.Println(st.key.String(), "hls write playlist:", err)
+	}
+	st.notify()
+}
+
+// writeFile 先写临时文件再改名, 别的http服务器不会读到写了一半的文件
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writePlaylistFile 切片放在磁盘上的时候m3u8也写一份, 切片地址不带参数, 没有ll-hls的分片
+func (st *stream) writePlaylistFile() error {
+	if st.dir == "" || st.stopped {
+		return nil
+	}
+	data := st.buildPlaylist("", false)
+	if data == nil {
+		return nil
+	}
+	return writeFile(filepath.Join(st.dir, st.key.Stream+playlistExt), data)
+}
+
+// playlist 没有切片的时候返回nil
+func (st *stream) playlist(query string) []byte {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.lastAccess = time.Now()
+	return st.buildPlaylist(query, st.config.LowLatency)
+}
+
+// buildPlaylist 最近PlaylistLength个切片, query加到切片地址后面, 鉴权的参数可以带过去
+func (st *stream) buildPlaylist(query string, lowLatency bool) []byte {
+	segments := st.segments
+	discontinuity := st.discontinuity
+	if n := len(segments) - st.config.PlaylistLength; n > 0 {
+		for _, seg := range segments[:n] {
+			if seg.discontinuity {
+				discontinuity++
+			}
+		}
+		segments = segments[n:]
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	target := uint64((st.config.SegmentDuration + time.Second - 1) / time.Second)
+	for _, seg := range segments {
+		if d := (seg.duration + 999) / 1000; d > target {
+			target = d
+		}
+	}
+	if query != "" {
+		query = "?" + query
+	}
+
+	var b bytes.Buffer
+	version := 3
+	if st.config.LowLatency {
+		// EXT-X-MAP
+		version = 6
+	}
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n", version, target)
+	if lowLatency {
+		st.writeServerControl(&b)
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].seq)
+	if discontinuity > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuity)
+	}
+
+	// 离结尾3个target duration以内的切片列出分片
+	partsFrom := len(segments)
+	for remain := 3 * target * 1000; partsFrom > 0 && segments[partsFrom-1].duration < remain; partsFrom-- {
+		remain -= segments[partsFrom-1].duration
+	}
+	var init *initSegment
+	for i, seg := range segments {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.init != init {
+			init = seg.init
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s%s\"\n", st.initName(init.id), query)
+		}
+		if lowLatency && i >= partsFrom {
+			st.writeParts(&b, seg, query)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s%s\n", float64(seg.duration)/1000, st.segmentName(seg.seq), query)
+	}
+	if st.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else if lowLatency {
+		st.writeLiveEdge(&b, init, query)
+	}
+	return b.Bytes()
+}
+
+// getSegment 移出m3u8的切片还可以下载
+func (st *stream) getSegment(seq uint64) *segment {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.lastAccess = time.Now()
+	for _, seg := range st.segments {
+		if seg.seq == seq {
+			return seg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/chinasarft/golive/container/mp4"
+	"github.com/chinasarft/golive/exchange"
+)
+
+// 纯音频没有关键帧触发生成分片, 按照这个间隔生成
+const fmp4AudioFragDuration = 1000
+
+// fmp4Segment 一个fmp4文件
+// ExData的Payload是flv tag data, 视频去掉5个字节的头就是带长度的nalu, aac去掉2个字节就是裸的aac帧
+type fmp4Segment struct {
+	path        string
+	file        *os.File
+	w           *bufio.Writer
+	fmp4        *mp4.Fmp4
+	videoConfig []byte
+	audioConfig []byte
+	changed     bool // sequence header变了, 下一个关键帧换文件
+	start       uint64
+	lastFlush   uint64
+	size        int64
+	maxSize     int64
+	maxLength   uint64
+}
+
+func createFmp4Segment(tmpl string, key exchange.StreamKey, ts uint64, config exchange.RecordConfig) (*fmp4Segment, error) {
+	file, err := createSegmentFile(tmpl, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fmp4Segment{
+		path:      file.Name(),
+		file:      file,
+		w:         bufio.NewWriterSize(file, 64*1024),
+		fmp4:      mp4.NewFmp4(0),
+		start:     ts,
+		maxSize:   config.MaxSize,
+		maxLength: uint64(config.MaxDuration / time.Millisecond),
+	}, nil
+}
+
+// writeHeader fmp4的moov里面没有metadata
+func (s *fmp4Segment) writeHeader(metaData, videoConfig, audioConfig []byte) error {
+	if videoConfig == nil && audioConfig == nil {
+		return fmt.Errorf("fmp4 record without sequence header")
+	}
+
+	s.fmp4.AppendCompatibleBrand(mp4.Mp4BoxBrandISOM)
+	s.fmp4.AppendCompatibleBrand(mp4.Mp4BoxBrandISO2)
+	if videoConfig != nil {
+		if len(videoConfig) < 6 || videoConfig[0]&0x0f != 7 {
+			return fmt.Errorf("fmp4 record only support h264")
+		}
+		if err := s.fmp4.AddVideoH264Track(videoConfig[5:]); err != nil {
+			return err
+		}
+		s.fmp4.AppendCompatibleBrand(mp4.Mp4BoxBrandAVC1)
+	}
+	s.fmp4.AppendCompatibleBrand(mp4.Mp4BoxBrandISO6)
+	s.fmp4.AppendCompatibleBrand(mp4.Mp4BoxBrandMP41)
+	if audioConfig != nil {
+		if len(audioConfig) < 4 || audioConfig[0]>>4 != 10 {
+			return fmt.Errorf("fmp4 record only support aac")
+		}
+		if err := s.fmp4.AddAudioTrack(audioConfig[2:]); err != nil {
+			return err
+		}
+	}
+	s.videoConfig = videoConfig
+	s.audioConfig = audioConfig
+	return nil
+}
+
+func (s *fmp4Segment) write(m *exchange.ExData) error {
+	var ts uint64
+	if m.Timestamp > s.start {
+		ts = m.Timestamp - s.start
+	}
+
+	var err error
+	switch m.DataType {
+	case exchange.DataTypeVideoConfig:
+		if !bytes.Equal(m.Payload, s.videoConfig) {
+			s.changed = true
+		}
+		return nil
+	case exchange.DataTypeAudioConfig:
+		if !bytes.Equal(m.Payload, s.audioConfig) {
+			s.changed = true
+		}
+		return nil
+	case exchange.DataTypeVideo, exchange.DataTypeVideoKeyFrame, exchange.DataTypeVideoNonKeyFrame:
+		if s.videoConfig == nil || len(m.Payload) <= 5 || m.Payload[1] != 1 {
+			return nil
+		}
+		err = s.fmp4.AddVideoFrameWithCts(m.Payload[5:], int64(ts), m.CompositionTime, m.DataType == exchange.DataTypeVideoKeyFrame)
+	case exchange.DataTypeAudio:
+		if s.audioConfig == nil || len(m.Payload) <= 2 || m.Payload[1] != 1 {
+			return nil
+		}
+		if err = s.fmp4.AddAudioFrameWithoutLen(m.Payload[2:], int64(ts)); err != nil {
+			// 第一个关键帧之前的音频
+			return nil
+		}
+		if s.videoConfig == nil && ts-s.lastFlush >= fmp4AudioFragDuration {
+			s.lastFlush = ts
+			err = s.fmp4.Flush()
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.writeFragments()
+}
+
+// writeFragments 每个分片生成之后马上写到文件里面
+func (s *fmp4Segment) writeFragments() error {
+	n, err := s.fmp4.WriteFragments(s.w)
+	if err != nil || n == 0 {
+		return err
+	}
+	s.size += int64(n)
+	return s.w.Flush()
+}
+
+func (s *fmp4Segment) full(ts uint64) bool {
+	if s.changed {
+		return true
+	}
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		return true
+	}
+	return s.maxLength > 0 && ts > s.start && ts-s.start >= s.maxLength
+}
+
+func (s *fmp4Segment) filePath() string {
+	return s.path
+}
+
+// close 最后一个gop也生成分片
+func (s *fmp4Segment) close() error {
+	err := s.fmp4.Flush()
+	if err == nil {
+		err = s.writeFragments()
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	if s.size == 0 {
+		// 一个分片都没有的文件不能播放
+		os.Remove(s.path)
+	}
+	return err
+}
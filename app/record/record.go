@@ -0,0 +1,327 @@
+package record
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chinasarft/golive/exchange"
+)
+
+/*
+	录制成分段的flv文件
+	1. 本地推流注册之后exchange调用Record, app配置了Enabled就注册一个sink开始录制
+	2. 每一段文件: flv header, onMetaData, sequence header, 然后从关键帧开始的音视频
+	3. 超过MaxDuration或者MaxSize之后在下一个关键帧切换文件，时间戳每一段从0开始
+	4. 每一段关闭之后按照MaxAge和MaxTotalBytes清理这个app的录制目录
+	5. Start/Stop可以单独打开或者关闭某一路流的录制，不管app的配置
+	6. rtmp publish类型是record/append的时候录制到PublishPath一个文件, record覆盖, append接着原来的时间戳追加
+	7. Format是mp4的时候录成fmp4, 每个gop一个moof mdat, 生成就写文件, 推流断开的时候文件也是可以播放的
+*/
+
+// publishQuerier exchange.ConnPool, 查询流是否已经推上来
+type publishQuerier interface {
+	GetPublishStats(key exchange.StreamKey) *exchange.PublishStats
+}
+
+type Recorder struct {
+	pad        exchange.Pad
+	lock       sync.Mutex
+	recordings map[string]*recording
+	overrides  map[string]bool // Start/Stop设置的, 优先于app配置的Enabled
+	openFiles  map[string]bool // 正在写的文件, 清理的时候跳过
+	cleanLock  sync.Mutex
+}
+
+func NewRecorder(pad exchange.Pad) *Recorder {
+	return &Recorder{
+		pad:        pad,
+		recordings: make(map[string]*recording),
+		overrides:  make(map[string]bool),
+		openFiles:  make(map[string]bool),
+	}
+}
+
+// Record 实现exchange.Recorder
+func (r *Recorder) Record(key exchange.StreamKey, publishType string, config exchange.RecordConfig) {
+	r.lock.Lock()
+	enabled, ok := r.overrides[key.String()]
+	r.lock.Unlock()
+	if ok && !enabled {
+		// Stop关闭的流推流端要求录制也不录
+		return
+	}
+	switch publishType {
+	case exchange.PublishTypeRecord, exchange.PublishTypeAppend:
+		r.start(key, publishType, config)
+		return
+	}
+	if !ok {
+		enabled = config.Enabled
+	}
+	if enabled {
+		r.start(key, exchange.PublishTypeLive, config)
+	}
+}
+
+// Start 打开某一路流的录制, 流还没有推上来的话等推流之后开始
+func (r *Recorder) Start(key exchange.StreamKey) error {
+	r.lock.Lock()
+	r.overrides[key.String()] = true
+	r.lock.Unlock()
+
+	// 没有推流的时候不注册sink, 否则等待推流超时之后就被Cancel了
+	if q, ok := r.pad.(publishQuerier); ok && q.GetPublishStats(key) == nil {
+		return nil
+	}
+	return r.start(key, exchange.PublishTypeLive, exchange.GetAppConfig(key).Record)
+}
+
+// Stop 关闭某一路流的录制, 之后重新推流也不录
+func (r *Recorder) Stop(key exchange.StreamKey) {
+	r.lock.Lock()
+	r.overrides[key.String()] = false
+	rec := r.recordings[key.String()]
+	r.lock.Unlock()
+	if rec != nil {
+		rec.Cancel()
+	}
+}
+
+func (r *Recorder) start(key exchange.StreamKey, publishType string, config exchange.RecordConfig) error {
+	// 名字要作为文件路径, 不能写到录制目录外面
+	if err := key.CheckPath(); err != nil {
+		log.Println(key.String(), "record:", err)
+		return err
+	}
+	r.lock.Lock()
+	if _, ok := r.recordings[key.String()]; ok {
+		// 抢流的时候录制跟着观看者一起转到新的source
+		r.lock.Unlock()
+		return nil
+	}
+	rec := newRecording(r, key, publishType, config)
+	r.recordings[key.String()] = rec
+	r.lock.Unlock()
+
+	if err := r.pad.OnSinkDetermined(rec, rec.ctx); err != nil {
+		log.Println(key.String(), "record register sink:", err)
+		r.remove(rec)
+		rec.cancel()
+		return err
+	}
+	go rec.wait()
+	return nil
+}
+
+func (r *Recorder) remove(rec *recording) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.recordings[rec.key.String()] == rec {
+		delete(r.recordings, rec.key.String())
+	}
+}
+
+func (r *Recorder) setFileOpen(path string, open bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if open {
+		r.openFiles[path] = true
+	} else {
+		delete(r.openFiles, path)
+	}
+}
+
+func (r *Recorder) isFileOpen(path string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.openFiles[path]
+}
+
+// ServeHTTP /record/start和/record/stop, 参数app stream, 可选vhost
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	key := exchange.StreamKey{
+		Vhost:  q.Get("vhost"),
+		App:    q.Get("app"),
+		Stream: q.Get("stream"),
+	}
+	if key.Vhost == "" {
+		key.Vhost = exchange.DefaultVhost
+	}
+	if err := key.CheckPath(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/start"):
+		if err := r.Start(key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case strings.HasSuffix(req.URL.Path, "/stop"):
+		r.Stop(key)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// recording 一路流的录制, 作为sink的StreamHandler
+type recording struct {
+	recorder    *Recorder
+	key         exchange.StreamKey
+	publishType string // live按照Path分段, record/append只写PublishPath一个文件
+	config      exchange.RecordConfig
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	lock        sync.Mutex // WriteData在sink协程, 关闭在wait协程
+	closed      bool
+	metaData    []byte
+	videoConfig []byte
+	audioConfig []byte
+	segment     segmentWriter
+}
+
+// segmentWriter 一个录制文件, flv或者fmp4
+type segmentWriter interface {
+	writeHeader(metaData, videoConfig, audioConfig []byte) error
+	write(m *exchange.ExData) error
+	full(ts uint64) bool
+	filePath() string
+	close() error
+}
+
+func newRecording(r *Recorder, key exchange.StreamKey, publishType string, config exchange.RecordConfig) *recording {
+	rec := &recording{
+		recorder:    r,
+		key:         key,
+		publishType: publishType,
+		config:      config,
+	}
+	rec.ctx, rec.cancel = context.WithCancel(context.Background())
+	return rec
+}
+
+func (rec *recording) GetStreamKey() exchange.StreamKey {
+	return rec.key
+}
+
+func (rec *recording) Cancel() {
+	rec.cancel()
+}
+
+// wait 推流结束或者Stop的时候关闭文件
+func (rec *recording) wait() {
+	<-rec.ctx.Done()
+	rec.lock.Lock()
+	rec.closed = true
+	rec.closeSegment()
+	rec.lock.Unlock()
+
+	rec.recorder.pad.OnDestroySink(rec)
+	rec.recorder.remove(rec)
+}
+
+func (rec *recording) WriteData(m *exchange.ExData) error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.closed {
+		return fmt.Errorf("record closed")
+	}
+
+	var err error
+	switch m.DataType {
+	case exchange.DataTypeDataAMF0:
+		rec.metaData = append([]byte(nil), m.Payload...)
+		err = rec.writeTag(m)
+	case exchange.DataTypeVideoConfig:
+		rec.videoConfig = append([]byte(nil), m.Payload...)
+		err = rec.writeTag(m)
+	case exchange.DataTypeAudioConfig:
+		rec.audioConfig = append([]byte(nil), m.Payload...)
+		err = rec.writeTag(m)
+	case exchange.DataTypeVideoKeyFrame:
+		err = rec.writeFrame(m, true)
+	case exchange.DataTypeVideo, exchange.DataTypeVideoNonKeyFrame:
+		err = rec.writeFrame(m, false)
+	case exchange.DataTypeAudio:
+		// 纯音频的流任何一帧都可以切换文件
+		err = rec.writeFrame(m, rec.videoConfig == nil)
+	}
+	if err != nil {
+		// 写文件出错不影响推流, 只结束录制
+		log.Println(rec.key.String(), "record error:", err)
+		rec.closed = true
+		rec.closeSegment()
+		rec.cancel()
+	}
+	return nil
+}
+
+// writeTag metadata和sequence header, 还没有文件的时候等打开文件的时候写
+func (rec *recording) writeTag(m *exchange.ExData) error {
+	if rec.segment == nil {
+		return nil
+	}
+	return rec.segment.write(m)
+}
+
+func (rec *recording) writeFrame(m *exchange.ExData, canSplit bool) error {
+	if canSplit && (rec.segment == nil || rec.segment.full(m.Timestamp)) {
+		if err := rec.openSegment(m.Timestamp); err != nil {
+			return err
+		}
+	}
+	if rec.segment == nil {
+		// 等关键帧
+		return nil
+	}
+	return rec.segment.write(m)
+}
+
+func (rec *recording) openSegment(ts uint64) error {
+	rec.closeSegment()
+	var seg segmentWriter
+	var err error
+	switch {
+	case rec.publishType != exchange.PublishTypeLive:
+		var path string
+		if path, err = segmentPath(rec.config.PublishPath, rec.key, time.Now()); err != nil {
+			return err
+		}
+		seg, err = openPublishFile(path, ts, rec.publishType == exchange.PublishTypeAppend)
+	case rec.config.Format == exchange.RecordFormatFmp4:
+		seg, err = createFmp4Segment(rec.config.Path, rec.key, ts, rec.config)
+	default:
+		seg, err = createSegment(rec.config.Path, rec.key, ts, rec.config)
+	}
+	if err != nil {
+		return err
+	}
+	rec.recorder.setFileOpen(seg.filePath(), true)
+	rec.segment = seg
+	log.Println(rec.key.String(), "record segment:", seg.filePath())
+	return seg.writeHeader(rec.metaData, rec.videoConfig, rec.audioConfig)
+}
+
+func (rec *recording) closeSegment() {
+	if rec.segment == nil {
+		return
+	}
+	if err := rec.segment.close(); err != nil {
+		log.Println(rec.key.String(), "record close:", err)
+	}
+	rec.recorder.setFileOpen(rec.segment.filePath(), false)
+	rec.segment = nil
+	if rec.publishType == exchange.PublishTypeLive {
+		go rec.recorder.clean(rec.key, rec.config)
+	}
+}
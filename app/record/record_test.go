@@ -0,0 +1,404 @@
+package record
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chinasarft/golive/container/flv"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/exchange/exchangetest"
+	"github.com/chinasarft/golive/utils/amf"
+	"github.com/chinasarft/golive/utils/byteio"
+)
+
+// putFrames onMetaData, 然后是exchangetest.Frames, 每一帧之间稍微等一下，避免推流队列丢帧
+func putFrames(t *testing.T, put exchange.PutData, seconds int) {
+	var meta bytes.Buffer
+	amf.WriteValue(&meta, "onMetaData")
+	amf.WriteValue(&meta, amf.Object{"width": float64(480)})
+	put(&exchange.ExData{
+		DataType: exchange.DataTypeDataAMF0,
+		AvFormat: exchange.AvFormatData,
+		Payload:  meta.Bytes(),
+	})
+	for _, m := range exchangetest.Frames(0, uint64(seconds)*1000, false) {
+		if err := put(m); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func waitRecordDone(t *testing.T, r *Recorder) {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		r.lock.Lock()
+		n := len(r.recordings)
+		r.lock.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("record not stopped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// sortSegments 同一秒的文件后面加了序号, s-time.flv在s-time-1.flv前面
+func sortSegments(files []string) {
+	order := func(file string) string {
+		name := filepath.Base(file)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		if strings.Count(name, "-") == 2 {
+			name += "-0"
+		}
+		return name
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return order(files[i]) < order(files[j])
+	})
+}
+
+func readSegment(t *testing.T, path string) []*flv.FlvTag {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, hasVideo, err := flv.ParseFileHeader(f); err != nil || !hasVideo {
+		t.Fatalf("%s header:%v", path, err)
+	}
+	var tags []*flv.FlvTag
+	for {
+		tag, err := flv.ParseTag(f)
+		if err == io.EOF {
+			return tags
+		}
+		if err != nil {
+			t.Fatalf("%s:%v", path, err)
+		}
+		tags = append(tags, tag)
+	}
+}
+
+func TestRecordSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := exchange.DefaultAppConfig()
+	config.Record = exchange.RecordConfig{
+		Enabled:     true,
+		Path:        filepath.Join(dir, "{app}", "{stream}-{time}.flv"),
+		MaxDuration: 2 * time.Second,
+	}
+	exchange.SetAppConfig("recordtest", config)
+	pool := exchange.GetExchanger()
+	recorder := NewRecorder(pool)
+	exchange.SetRecorder(recorder)
+	defer exchange.SetRecorder(nil)
+
+	p, put := exchangetest.Publish(t, pool, "recordtest")
+	putFrames(t, put, 5)
+	time.Sleep(100 * time.Millisecond)
+	p.Cancel()
+	pool.OnDestroySource(p)
+	waitRecordDone(t, recorder)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "recordtest", "s-*.flv"))
+	sortSegments(files)
+	if len(files) != 3 {
+		t.Fatalf("expect 3 segments, got %v", files)
+	}
+	for _, file := range files {
+		tags := readSegment(t, file)
+		// metadata, sequence header, 然后从关键帧开始, 时间戳从0开始
+		if len(tags) < 3 || tags[0].TagType != flv.FlvTagAMF0 || tags[1].Data[1] != 0 ||
+			tags[2].Data[0] != 0x17 || tags[2].Timestamp != 0 {
+			t.Fatalf("%s wrong segment start", file)
+		}
+	}
+}
+
+func TestRecordStartStopAndRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 之前的录制文件, 超过MaxAge
+	appDir := filepath.Join(dir, "recordctl")
+	os.MkdirAll(appDir, 0755)
+	old := filepath.Join(appDir, "old-20200101-000000-1.flv")
+	// record/append的文件和不是模板生成的文件不清理
+	keep := []string{
+		filepath.Join(appDir, "pub.flv"),
+		filepath.Join(appDir, "old-2020.flv"),
+		filepath.Join(appDir, "notes.txt"),
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	for _, file := range append(keep, old) {
+		ioutil.WriteFile(file, make([]byte, 100), 0644)
+		os.Chtimes(file, past, past)
+	}
+
+	config := exchange.DefaultAppConfig()
+	config.Record = exchange.RecordConfig{
+		Path:        filepath.Join(dir, "{app}", "{stream}-{time}.flv"),
+		PublishPath: filepath.Join(dir, "{app}", "{stream}.flv"),
+		MaxAge:      time.Hour,
+	}
+	exchange.SetAppConfig("recordctl", config)
+	pool := exchange.GetExchanger()
+	recorder := NewRecorder(pool)
+	exchange.SetRecorder(recorder)
+	defer exchange.SetRecorder(nil)
+
+	// app没有打开录制, 单独打开这一路流
+	p, put := exchangetest.Publish(t, pool, "recordctl")
+	if err := recorder.Start(p.GetStreamKey()); err != nil {
+		t.Fatal(err)
+	}
+	putFrames(t, put, 1)
+	time.Sleep(100 * time.Millisecond)
+	recorder.Stop(p.GetStreamKey())
+	waitRecordDone(t, recorder)
+	p.Cancel()
+	pool.OnDestroySource(p)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := os.Stat(old); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired file not removed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	files, _ := filepath.Glob(filepath.Join(appDir, "s-*.flv"))
+	if len(files) != 1 {
+		t.Fatalf("expect 1 segment, got %v", files)
+	}
+	for _, file := range keep {
+		if _, err := os.Stat(file); err != nil {
+			t.Fatalf("%s removed", file)
+		}
+	}
+
+	// Stop之后重新推流也不录
+	p, put = exchangetest.Publish(t, pool, "recordctl")
+	putFrames(t, put, 1)
+	p.Cancel()
+	pool.OnDestroySource(p)
+	recorder.lock.Lock()
+	n := len(recorder.recordings)
+	recorder.lock.Unlock()
+	if n != 0 {
+		t.Fatal("stopped stream should not record")
+	}
+}
+
+func TestRecordPublishAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := exchange.DefaultAppConfig()
+	config.Record = exchange.RecordConfig{
+		PublishPath: filepath.Join(dir, "{app}", "{stream}.flv"),
+	}
+	exchange.SetAppConfig("recordpub", config)
+	pool := exchange.GetExchanger()
+	recorder := NewRecorder(pool)
+	exchange.SetRecorder(recorder)
+	defer exchange.SetRecorder(nil)
+
+	file := filepath.Join(dir, "recordpub", "s.flv")
+	publishOnce := func(publishType string) []*flv.FlvTag {
+		p, put := exchangetest.PublishWithType(t, pool, "recordpub", publishType)
+		putFrames(t, put, 1)
+		time.Sleep(100 * time.Millisecond)
+		p.Cancel()
+		pool.OnDestroySource(p)
+		waitRecordDone(t, recorder)
+		return readSegment(t, file)
+	}
+
+	first := publishOnce(exchange.PublishTypeRecord)
+	last := first[len(first)-1].Timestamp
+	if last != 960 {
+		t.Fatalf("expect last timestamp 960 but %d", last)
+	}
+	// record覆盖原来的文件
+	if tags := publishOnce(exchange.PublishTypeRecord); len(tags) != len(first) {
+		t.Fatalf("record should overwrite, %d tags", len(tags))
+	}
+
+	// 最后一个tag写了一半
+	f, _ := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{flv.FlvTagVideo, 0, 0, 9})
+	f.Close()
+
+	// append接着原来的时间戳, 只重新写sequence header
+	tags := publishOnce(exchange.PublishTypeAppend)
+	appended := tags[len(first):]
+	if len(appended) != len(first)-1 || appended[0].Data[1] != 0 || appended[0].Timestamp != last+1 {
+		t.Fatalf("wrong appended tags:%d", len(appended))
+	}
+	if ts := appended[len(appended)-1].Timestamp; ts != last+1+960 {
+		t.Fatalf("expect appended timestamp %d but %d", last+1+960, ts)
+	}
+}
+
+// fmp4Boxes 按照box头遍历顶层box
+func fmp4Boxes(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var boxes []string
+	for offset := 0; offset+8 <= len(data); {
+		size := int(byteio.U32BE(data[offset:]))
+		if size < 8 || offset+size > len(data) {
+			t.Fatalf("%s broken box at %d", path, offset)
+		}
+		boxes = append(boxes, string(data[offset+4:offset+8]))
+		offset += size
+	}
+	return boxes
+}
+
+func TestRecordFmp4(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := exchange.DefaultAppConfig()
+	config.Record = exchange.RecordConfig{
+		Enabled:     true,
+		Format:      exchange.RecordFormatFmp4,
+		Path:        filepath.Join(dir, "{app}", "{stream}-{time}.mp4"),
+		MaxDuration: 2 * time.Second,
+	}
+	exchange.SetAppConfig("recordmp4", config)
+	pool := exchange.GetExchanger()
+	recorder := NewRecorder(pool)
+	exchange.SetRecorder(recorder)
+	defer exchange.SetRecorder(nil)
+
+	p, put := exchangetest.Publish(t, pool, "recordmp4")
+	avcC, _ := hex.DecodeString("0142c015ffe1001c6742c015d901e096ffc0040003c4000003000400000300c83c58b92001000568cb83cb20")
+	put(&exchange.ExData{
+		DataType: exchange.DataTypeVideoConfig,
+		AvFormat: exchange.AvFormatAVC,
+		Payload:  append([]byte{0x17, 0, 0, 0, 0}, avcC...),
+	})
+	put(&exchange.ExData{
+		DataType: exchange.DataTypeAudioConfig,
+		AvFormat: exchange.AvFormatAAC,
+		Payload:  []byte{0xaf, 0, 0x14, 0x08},
+	})
+	for ts := uint64(0); ts < 3000; ts += 100 {
+		m := &exchange.ExData{
+			Timestamp: ts,
+			DataType:  exchange.DataTypeVideoNonKeyFrame,
+			AvFormat:  exchange.AvFormatAVC,
+			Payload:   []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 1, 0x41},
+		}
+		if ts%1000 == 0 {
+			m.DataType = exchange.DataTypeVideoKeyFrame
+			m.Payload = []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 1, 0x65}
+		}
+		put(m)
+		put(&exchange.ExData{
+			Timestamp: ts,
+			DataType:  exchange.DataTypeAudio,
+			AvFormat:  exchange.AvFormatAAC,
+			Payload:   []byte{0xaf, 1, 0x21, 0x10},
+		})
+		time.Sleep(2 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// 推流断开之前已经生成的分片都在文件里面了
+	files, _ := filepath.Glob(filepath.Join(dir, "recordmp4", "s-*.mp4"))
+	sortSegments(files)
+	if len(files) != 2 {
+		t.Fatalf("expect 2 segments, got %v", files)
+	}
+	if boxes := fmp4Boxes(t, files[0]); fmt.Sprint(boxes) != "[ftyp moov moof mdat moof mdat]" {
+		t.Fatalf("unexpected boxes %v", boxes)
+	}
+
+	// 断开之后最后一个gop也写进去
+	p.Cancel()
+	pool.OnDestroySource(p)
+	waitRecordDone(t, recorder)
+	if boxes := fmp4Boxes(t, files[1]); fmt.Sprint(boxes) != "[ftyp moov moof mdat]" {
+		t.Fatalf("unexpected boxes %v", boxes)
+	}
+}
+
+func TestRecordRejectPathName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := exchange.RecordConfig{
+		Enabled:     true,
+		Path:        filepath.Join(dir, "{app}", "{stream}-{time}.flv"),
+		PublishPath: filepath.Join(dir, "{app}", "{stream}.flv"),
+		MaxAge:      time.Hour,
+	}
+	recorder := NewRecorder(exchange.GetExchanger())
+	key := exchange.StreamKey{Vhost: exchange.DefaultVhost, App: "live/../..", Stream: "s"}
+	recorder.Record(key, exchange.PublishTypeLive, config)
+	// record会用O_TRUNC打开PublishPath
+	recorder.Record(key, exchange.PublishTypeRecord, config)
+	recorder.Record(key, exchange.PublishTypeAppend, config)
+	recorder.lock.Lock()
+	n := len(recorder.recordings)
+	recorder.lock.Unlock()
+	if n != 0 {
+		t.Fatal("should not record outside the record dir")
+	}
+
+	w := httptest.NewRecorder()
+	recorder.ServeHTTP(w, httptest.NewRequest("GET", "/record/start?app=live&stream=..", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expect 400 but %d", w.Code)
+	}
+
+	// 清理也不能遍历录制目录外面
+	outside := filepath.Join(filepath.Dir(dir), filepath.Base(dir)+"-s-20200101-000000.flv")
+	ioutil.WriteFile(outside, nil, 0644)
+	defer os.Remove(outside)
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(outside, past, past)
+	recorder.clean(exchange.StreamKey{Vhost: exchange.DefaultVhost, App: "..", Stream: "s"}, config)
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatal("file outside the record dir removed")
+	}
+}
@@ -0,0 +1,144 @@
+package record
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chinasarft/golive/exchange"
+)
+
+type recordFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// appRecordDir 路径模板里面第一个和流相关的变量之前的目录, 这个app所有的录制文件都在下面
+func appRecordDir(tmpl string, key exchange.StreamKey) string {
+	p := strings.NewReplacer("{vhost}", key.Vhost, "{app}", key.App).Replace(tmpl)
+	if idx := strings.Index(p, "{"); idx >= 0 {
+		p = p[:idx]
+	}
+	if strings.HasSuffix(p, "/") || strings.HasSuffix(p, string(filepath.Separator)) {
+		return filepath.Clean(p)
+	}
+	return filepath.Dir(p)
+}
+
+var templateVar = regexp.MustCompile(`\{(stream|time)\}`)
+
+// segmentMatcher 判断文件是不是Path模板展开的分段文件
+// {stream}不能有/, {time}要能解析, 扩展名前面可以有同一秒切换文件加的序号
+type segmentMatcher struct {
+	re   *regexp.Regexp
+	vars []string // 每个分组对应的变量
+}
+
+func newSegmentMatcher(tmpl string, key exchange.StreamKey) *segmentMatcher {
+	p := strings.NewReplacer("{vhost}", key.Vhost, "{app}", key.App).Replace(tmpl)
+	p = filepath.ToSlash(filepath.Clean(p))
+	ext := path.Ext(p)
+	p = strings.TrimSuffix(p, ext)
+
+	m := &segmentMatcher{}
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	for _, loc := range templateVar.FindAllStringSubmatchIndex(p, -1) {
+		expr.WriteString(regexp.QuoteMeta(p[last:loc[0]]))
+		name := p[loc[2]:loc[3]]
+		if name == "time" {
+			expr.WriteString(`(\d{8}-\d{6})`)
+		} else {
+			expr.WriteString(`([^/]+)`)
+		}
+		m.vars = append(m.vars, name)
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(p[last:]) + `(?:-\d+)?` + regexp.QuoteMeta(ext) + "$")
+	m.re = regexp.MustCompile(expr.String())
+	return m
+}
+
+// match 返回文件名里面的流名
+func (m *segmentMatcher) match(file string) (string, bool) {
+	sub := m.re.FindStringSubmatch(filepath.ToSlash(file))
+	if sub == nil {
+		return "", false
+	}
+	var stream string
+	for i, name := range m.vars {
+		if name == "stream" {
+			stream = sub[i+1]
+		} else if _, err := time.Parse(segmentTimeFormat, sub[i+1]); err != nil {
+			return "", false
+		}
+	}
+	return stream, true
+}
+
+// isSegment 只清理分段文件, 同一个目录下record/append的PublishPath文件和别的文件都不动
+func isSegment(m *segmentMatcher, file string, key exchange.StreamKey, config exchange.RecordConfig) bool {
+	stream, ok := m.match(file)
+	if !ok {
+		return false
+	}
+	if config.PublishPath != "" {
+		key.Stream = stream
+		if p, err := segmentPath(config.PublishPath, key, time.Time{}); err == nil && filepath.Clean(p) == filepath.Clean(file) {
+			return false
+		}
+	}
+	return true
+}
+
+// clean 删除超过MaxAge的文件, 然后从最老的开始删除直到总大小不超过MaxTotalBytes
+func (r *Recorder) clean(key exchange.StreamKey, config exchange.RecordConfig) {
+	if config.MaxAge <= 0 && config.MaxTotalBytes <= 0 {
+		return
+	}
+	// 名字拼在要遍历删除的目录里面
+	if err := key.CheckPath(); err != nil {
+		log.Println(key.String(), "record clean:", err)
+		return
+	}
+	r.cleanLock.Lock()
+	defer r.cleanLock.Unlock()
+
+	dir := appRecordDir(config.Path, key)
+	matcher := newSegmentMatcher(config.Path, key)
+	var files []recordFile
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || r.isFileOpen(path) || !isSegment(matcher, path, key, config) {
+			return nil
+		}
+		files = append(files, recordFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	now := time.Now()
+	for _, f := range files {
+		expired := config.MaxAge > 0 && now.Sub(f.modTime) > config.MaxAge
+		overflow := config.MaxTotalBytes > 0 && total > config.MaxTotalBytes
+		if !expired && !overflow {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Println("record remove:", err)
+			continue
+		}
+		log.Println("record removed:", f.path)
+		total -= f.size
+	}
+}
@@ -0,0 +1,216 @@
+package record
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chinasarft/golive/container/flv"
+	"github.com/chinasarft/golive/exchange"
+)
+
+const segmentTimeFormat = "20060102-150405"
+
+// segment 一个flv文件
+type segment struct {
+	path      string
+	file      *os.File
+	w         *bufio.Writer
+	start     uint64 // 第一帧的时间戳, 文件里面的时间戳减去它
+	base      uint64 // 追加的时候接在原来文件最后的时间戳后面
+	appended  bool
+	size      int64
+	maxSize   int64
+	maxLength uint64 // 毫秒
+}
+
+// segmentPath 展开路径模板, vhost app stream不能作为路径的时候返回错误
+func segmentPath(tmpl string, key exchange.StreamKey, t time.Time) (string, error) {
+	return exchange.ExpandPath(tmpl, key, "{time}", t.Format(segmentTimeFormat))
+}
+
+// createSegmentFile 展开路径模板并创建文件, 同一秒里面切换文件的时候加序号
+func createSegmentFile(tmpl string, key exchange.StreamKey) (*os.File, error) {
+	path, err := segmentPath(tmpl, key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 0; ; i++ {
+		if i > 0 {
+			path = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return file, err
+		}
+	}
+}
+
+func createSegment(tmpl string, key exchange.StreamKey, ts uint64, config exchange.RecordConfig) (*segment, error) {
+	file, err := createSegmentFile(tmpl, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &segment{
+		path:      file.Name(),
+		file:      file,
+		w:         bufio.NewWriterSize(file, 64*1024),
+		start:     ts,
+		maxSize:   config.MaxSize,
+		maxLength: uint64(config.MaxDuration / time.Millisecond),
+	}, nil
+}
+
+// openPublishFile rtmp publish类型record/append的文件, 不分段
+// append的时候文件不存在或者不是flv就和record一样重新写
+func openPublishFile(path string, ts uint64, appendFile bool) (*segment, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	s := &segment{
+		path:  path,
+		start: ts,
+	}
+
+	var err error
+	if appendFile {
+		var last uint64
+		var end int64
+		if last, end, err = scanFlvFile(path); err == nil {
+			// 接在最后一个tag后面, 第一个tag不能和它的时间戳重复
+			s.base = last + 1
+			if s.file, err = os.OpenFile(path, os.O_WRONLY, 0644); err != nil {
+				return nil, err
+			}
+			// 上次异常退出的时候最后一个tag可能不完整
+			if err = s.file.Truncate(end); err == nil {
+				_, err = s.file.Seek(end, io.SeekStart)
+			}
+			if err != nil {
+				s.file.Close()
+				return nil, err
+			}
+			s.appended = true
+			s.size = end
+		} else if !os.IsNotExist(err) {
+			log.Println("record append", path, err, ", rewrite")
+		}
+	}
+	if s.file == nil {
+		if s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			return nil, err
+		}
+	}
+	s.w = bufio.NewWriterSize(s.file, 64*1024)
+	return s, nil
+}
+
+// scanFlvFile 返回最后一个tag的时间戳和最后一个完整tag结束的位置
+func scanFlvFile(path string) (lastTimestamp uint64, end int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if _, _, err = flv.ParseFileHeader(r); err != nil {
+		return 0, 0, err
+	}
+	end = flv.FlvHeaderSize + 4
+	for {
+		tag, err := flv.ParseTag(r)
+		if err != nil {
+			break
+		}
+		end += int64(len(tag.Data)) + 15
+		if uint64(tag.Timestamp) > lastTimestamp {
+			lastTimestamp = uint64(tag.Timestamp)
+		}
+	}
+	return lastTimestamp, end, nil
+}
+
+func (s *segment) writeHeader(metaData, videoConfig, audioConfig []byte) error {
+	if s.appended {
+		// 追加的时候只重新写sequence header, 编码参数可能变了
+		metaData = nil
+	} else {
+		if err := flv.WriteFileHeader(s.w, audioConfig != nil, videoConfig != nil); err != nil {
+			return err
+		}
+		s.size += flv.FlvHeaderSize + 4
+	}
+
+	headers := []struct {
+		tagType uint8
+		data    []byte
+	}{
+		{flv.FlvTagAMF0, metaData},
+		{flv.FlvTagVideo, videoConfig},
+		{flv.FlvTagAudio, audioConfig},
+	}
+	for _, h := range headers {
+		if h.data == nil {
+			continue
+		}
+		n, err := flv.WriteTag(s.w, h.tagType, uint32(s.base), h.data)
+		if err != nil {
+			return err
+		}
+		s.size += int64(n)
+	}
+	return nil
+}
+
+func (s *segment) write(m *exchange.ExData) error {
+	var tagType uint8
+	switch m.DataType {
+	case exchange.DataTypeAudio, exchange.DataTypeAudioConfig:
+		tagType = flv.FlvTagAudio
+	case exchange.DataTypeDataAMF0:
+		tagType = flv.FlvTagAMF0
+	default:
+		tagType = flv.FlvTagVideo
+	}
+
+	ts := s.base
+	if m.Timestamp > s.start {
+		ts += m.Timestamp - s.start
+	}
+	n, err := flv.WriteTag(s.w, tagType, uint32(ts), m.Payload)
+	s.size += int64(n)
+	return err
+}
+
+// full 超过时长或者大小, 下一个可以切换的帧开始新文件
+func (s *segment) full(ts uint64) bool {
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		return true
+	}
+	return s.maxLength > 0 && ts > s.start && ts-s.start >= s.maxLength
+}
+
+func (s *segment) filePath() string {
+	return s.path
+}
+
+func (s *segment) close() error {
+	err := s.w.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
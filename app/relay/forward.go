@@ -0,0 +1,325 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chinasarft/golive/app/rtmpserver"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/protocol/rtmp"
+	"github.com/chinasarft/golive/utils/amf"
+)
+
+/*
+	转推, 见readme forward模块
+	本地推流注册之后, 对app配置的每个上游地址注册一个sink, 用rtmp publish推到上游
+	1. sink的协程只把数据放到队列里面，网络发送在转推自己的协程里面，上游卡住不影响exchange
+	2. 断开之后按照ReconnectMin到ReconnectMax退避重连
+	3. 每次连上之后先发metadata和sequence header, 视频从关键帧开始
+	4. 推流结束的时候exchange Cancel这个sink, 转推也就结束了
+*/
+
+const (
+	forwardQueueSize      = 512
+	forwardConnectTimeout = 10 * time.Second
+)
+
+type Forwarder struct {
+	pad      exchange.Pad
+	lock     sync.Mutex
+	forwards map[string]*forward
+	dial     func(rawurl string) (net.Conn, error)
+}
+
+func NewForwarder(pad exchange.Pad) *Forwarder {
+	return &Forwarder{
+		pad:      pad,
+		forwards: make(map[string]*forward),
+		dial:     dialRtmpUrl,
+	}
+}
+
+// dialRtmpUrl rtmps用tls, 没有端口的时候rtmp默认1935, rtmps默认443
+func dialRtmpUrl(rawurl string) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if _, _, err = net.SplitHostPort(host); err != nil {
+		if u.Scheme == "rtmps" {
+			host += ":443"
+		} else {
+			host += ":1935"
+		}
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if u.Scheme == "rtmps" {
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	}
+	return dialer.Dial("tcp", host)
+}
+
+func forwardUrl(tmpl string, key exchange.StreamKey) string {
+	return strings.NewReplacer("{vhost}", key.Vhost, "{app}", key.App, "{stream}", key.Stream).Replace(tmpl)
+}
+
+// Forward 实现exchange.Forwarder
+func (f *Forwarder) Forward(key exchange.StreamKey, config exchange.ForwardConfig) {
+	for _, tmpl := range config.Urls {
+		u := forwardUrl(tmpl, key)
+		id := key.String() + " " + u
+
+		f.lock.Lock()
+		if _, ok := f.forwards[id]; ok {
+			// 抢流的时候老的转推跟着观看者一起转到新的source
+			f.lock.Unlock()
+			continue
+		}
+		fw := &forward{
+			forwarder: f,
+			id:        id,
+			key:       key,
+			url:       u,
+			config:    config,
+			msgs:      make(chan *exchange.ExData, forwardQueueSize),
+		}
+		fw.ctx, fw.cancel = context.WithCancel(context.Background())
+		f.forwards[id] = fw
+		f.lock.Unlock()
+
+		if err := f.pad.OnSinkDetermined(fw, fw.ctx); err != nil {
+			log.Println(id, "forward register sink:", err)
+			f.remove(fw)
+			fw.cancel()
+			continue
+		}
+		go fw.run()
+	}
+}
+
+func (f *Forwarder) remove(fw *forward) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.forwards[fw.id] == fw {
+		delete(f.forwards, fw.id)
+	}
+}
+
+// forward 转推到一个上游, 作为sink的StreamHandler
+type forward struct {
+	forwarder *Forwarder
+	id        string
+	key       exchange.StreamKey
+	url       string
+	config    exchange.ForwardConfig
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	msgs    chan *exchange.ExData
+	dropped int32 // 队列满了丢过数据, 需要重新发sequence header并且等关键帧
+
+	lock        sync.Mutex // 在sink和转推两个协程里面访问
+	metaData    *exchange.ExData
+	videoConfig *exchange.ExData
+	audioConfig *exchange.ExData
+}
+
+func (fw *forward) GetStreamKey() exchange.StreamKey {
+	return fw.key
+}
+
+func (fw *forward) Cancel() {
+	fw.cancel()
+}
+
+// WriteData 在sink的协程里面, 拷贝一份放到队列里面
+func (fw *forward) WriteData(m *exchange.ExData) error {
+	d := &exchange.ExData{
+		Timestamp:       m.Timestamp,
+		CompositionTime: m.CompositionTime,
+		DataType:        m.DataType,
+		AvFormat:        m.AvFormat,
+		OriginProtocol:  m.OriginProtocol,
+		Payload:         append([]byte(nil), m.Payload...),
+	}
+
+	switch d.DataType {
+	case exchange.DataTypeDataAMF0:
+		// onCuePoint这些只转发, 重连的时候只补发onMetaData
+		if isMetaData(d.Payload) {
+			fw.lock.Lock()
+			fw.metaData = d
+			fw.lock.Unlock()
+		}
+	case exchange.DataTypeVideoConfig:
+		fw.lock.Lock()
+		fw.videoConfig = d
+		fw.lock.Unlock()
+	case exchange.DataTypeAudioConfig:
+		fw.lock.Lock()
+		fw.audioConfig = d
+		fw.lock.Unlock()
+	}
+
+	select {
+	case fw.msgs <- d:
+	default:
+		atomic.StoreInt32(&fw.dropped, 1)
+	}
+	return nil
+}
+
+func (fw *forward) run() {
+	defer fw.stop()
+
+	backoff := fw.config.ReconnectMin
+	for {
+		connected, err := fw.publish()
+		if fw.ctx.Err() != nil {
+			return
+		}
+		log.Println(fw.id, "forward error:", err)
+		if connected {
+			backoff = fw.config.ReconnectMin
+		}
+
+		select {
+		case <-fw.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > fw.config.ReconnectMax {
+			backoff = fw.config.ReconnectMax
+		}
+	}
+}
+
+// publish 连上上游之后一直发送，出错或者取消的时候返回
+func (fw *forward) publish() (connected bool, err error) {
+	conn, err := fw.forwarder.dial(fw.url)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	handler, err := rtmp.NewRtmpClientHandler(rtmpserver.NewNetConnWrapper(conn, 4*1024), fw.url, rtmp.ROLE_PUBLISH, nil)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithCancel(fw.ctx)
+	defer cancel()
+	go handler.Start(ctx)
+
+	select {
+	case ok := <-handler.ConnectResult():
+		if !ok {
+			return false, fmt.Errorf("publish to %s fail", fw.url)
+		}
+	case <-time.After(forwardConnectTimeout):
+		return false, fmt.Errorf("publish to %s timeout", fw.url)
+	case <-fw.ctx.Done():
+		return false, nil
+	}
+	log.Println(fw.id, "forward connected")
+
+	// 断开期间积压的数据已经过时了
+	fw.drain()
+	atomic.StoreInt32(&fw.dropped, 0)
+	if err = fw.sendHeaders(handler); err != nil {
+		return true, err
+	}
+
+	waitKeyFrame := true
+	for {
+		select {
+		case <-fw.ctx.Done():
+			return true, nil
+		case m := <-fw.msgs:
+			if atomic.SwapInt32(&fw.dropped, 0) == 1 {
+				if err = fw.sendHeaders(handler); err != nil {
+					return true, err
+				}
+				waitKeyFrame = true
+			}
+			switch m.DataType {
+			case exchange.DataTypeVideo, exchange.DataTypeVideoNonKeyFrame:
+				if waitKeyFrame {
+					continue
+				}
+			case exchange.DataTypeVideoKeyFrame:
+				waitKeyFrame = false
+			}
+			if err = fw.send(handler, m); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+func (fw *forward) drain() {
+	for {
+		select {
+		case <-fw.msgs:
+		default:
+			return
+		}
+	}
+}
+
+func (fw *forward) sendHeaders(handler *rtmp.RtmpClientHandler) error {
+	fw.lock.Lock()
+	headers := []*exchange.ExData{fw.metaData, fw.videoConfig, fw.audioConfig}
+	fw.lock.Unlock()
+
+	for _, m := range headers {
+		if m == nil {
+			continue
+		}
+		if err := fw.send(handler, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fw *forward) send(handler *rtmp.RtmpClientHandler, m *exchange.ExData) error {
+	ts := uint32(m.Timestamp)
+	switch m.DataType {
+	case exchange.DataTypeAudio, exchange.DataTypeAudioConfig:
+		return handler.SendAudioMessage(m.Payload, ts)
+	case exchange.DataTypeVideo, exchange.DataTypeVideoKeyFrame, exchange.DataTypeVideoNonKeyFrame, exchange.DataTypeVideoConfig:
+		return handler.SendVideoMessage(m.Payload, ts)
+	case exchange.DataTypeDataAMF0:
+		if !isMetaData(m.Payload) {
+			return handler.SendDataMessage(m.Payload, ts)
+		}
+		// exchange里面的onMetaData去掉了@setDataFrame, 推流的时候要加回去
+		var buf bytes.Buffer
+		amf.WriteValue(&buf, "@setDataFrame")
+		buf.Write(m.Payload)
+		return handler.SendDataMessage(buf.Bytes(), ts)
+	}
+	return nil
+}
+
+// isMetaData exchange里面的onMetaData已经去掉了@setDataFrame
+func isMetaData(payload []byte) bool {
+	v, err := amf.ReadValue(bytes.NewReader(payload))
+	return err == nil && v == "onMetaData"
+}
+
+func (fw *forward) stop() {
+	fw.cancel()
+	fw.forwarder.pad.OnDestroySink(fw)
+	fw.forwarder.remove(fw)
+}
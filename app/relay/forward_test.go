@@ -0,0 +1,233 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chinasarft/golive/app/rtmpserver"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/protocol/rtmp"
+	"github.com/chinasarft/golive/utils/amf"
+)
+
+// testUpstream 上游, 每个推流连接收到的数据放到一个chan里面
+type testUpstream struct {
+	ln    net.Listener
+	lock  sync.Mutex
+	conns []*upstreamConn
+}
+
+type upstreamConn struct {
+	conn     net.Conn
+	received chan *exchange.ExData
+}
+
+func newTestUpstream(t *testing.T) *testUpstream {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := &testUpstream{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := &upstreamConn{conn: conn, received: make(chan *exchange.ExData, 1000)}
+			up.lock.Lock()
+			up.conns = append(up.conns, c)
+			up.lock.Unlock()
+			go func() {
+				defer conn.Close()
+				var flag [1]byte
+				if _, err := io.ReadFull(conn, flag[:]); err != nil {
+					return
+				}
+				rtmp.NewRtmpHandler(rtmpserver.NewNetConnWrapper(conn, 4*1024), c, flag[0]).Start()
+			}()
+		}
+	}()
+	return up
+}
+
+func (up *testUpstream) conn(t *testing.T, idx int) *upstreamConn {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		up.lock.Lock()
+		if len(up.conns) > idx {
+			c := up.conns[idx]
+			up.lock.Unlock()
+			return c
+		}
+		up.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("wait upstream connection %d timeout", idx)
+	return nil
+}
+
+func (c *upstreamConn) OnSourceDetermined(h exchange.StreamHandler, ctx context.Context) (exchange.PutData, error) {
+	return func(m *exchange.ExData) error {
+		d := *m
+		d.Payload = append([]byte(nil), m.Payload...)
+		m.Release()
+		c.received <- &d
+		return nil
+	}, nil
+}
+
+func (c *upstreamConn) OnSinkDetermined(h exchange.StreamHandler, ctx context.Context) error {
+	return exchange.ErrStreamNotFound
+}
+func (c *upstreamConn) OnDestroySource(h exchange.StreamHandler) {}
+func (c *upstreamConn) OnDestroySink(h exchange.StreamHandler)   {}
+
+func newMetaDataPayload() []byte {
+	var buf bytes.Buffer
+	amf.WriteValue(&buf, "@setDataFrame")
+	amf.WriteValue(&buf, "onMetaData")
+	amf.WriteValue(&buf, amf.Object{"videocodecid": float64(7), "audiocodecid": float64(10)})
+	return buf.Bytes()
+}
+
+// expectHeaders 每个连接最先收到metadata和sequence header, 第一个视频帧是关键帧
+func expectHeaders(t *testing.T, c *upstreamConn) {
+	var gotMeta, gotVideo, gotAudio bool
+	for {
+		select {
+		case m := <-c.received:
+			switch m.DataType {
+			case exchange.DataTypeDataAMF0:
+				gotMeta = true
+			case exchange.DataTypeVideoConfig:
+				gotVideo = true
+			case exchange.DataTypeAudioConfig:
+				gotAudio = true
+			case exchange.DataTypeVideoKeyFrame:
+				if !gotMeta || !gotVideo || !gotAudio {
+					t.Fatalf("headers not sent before key frame:%v %v %v", gotMeta, gotVideo, gotAudio)
+				}
+				return
+			case exchange.DataTypeVideoNonKeyFrame:
+				t.Fatal("expect key frame first")
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("wait upstream data timeout")
+		}
+	}
+}
+
+func TestForwardReconnect(t *testing.T) {
+	up := newTestUpstream(t)
+	defer up.ln.Close()
+
+	config := exchange.DefaultAppConfig()
+	config.Forward = exchange.ForwardConfig{
+		Urls:         []string{"rtmp://" + up.ln.Addr().String() + "/up/{stream}"},
+		ReconnectMin: 50 * time.Millisecond,
+		ReconnectMax: 200 * time.Millisecond,
+	}
+	exchange.SetAppConfig("forwardtest", config)
+	pool := exchange.GetExchanger()
+	forwarder := NewForwarder(pool)
+	exchange.SetForwarder(forwarder)
+	defer exchange.SetForwarder(nil)
+
+	pub := newTestSink(t, "rtmp://127.0.0.1/forwardtest/s")
+	put, err := pool.OnSourceDetermined(pub, pub.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	videoConfig, _ := hex.DecodeString("17000000000142c015ffe1001c6742c015d901e096ffc0040003c4000003000400000300c83c58b92001000568cb83cb20")
+	for _, d := range []struct {
+		dataType uint8
+		avFormat uint8
+		payload  []byte
+	}{
+		{exchange.DataTypeDataAMF0, exchange.AvFormatData, newMetaDataPayload()},
+		{exchange.DataTypeVideoConfig, exchange.AvFormatAVC, videoConfig},
+		{exchange.DataTypeAudioConfig, exchange.AvFormatAAC, []byte{0xaf, 0, 0x14, 0x08}},
+	} {
+		m := exchange.NewPooledExData(d.payload)
+		m.DataType, m.AvFormat = d.dataType, d.avFormat
+		put(m)
+	}
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-pub.ctx.Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			payload := []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 1}
+			dataType := exchange.DataTypeVideoNonKeyFrame
+			if i%5 == 0 {
+				payload[0] = 0x17
+				dataType = exchange.DataTypeVideoKeyFrame
+			}
+			m := exchange.NewPooledExData(payload)
+			m.DataType, m.AvFormat, m.Timestamp = dataType, exchange.AvFormatAVC, uint64(i*40)
+			put(m)
+		}
+	}()
+
+	first := up.conn(t, 0)
+	expectHeaders(t, first)
+
+	// 上游断开之后重连, 重新发送sequence header
+	forwarder.lock.Lock()
+	var fw *forward
+	for _, v := range forwarder.forwards {
+		fw = v
+	}
+	forwarder.lock.Unlock()
+	if fw == nil || fw.url != "rtmp://"+up.ln.Addr().String()+"/up/s" {
+		t.Fatal("unexpected forward:", fw)
+	}
+	first.conn.Close()
+	expectHeaders(t, up.conn(t, 1))
+
+	// 推流结束, 转推也结束
+	pub.Cancel()
+	pool.OnDestroySource(pub)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		forwarder.lock.Lock()
+		n := len(forwarder.forwards)
+		forwarder.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("forward not stopped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestForwardCacheOnlyMetaData(t *testing.T) {
+	fw := &forward{msgs: make(chan *exchange.ExData, forwardQueueSize)}
+	meta := newMetaDataPayload()[16:]
+	fw.WriteData(&exchange.ExData{DataType: exchange.DataTypeDataAMF0, Payload: meta})
+
+	var buf bytes.Buffer
+	amf.WriteValue(&buf, "onCuePoint")
+	amf.WriteValue(&buf, amf.Object{"name": "ad"})
+	fw.WriteData(&exchange.ExData{DataType: exchange.DataTypeDataAMF0, Payload: buf.Bytes()})
+
+	// onCuePoint照常转发, 重连补发的还是onMetaData
+	if len(fw.msgs) != 2 {
+		t.Fatalf("queued:%d", len(fw.msgs))
+	}
+	if fw.metaData == nil || !bytes.Equal(fw.metaData.Payload, meta) {
+		t.Fatal("metadata overwritten by onCuePoint")
+	}
+}
@@ -0,0 +1,274 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/chinasarft/golive/app/rtmpserver"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/protocol/rtmp"
+)
+
+/*
+	边缘节点回源拉流, 见readme relay模块
+	1. 观看者请求的流不存在，exchange调用Pull, 按照app配置的Origins顺序用rtmp play去源站拉流
+	2. 收到第一个消息之后注册成本地的source, 观看者就和普通推流一样
+	3. 出错换下一个源站，一轮下来都没有拉到数据就放弃，等待的观看者会超时收到StreamNotFound
+	   拉到过数据就等一会儿再来一轮, 间隔从ReconnectMin开始翻倍, 最大ReconnectMax
+	   连接保持StableAfter以上才重置间隔, 源站连上发一点数据就断开的时候不会一直重连
+	4. 观看者个数变成0之后过IdleTimeout断开
+*/
+
+const dialTimeout = 5 * time.Second
+
+type Puller struct {
+	pad   exchange.Pad
+	lock  sync.Mutex
+	pulls map[string]*pull
+	dial  func(addr string) (net.Conn, error)
+}
+
+func NewPuller(pad exchange.Pad) *Puller {
+	return &Puller{
+		pad:   pad,
+		pulls: make(map[string]*pull),
+		dial: func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, dialTimeout)
+		},
+	}
+}
+
+// Pull 实现exchange.Puller, 同一个key只拉一路
+func (p *Puller) Pull(key exchange.StreamKey, config exchange.RelayConfig) {
+	k := key.String()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.pulls[k]; ok {
+		return
+	}
+
+	pl := &pull{
+		puller: p,
+		key:    key,
+		config: config,
+	}
+	pl.ctx, pl.cancel = context.WithCancel(context.Background())
+	p.pulls[k] = pl
+	go pl.run()
+}
+
+func (p *Puller) remove(pl *pull) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pulls[pl.key.String()] == pl {
+		delete(p.pulls, pl.key.String())
+	}
+}
+
+// pull 一路回源, 作为source的StreamHandler
+type pull struct {
+	puller *Puller
+	key    exchange.StreamKey
+	config exchange.RelayConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// 以下在拉流的协程里面访问
+	putData  exchange.PutData
+	received bool // 当前源站收到过数据
+
+	lock       sync.Mutex
+	registered bool
+	counted    bool // 收到过观看者个数的通知
+	idleTimer  *time.Timer
+}
+
+func (pl *pull) run() {
+	defer pl.stop()
+
+	backoff := pl.config.ReconnectMin
+	for {
+		ok, stable := false, false
+		for _, origin := range pl.config.Origins {
+			if pl.ctx.Err() != nil {
+				return
+			}
+			start := time.Now()
+			if pl.pullFrom(origin) {
+				ok = true
+				if time.Since(start) >= pl.config.StableAfter {
+					stable = true
+				}
+			}
+		}
+		if !ok {
+			log.Println(pl.key.String(), "pull from all origins fail")
+			return
+		}
+
+		if stable {
+			backoff = pl.config.ReconnectMin
+		}
+		log.Println(pl.key.String(), "relay pull again after", backoff)
+		select {
+		case <-pl.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > pl.config.ReconnectMax {
+			backoff = pl.config.ReconnectMax
+		}
+	}
+}
+
+func (pl *pull) originUrl(origin string) string {
+	args := url.Values{}
+	for k, v := range pl.key.Args {
+		args[k] = v
+	}
+	if pl.key.Vhost != exchange.DefaultVhost {
+		args.Set("vhost", pl.key.Vhost)
+	}
+	u := "rtmp://" + origin + "/" + pl.key.App + "/" + pl.key.Stream
+	if len(args) > 0 {
+		u += "?" + args.Encode()
+	}
+	return u
+}
+
+// pullFrom 阻塞到出错或者取消, 返回是否收到过数据
+func (pl *pull) pullFrom(origin string) bool {
+	u := pl.originUrl(origin)
+	log.Println("relay pull:", u)
+	conn, err := pl.puller.dial(origin)
+	if err != nil {
+		log.Println("relay dial:", origin, err)
+		return false
+	}
+	defer conn.Close()
+
+	handler, err := rtmp.NewRtmpClientHandler(rtmpserver.NewNetConnWrapper(conn, 4*1024), u, rtmp.ROLE_PLAY, pl)
+	if err != nil {
+		log.Println("relay:", err)
+		return false
+	}
+
+	// Start阻塞在读上面, 取消的时候关闭连接让它返回
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-pl.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	pl.received = false
+	handler.Start(pl.ctx)
+	return pl.received
+}
+
+func (pl *pull) put(m *rtmp.Message) {
+	if pl.ctx.Err() != nil || len(m.Payload) < 2 {
+		return
+	}
+	if pl.putData == nil {
+		var err error
+		if pl.putData, err = pl.puller.pad.OnSourceDetermined(pl, pl.ctx); err != nil {
+			// 拉流的过程中本地有了推流
+			log.Println(pl.key.String(), "relay register source:", err)
+			pl.cancel()
+			return
+		}
+		pl.onRegistered()
+	}
+	pl.received = true
+	if err := pl.putData(rtmp.MessageToExData(m)); err != nil {
+		log.Println(pl.key.String(), "relay put data:", err)
+		pl.cancel()
+	}
+}
+
+func (pl *pull) onRegistered() {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	pl.registered = true
+	// 注册的时候等待的观看者可能都已经超时走了
+	if !pl.counted {
+		pl.resetIdleTimer(0)
+	}
+}
+
+// OnSinkCountChanged 实现exchange.SinkCountHandler
+func (pl *pull) OnSinkCountChanged(count int) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	pl.counted = true
+	pl.resetIdleTimer(count)
+}
+
+func (pl *pull) resetIdleTimer(count int) {
+	if pl.idleTimer != nil {
+		pl.idleTimer.Stop()
+		pl.idleTimer = nil
+	}
+	if count == 0 {
+		pl.idleTimer = time.AfterFunc(pl.config.IdleTimeout, func() {
+			log.Println(pl.key.String(), "relay idle, stop pull")
+			pl.cancel()
+		})
+	}
+}
+
+func (pl *pull) stop() {
+	pl.cancel()
+	pl.lock.Lock()
+	if pl.idleTimer != nil {
+		pl.idleTimer.Stop()
+	}
+	registered := pl.registered
+	pl.lock.Unlock()
+	if registered {
+		pl.puller.pad.OnDestroySource(pl)
+	}
+	pl.puller.remove(pl)
+}
+
+func (pl *pull) GetStreamKey() exchange.StreamKey {
+	return pl.key
+}
+
+func (pl *pull) Cancel() {
+	pl.cancel()
+}
+
+// IsRelay 实现exchange.RelaySource, 回源的流不转推
+func (pl *pull) IsRelay() bool {
+	return true
+}
+
+func (pl *pull) WriteData(m *exchange.ExData) error {
+	return fmt.Errorf("relay pull must be source")
+}
+
+func (pl *pull) OnError(err error) {
+	log.Println(pl.key.String(), "relay pull error:", err)
+}
+
+func (pl *pull) OnAudioMessage(m *rtmp.AudioMessage) {
+	pl.put((*rtmp.Message)(m))
+}
+
+func (pl *pull) OnVideoMessage(m *rtmp.VideoMessage) {
+	pl.put((*rtmp.Message)(m))
+}
+
+func (pl *pull) OnDataMessage(m *rtmp.DataMessage) {
+	pl.put((*rtmp.Message)(m))
+}
@@ -0,0 +1,230 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chinasarft/golive/app/rtmpserver"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/protocol/rtmp"
+)
+
+// testOrigin 源站, 有观看者就一直发视频
+type testOrigin struct {
+	ln net.Listener
+}
+
+func newTestOrigin(t *testing.T) *testOrigin {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &testOrigin{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var flag [1]byte
+				if _, err := io.ReadFull(conn, flag[:]); err != nil {
+					return
+				}
+				h := rtmp.NewRtmpHandler(rtmpserver.NewNetConnWrapper(conn, 4*1024), o, flag[0])
+				h.Start()
+			}()
+		}
+	}()
+	return o
+}
+
+func (o *testOrigin) OnSourceDetermined(h exchange.StreamHandler, ctx context.Context) (exchange.PutData, error) {
+	return nil, exchange.ErrStreamAlreadyPublished
+}
+
+func (o *testOrigin) OnSinkDetermined(h exchange.StreamHandler, ctx context.Context) error {
+	go func() {
+		h.WriteData(&exchange.ExData{
+			DataType: exchange.DataTypeVideoConfig,
+			Payload:  []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, 0x15},
+		})
+		for ts := uint64(0); ; ts += 40 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			err := h.WriteData(&exchange.ExData{
+				DataType:  exchange.DataTypeVideoKeyFrame,
+				Timestamp: ts,
+				Payload:   []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 1},
+			})
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (o *testOrigin) OnDestroySource(h exchange.StreamHandler) {}
+func (o *testOrigin) OnDestroySink(h exchange.StreamHandler)   {}
+
+type testSink struct {
+	key      exchange.StreamKey
+	ctx      context.Context
+	cancel   context.CancelFunc
+	received chan *exchange.ExData
+}
+
+func newTestSink(t *testing.T, url string) *testSink {
+	key, err := exchange.ParseStreamUrl(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSink{key: key, received: make(chan *exchange.ExData, 1000)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *testSink) GetStreamKey() exchange.StreamKey { return s.key }
+func (s *testSink) Cancel()                          { s.cancel() }
+func (s *testSink) WriteData(m *exchange.ExData) error {
+	d := *m
+	d.Payload = append([]byte(nil), m.Payload...)
+	select {
+	case s.received <- &d:
+	default:
+	}
+	return nil
+}
+
+func TestRelayPullAndIdleStop(t *testing.T) {
+	origin := newTestOrigin(t)
+	defer origin.ln.Close()
+
+	// 第一个源站连不上, 换下一个
+	bad, _ := net.Listen("tcp", "127.0.0.1:0")
+	badAddr := bad.Addr().String()
+	bad.Close()
+
+	config := exchange.DefaultAppConfig()
+	config.Relay = exchange.RelayConfig{
+		Origins:     []string{badAddr, origin.ln.Addr().String()},
+		IdleTimeout: 200 * time.Millisecond,
+	}
+	exchange.SetAppConfig("relaytest", config)
+	pool := exchange.GetExchanger()
+	puller := NewPuller(pool)
+	exchange.SetPuller(puller)
+	defer exchange.SetPuller(nil)
+
+	sink := newTestSink(t, "rtmp://127.0.0.1/relaytest/s?token=1")
+	if err := pool.OnSinkDetermined(sink, sink.ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gotConfig, frames := false, 0
+	for frames < 5 {
+		select {
+		case m := <-sink.received:
+			switch m.DataType {
+			case exchange.DataTypeVideoConfig:
+				gotConfig = true
+			case exchange.DataTypeVideoKeyFrame:
+				frames++
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("wait relay data timeout")
+		}
+	}
+	if !gotConfig {
+		t.Fatal("expect video sequence header")
+	}
+
+	// 观看者离开之后过IdleTimeout断开回源
+	sink.Cancel()
+	pool.OnDestroySink(sink)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		puller.lock.Lock()
+		n := len(puller.pulls)
+		puller.lock.Unlock()
+		if n == 0 && pool.GetPublishStats(sink.key) == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relay not stopped after idle")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRelayPullBackoff(t *testing.T) {
+	origin := newTestOrigin(t)
+	defer origin.ln.Close()
+
+	config := exchange.RelayConfig{
+		Origins:      []string{origin.ln.Addr().String()},
+		IdleTimeout:  10 * time.Second,
+		ReconnectMin: 100 * time.Millisecond,
+		ReconnectMax: 400 * time.Millisecond,
+		StableAfter:  time.Minute,
+	}
+	key, _ := exchange.ParseStreamUrl("rtmp://127.0.0.1/relaybackoff/s")
+	puller := NewPuller(exchange.GetExchanger())
+
+	// 源站发一点数据就断开
+	var lock sync.Mutex
+	var dials []time.Time
+	puller.dial = func(addr string) (net.Conn, error) {
+		lock.Lock()
+		dials = append(dials, time.Now())
+		lock.Unlock()
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err == nil {
+			time.AfterFunc(200*time.Millisecond, func() { conn.Close() })
+		}
+		return conn, err
+	}
+	puller.Pull(key, config)
+	time.Sleep(1600 * time.Millisecond)
+
+	puller.lock.Lock()
+	pl := puller.pulls[key.String()]
+	puller.lock.Unlock()
+	if pl == nil {
+		t.Fatal("pull stopped")
+	}
+	pl.Cancel()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		puller.lock.Lock()
+		n := len(puller.pulls)
+		puller.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pull not stopped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// 每次连上200毫秒, 间隔100 200 400毫秒, 大概在0 300 700 1300毫秒重连
+	lock.Lock()
+	defer lock.Unlock()
+	if len(dials) < 3 || len(dials) > 5 {
+		t.Fatalf("dials:%d", len(dials))
+	}
+	first, last := dials[1].Sub(dials[0]), dials[len(dials)-1].Sub(dials[len(dials)-2])
+	if last < first+150*time.Millisecond {
+		t.Fatalf("no backoff:%v %v", first, last)
+	}
+}
@@ -54,3 +54,58 @@ func ParseTag(r io.Reader) (tag *FlvTag, err error) {
 
 	return
 }
+
+const FlvHeaderSize = 9
+
+// WriteFileHeader flv文件头和第一个PreviousTagSize0
+func WriteFileHeader(w io.Writer, hasAudio, hasVideo bool) error {
+	var flags byte
+	if hasAudio {
+		flags |= 0x04
+	}
+	if hasVideo {
+		flags |= 0x01
+	}
+	_, err := w.Write([]byte{'F', 'L', 'V', 1, flags, 0, 0, 0, FlvHeaderSize, 0, 0, 0, 0})
+	return err
+}
+
+// ParseFileHeader 读取文件头和PreviousTagSize0, 之后就可以ParseTag
+func ParseFileHeader(r io.Reader) (hasAudio, hasVideo bool, err error) {
+	var bin [FlvHeaderSize + 4]byte
+	if _, err = io.ReadFull(r, bin[:]); err != nil {
+		return
+	}
+	if bin[0] != 'F' || bin[1] != 'L' || bin[2] != 'V' {
+		err = fmt.Errorf("not flv file")
+		return
+	}
+	if offset := byteio.U32BE(bin[5:9]); offset != FlvHeaderSize {
+		err = fmt.Errorf("unsupported flv header size:%d", offset)
+		return
+	}
+	hasAudio = bin[4]&0x04 != 0
+	hasVideo = bin[4]&0x01 != 0
+	return
+}
+
+// WriteTag 写一个tag和它的PreviousTagSize, 返回写入的字节数
+func WriteTag(w io.Writer, tagType uint8, timestamp uint32, data []byte) (int, error) {
+	var hdr [11]byte
+	hdr[0] = tagType
+	byteio.PutU24BE(hdr[1:4], uint32(len(data)))
+	byteio.PutU24BE(hdr[4:7], timestamp&0xFFFFFF)
+	hdr[7] = uint8(timestamp >> 24)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return 0, err
+	}
+	var size [4]byte
+	byteio.PutU32BE(size[:], uint32(len(data)+11))
+	if _, err := w.Write(size[:]); err != nil {
+		return 0, err
+	}
+	return len(data) + 15, nil
+}
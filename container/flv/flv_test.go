@@ -64,3 +64,27 @@ func TestAmfParse(t *testing.T) {
 		t.Error("expect publish is true:", ok, v)
 	}
 }
+
+func TestWriteTag(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := WriteFileHeader(buf, true, true); err != nil {
+		t.Fatal(err)
+	}
+	n, err := WriteTag(buf, FlvTagVideo, 0x12345678, []byte{0x17, 1, 0, 0, 0})
+	if err != nil || n != 20 {
+		t.Fatalf("write tag:%d %v", n, err)
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	hasAudio, hasVideo, err := ParseFileHeader(r)
+	if err != nil || !hasAudio || !hasVideo {
+		t.Fatalf("parse header:%v %v %v", hasAudio, hasVideo, err)
+	}
+	tag, err := ParseTag(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.TagType != FlvTagVideo || tag.Timestamp != 0x12345678 || !bytes.Equal(tag.Data, []byte{0x17, 1, 0, 0, 0}) {
+		t.Fatalf("unexpected tag:%+v", tag)
+	}
+}
@@ -36,9 +36,11 @@ type Fmp4MoofMdat struct {
 
 type MdatCache struct {
 	trunBox           *TrunBox
+	hasCts            bool // 有B帧, trun需要写sample_composition_time_offset
 	buf               bytes.Buffer
 	lastTs            int64
 	firstTs           int64
+	endTs             int64 // 下一帧的时间戳, 知道的时候用来算最后一帧的时长
 	accOffset         uint64
 	defaultSampleSize uint32
 	baseDataOffset    uint64
@@ -69,6 +71,9 @@ type Fmp4 struct {
 	// 所以这里单独放出来，后面在更正timescale
 	moofMdatSeqNum     uint32
 	fmp4BaseDataOffset uint64
+	audioTimescale     uint32
+	headerWritten      bool // WriteFragments已经写过ftyp moov
+	baseIsMoof         bool // tfhd不写base_data_offset, 数据偏移从moof开始算
 }
 
 func findBoxByType(boxes []IBox, boxTypes []uint32) IBox {
@@ -129,6 +134,12 @@ func NewFmp4(segDuration time.Duration) *Fmp4 {
 	return f
 }
 
+// SetDefaultBaseIsMoof 每个moof mdat单独作为一个文件的时候用, 比如hls的切片
+// tfhd不写base_data_offset, 设置default-base-is-moof
+func (f *Fmp4) SetDefaultBaseIsMoof() {
+	f.baseIsMoof = true
+}
+
 func (f *Fmp4) SetMajorBrand(brand uint32) {
 	f.Ftyp.MajorBrand = brand
 }
@@ -344,7 +355,8 @@ func (f *Fmp4) AddAudioTrack(aacSeqHdlr []byte) error {
 
 	stblBox := newVideoStblBox(mp4aBox)
 
-	mdhdBox := newFmp4MdhdBox(aacArIdxMap[sampleRateIdx], f.cmTime)
+	f.audioTimescale = aacArIdxMap[sampleRateIdx]
+	mdhdBox := newFmp4MdhdBox(f.audioTimescale, f.cmTime)
 	hdlrBox := newFmp4AudioHdlrBox()
 	minfBox := newFmp4AudioMinfBox(stblBox)
 
@@ -400,6 +412,23 @@ func (f *Fmp4) generateHeaderBox() (err error) {
 	return
 }
 
+// generateHeaderBoxOnce 第一个分片生成之前调用
+func (f *Fmp4) generateHeaderBoxOnce() (err error) {
+	if len(f.headerBox.Bytes()) > 0 {
+		return
+	}
+	if err = f.generateHeaderBox(); err != nil {
+		return
+	}
+	if f.vCache.baseDataOffset < 1 {
+		f.vCache.baseDataOffset = f.fmp4BaseDataOffset
+	}
+	if f.aCache.baseDataOffset < 1 {
+		f.aCache.baseDataOffset = f.fmp4BaseDataOffset
+	}
+	return
+}
+
 func (f *Fmp4) resetFrag(isForce bool, ts int64) {
 
 	if f.audioTrackId > 0 {
@@ -410,20 +439,24 @@ func (f *Fmp4) resetFrag(isForce bool, ts int64) {
 	}
 
 	if isForce || f.moofBox == nil {
-		mfhdBox := &MfhdBox{
-			FullBox:        NewTypeFullBox(BoxTypeMFHD, 0, 0),
-			SequenceNumber: f.moofMdatSeqNum,
-		}
-		mfhdBox.Size += MfhdBoxBodyLen
-		f.moofBox = &MoofBox{
-			Box: NewTypeBox(BoxTypeMOOF),
-			SubBoxes: []IBox{
-				mfhdBox,
-			},
-		}
-		f.moofBox.Size += mfhdBox.Size
-		f.mdatBuf.Reset()
+		f.newMoofBox()
+	}
+}
+
+func (f *Fmp4) newMoofBox() {
+	mfhdBox := &MfhdBox{
+		FullBox:        NewTypeFullBox(BoxTypeMFHD, 0, 0),
+		SequenceNumber: f.moofMdatSeqNum,
 	}
+	mfhdBox.Size += MfhdBoxBodyLen
+	f.moofBox = &MoofBox{
+		Box: NewTypeBox(BoxTypeMOOF),
+		SubBoxes: []IBox{
+			mfhdBox,
+		},
+	}
+	f.moofBox.Size += mfhdBox.Size
+	f.mdatBuf.Reset()
 }
 
 func newFmp4DinfBox() *DinfBox {
@@ -579,7 +612,11 @@ func (f *Fmp4) AddAudioFrameWithoutLen(frame []byte, ts int64) (err error) {
 		return fmt.Errorf("audio track not exists")
 	}
 	if f.videoTrackId > 0 && f.keyFrameCount == 0 {
-		err = fmt.Errorf("no key frame")
+		return fmt.Errorf("no key frame")
+	}
+	if f.aCache.trunBox == nil {
+		// 音频的timescale是采样率, ts是毫秒
+		f.aCache.baseDecodeTime = uint64(ts) * uint64(f.audioTimescale) / 1000
 	}
 	if err = f.aCache.addFrame(frame, ts, len(frame)); err != nil {
 		return
@@ -589,52 +626,83 @@ func (f *Fmp4) AddAudioFrameWithoutLen(frame []byte, ts int64) (err error) {
 }
 
 func (f *Fmp4) AddVideoFrameWithLen(frame []byte, ts int64, isKeyFrame bool) (err error) {
+	return f.AddVideoFrameWithCts(frame, ts, 0, isKeyFrame)
+}
+
+// AddVideoFrameWithCts ts是dts, cts是pts-dts, 有B帧的时候不为0
+func (f *Fmp4) AddVideoFrameWithCts(frame []byte, ts int64, cts int32, isKeyFrame bool) (err error) {
 	if f.videoTrackId < 1 {
 		return fmt.Errorf("video track not exists")
 	}
 
 	if isKeyFrame {
 		if f.vCache.accOffset > 0 {
-			if len(f.headerBox.Bytes()) == 0 {
-				if err = f.generateHeaderBox(); err != nil {
-					return
-				}
-				if f.vCache.baseDataOffset < 1 {
-					f.vCache.baseDataOffset = f.fmp4BaseDataOffset
-				}
-				if f.aCache.baseDataOffset < 1 {
-					f.aCache.baseDataOffset = f.fmp4BaseDataOffset
-				}
+			if err = f.generateHeaderBoxOnce(); err != nil {
+				return
 			}
+			f.vCache.endTs = ts
 			f.generateOneFrag()
 
 			f.keyFrameCount = 0
 
-			if f.vCache.lastTs-f.vCache.firstTs > int64(f.segDuration) {
-				f.curTrackOffset = 0
-				f.moofMdatSeqNum = 1
-				// TODO gen fmp4 file
-			}
-
 			f.resetFrag(true, ts)
 		} else {
 			f.resetFrag(true, ts)
 		}
 		f.keyFrameCount++
 	}
+	if f.vCache.trunBox == nil {
+		// Flush之后的第一帧不是关键帧
+		f.vCache.baseDecodeTime = uint64(ts)
+	}
 
-	if err = f.vCache.addFrame(frame, ts, 0); err != nil {
+	if err = f.vCache.addFrameWithCts(frame, ts, cts, 0); err != nil {
 		return
 	}
 
 	return
 }
 
+// Flush 没有到下一个关键帧也把缓存的帧生成一个分片
+// 推流结束的时候调用, 纯音频没有关键帧, 需要定时调用
+func (f *Fmp4) Flush() (err error) {
+	if f.vCache.trunBox == nil && f.aCache.trunBox == nil {
+		return
+	}
+	if err = f.generateHeaderBoxOnce(); err != nil {
+		return
+	}
+	if f.moofBox == nil {
+		f.newMoofBox()
+	}
+	if err = f.generateOneFrag(); err != nil {
+		return
+	}
+	f.resetFrag(true, f.vCache.lastTs)
+	return
+}
+
+// FlushBefore 和Flush一样, next是下一帧的时间戳, 视频最后一帧的时长按照它算
+func (f *Fmp4) FlushBefore(next int64) (err error) {
+	f.vCache.endTs = next
+	return f.Flush()
+}
+
+// InitSegment ftyp moov, 加完track之后调用
+func (f *Fmp4) InitSegment() ([]byte, error) {
+	if err := f.generateHeaderBoxOnce(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), f.headerBox.Bytes()...), nil
+}
+
 func (f *Fmp4) generateOneFrag() (err error) {
 	type pair struct {
-		idx uint32
-		f   func() error
+		cache *MdatCache
+		f     func() error
 	}
+	// 每个moof里面track数据的偏移从0开始
+	f.curTrackOffset = 0
 	genVideoPair := func() error {
 		f.generateVideoMoofMdat()
 		_, err := f.mdatBuf.Write(f.vCache.buf.Bytes())
@@ -646,27 +714,28 @@ func (f *Fmp4) generateOneFrag() (err error) {
 		return err
 	}
 	pairs := []pair{
-		pair{f.videoTrackId, genVideoPair},
-		pair{f.audioTrackId, genAudioPair},
+		pair{&f.vCache, genVideoPair},
+		pair{&f.aCache, genAudioPair},
 	}
 	if f.audioTrackId <= f.videoTrackId {
 		pairs[0], pairs[1] = pairs[1], pairs[0]
 	}
 
-	if pairs[0].idx > 0 {
-		if err = pairs[0].f(); err != nil {
-			return
+	// 只有视频的时候audioTrackId是0, 排在前面，不能因为第一个不存在就都跳过
+	// 这个分片里面没有帧的track也跳过
+	for _, p := range pairs {
+		if p.cache.trunBox == nil {
+			continue
 		}
-		if pairs[1].idx > 0 {
-			if err = pairs[1].f(); err != nil {
-				return
-			}
+		if err = p.f(); err != nil {
+			return
 		}
 	}
 	mdatBox := &MdatBox{
 		Box: NewTypeBox(BoxTypeMDAT),
 	}
-	mdatBox.Data = f.mdatBuf.Bytes()
+	// mdatBuf下一个分片还要用
+	mdatBox.Data = append([]byte(nil), f.mdatBuf.Bytes()...)
 	mdatBox.Size += uint64(len(mdatBox.Data))
 
 	moofMdat := Fmp4MoofMdat{
@@ -674,29 +743,29 @@ func (f *Fmp4) generateOneFrag() (err error) {
 		Mdat: mdatBox,
 	}
 	f.MoofMdat = append(f.MoofMdat, moofMdat)
-	if f.audioTrackId > 0 {
+	if f.aCache.trunBox != nil {
 		f.aCache.trunBox.DataOffset += uint32(f.moofBox.Size)
 	}
-	if f.videoTrackId > 0 {
+	if f.vCache.trunBox != nil {
 		f.vCache.trunBox.DataOffset += uint32(f.moofBox.Size)
 	}
 	f.fmp4BaseDataOffset += (f.moofBox.Size + mdatBox.Size)
+	f.moofMdatSeqNum++
 	return
 }
 
 func (f *Fmp4) generateVideoMoofMdat() {
 
-	duration := f.vCache.lastTs - f.vCache.firstTs
-	duration = (duration / int64(f.vCache.trunBox.SampleCount))
-	tfhdBox := &TfhdBox{
-		FullBox:               NewTypeFullBox(BoxTypeTFHD, 0, 0x39),
-		TrackID:               f.vCache.trackID,
-		BaseDataOffset:        f.vCache.baseDataOffset,
-		DefaultSampleSize:     f.vCache.defaultSampleSize,
-		DefaultSampleDuration: uint32(duration), // TODO
-		DefaultSampleFlags:    0x01010000,       // TODO 没有查到什么意思，跟着ffmpeg生成的fmp4文件来的
+	// 知道下一帧的时间戳的时候最后一帧也有时长
+	end := f.vCache.lastTs
+	if f.vCache.endTs > end {
+		end = f.vCache.endTs
 	}
-	tfhdBox.Size += 24 //flag 39
+	duration := end - f.vCache.firstTs
+	duration = (duration / int64(f.vCache.trunBox.SampleCount))
+	tfhdBox := f.newTfhdBox(&f.vCache)
+	tfhdBox.DefaultSampleDuration = uint32(duration) // TODO
+	tfhdBox.DefaultSampleFlags = 0x01010000          // TODO 没有查到什么意思，跟着ffmpeg生成的fmp4文件来的
 
 	tfdtBox := &TfdtBox{
 		FullBox:             NewTypeFullBox(BoxTypeTFDT, 1, 0),
@@ -714,6 +783,12 @@ func (f *Fmp4) generateVideoMoofMdat() {
 
 	f.vCache.trunBox.flags24Bit = 0x205
 	f.vCache.trunBox.Size += 8
+	if f.vCache.hasCts {
+		// version 1 sample_composition_time_offset是有符号的
+		f.vCache.trunBox.version = 1
+		f.vCache.trunBox.flags24Bit |= 0x800
+		f.vCache.trunBox.Size += 4 * uint64(f.vCache.trunBox.SampleCount)
+	}
 	f.vCache.trunBox.FirstSampleFlags = 0x02000000
 	f.vCache.trunBox.DataOffset = uint32(BOX_SIZE) + uint32(f.curTrackOffset) //uint32(f.moofBox.Size)
 
@@ -729,15 +804,9 @@ func (f *Fmp4) generateVideoMoofMdat() {
 
 func (f *Fmp4) generateAudioMoofMdat() {
 
-	tfhdBox := &TfhdBox{
-		FullBox:               NewTypeFullBox(BoxTypeTFHD, 0, 0x39),
-		TrackID:               f.aCache.trackID,
-		BaseDataOffset:        f.aCache.baseDataOffset,
-		DefaultSampleSize:     f.aCache.defaultSampleSize,
-		DefaultSampleDuration: 1024,       // aac编码规则决定的固定值
-		DefaultSampleFlags:    0x02000000, // TODO 没有查到什么意思，跟着ffmpeg生成的fmp4文件来的
-	}
-	tfhdBox.Size += 24 //flag 39
+	tfhdBox := f.newTfhdBox(&f.aCache)
+	tfhdBox.DefaultSampleDuration = 1024    // aac编码规则决定的固定值
+	tfhdBox.DefaultSampleFlags = 0x02000000 // TODO 没有查到什么意思，跟着ffmpeg生成的fmp4文件来的
 
 	tfdtBox := &TfdtBox{
 		FullBox:             NewTypeFullBox(BoxTypeTFDT, 1, 0),
@@ -766,12 +835,35 @@ func (f *Fmp4) generateAudioMoofMdat() {
 	return
 }
 
+// newTfhdBox 有base_data_offset的时候flag是0x39, default-base-is-moof的时候是0x020038
+func (f *Fmp4) newTfhdBox(c *MdatCache) *TfhdBox {
+	if f.baseIsMoof {
+		tfhdBox := &TfhdBox{
+			FullBox:           NewTypeFullBox(BoxTypeTFHD, 0, 0x020038),
+			TrackID:           c.trackID,
+			DefaultSampleSize: c.defaultSampleSize,
+		}
+		tfhdBox.Size += 16
+		return tfhdBox
+	}
+	tfhdBox := &TfhdBox{
+		FullBox:           NewTypeFullBox(BoxTypeTFHD, 0, 0x39),
+		TrackID:           c.trackID,
+		BaseDataOffset:    c.baseDataOffset,
+		DefaultSampleSize: c.defaultSampleSize,
+	}
+	tfhdBox.Size += 24 //flag 39
+	return tfhdBox
+}
+
 func (c *MdatCache) reset(baseDataOffset uint64, baseDecodeTime uint64) {
 
 	c.trunBox = nil
+	c.hasCts = false
 	c.buf.Reset()
 	c.lastTs = 0
 	c.firstTs = 0
+	c.endTs = 0
 	c.accOffset = 0
 	c.defaultSampleSize = 0
 	c.baseDataOffset = baseDataOffset
@@ -780,6 +872,10 @@ func (c *MdatCache) reset(baseDataOffset uint64, baseDecodeTime uint64) {
 }
 
 func (c *MdatCache) addFrame(frame []byte, ts int64, frameLen int) (err error) {
+	return c.addFrameWithCts(frame, ts, 0, frameLen)
+}
+
+func (c *MdatCache) addFrameWithCts(frame []byte, ts int64, cts int32, frameLen int) (err error) {
 
 	if c.trunBox == nil {
 		c.firstTs = ts
@@ -807,15 +903,21 @@ func (c *MdatCache) addFrame(frame []byte, ts int64, frameLen int) (err error) {
 	}
 	c.accOffset += uint64(curWriteLen)
 	c.trunBox.BoxSamples = append(c.trunBox.BoxSamples, &TrunBoxSample{
-		SampleSize: uint32(frameLen),
+		SampleSize:                   uint32(frameLen),
+		SampleCompositionTimeOffset:  uint32(cts),
+		SSampleCompositionTimeOffset: cts,
 	})
+	if cts != 0 {
+		c.hasCts = true
+	}
 	c.trunBox.Size += 4 // fullbox的flag决定
 	c.trunBox.SampleCount++
 
 	return
 }
 
-func (f *Fmp4) serialize(w io.Writer) (writedLen int, err error) {
+// Serialize 写ftyp moov和目前所有的moof mdat
+func (f *Fmp4) Serialize(w io.Writer) (writedLen int, err error) {
 
 	if writedLen, err = w.Write(f.headerBox.Bytes()); err != nil {
 		return
@@ -836,3 +938,42 @@ func (f *Fmp4) serialize(w io.Writer) (writedLen int, err error) {
 
 	return
 }
+
+// WriteFragments 边生成边写文件: 第一次写ftyp moov, 之后只写新生成的moof mdat
+// 写过的moof mdat不再保留，所以不能和Serialize一起用
+func (f *Fmp4) WriteFragments(w io.Writer) (writedLen int, err error) {
+	if !f.headerWritten {
+		if len(f.headerBox.Bytes()) == 0 {
+			return
+		}
+		if writedLen, err = w.Write(f.headerBox.Bytes()); err != nil {
+			return
+		}
+		f.headerWritten = true
+	}
+
+	curWriteLen, err := f.WriteMoofMdat(w)
+	writedLen += curWriteLen
+	return
+}
+
+// WriteMoofMdat 只写新生成的moof mdat, ftyp moov用InitSegment单独拿
+func (f *Fmp4) WriteMoofMdat(w io.Writer) (writedLen int, err error) {
+	curWriteLen := 0
+	for len(f.MoofMdat) > 0 {
+		mm := f.MoofMdat[0]
+		if curWriteLen, err = mm.Moof.Serialize(w); err != nil {
+			return
+		}
+		writedLen += curWriteLen
+
+		if curWriteLen, err = mm.Mdat.Serialize(w); err != nil {
+			return
+		}
+		writedLen += curWriteLen
+		f.MoofMdat = f.MoofMdat[1:]
+	}
+	f.MoofMdat = nil
+
+	return
+}
@@ -1,7 +1,7 @@
 package mp4
 
 import (
-	//"bytes"
+	"bytes"
 	"encoding/hex"
 	"fmt"
 
@@ -110,6 +110,175 @@ func TestGenerateHeaderBox(t *testing.T) {
 	if file, err = os.OpenFile("my.fmp4", os.O_CREATE|os.O_WRONLY, 0644); err != nil {
 		t.Fatalf("open file my.fmp4 fail:%s\n", err.Error())
 	}
-	fmp4.serialize(file)
+	fmp4.Serialize(file)
 	file.Close()
 }
+
+func TestFmp4CompositionTimeOffset(t *testing.T) {
+	str := "0142c015ffe1001c6742c015d901e096ffc0040003c4000003000400000300c83c58b92001000568cb83cb20"
+	spsByte, _ := hex.DecodeString(str)
+
+	fmp4 := NewFmp4(1000)
+	if err := fmp4.AddVideoH264Track(spsByte); err != nil {
+		t.Fatalf("add h264 track fail:%s\n", err.Error())
+	}
+
+	// 解码顺序 I P B B P B B, pts-dts
+	ctsList := []int32{40, 120, 0, 0, 120, 0, 0}
+	cnt := make([]byte, 16)
+	byteio.PutU32BE(cnt, 12)
+	for i, cts := range ctsList {
+		if err := fmp4.AddVideoFrameWithCts(cnt, int64(i*40), cts, i == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fmp4.AddVideoFrameWithCts(cnt, int64(len(ctsList)*40), 40, true)
+
+	var buf bytes.Buffer
+	if _, err := fmp4.MoofMdat[0].Moof.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if uint64(buf.Len()) != fmp4.MoofMdat[0].Moof.Size {
+		t.Fatalf("moof size:%d but serialized:%d", fmp4.MoofMdat[0].Moof.Size, buf.Len())
+	}
+
+	moof, _, err := NewBox().Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trun, ok := findBoxByType(moof.GetSubBoxes(), []uint32{BoxTypeTRAF, BoxTypeTRUN}).(*TrunBox)
+	if !ok || !trun.isSampleCompositionTimeOffsetExists() || trun.version != 1 {
+		t.Fatal("expect trun with composition time offset")
+	}
+	for i, sample := range trun.BoxSamples {
+		if sample.SSampleCompositionTimeOffset != ctsList[i] {
+			t.Fatalf("sample %d expect cts:%d but:%d", i, ctsList[i], sample.SSampleCompositionTimeOffset)
+		}
+	}
+}
+
+func TestFmp4WriteFragments(t *testing.T) {
+	str := "0142c015ffe1001c6742c015d901e096ffc0040003c4000003000400000300c83c58b92001000568cb83cb20"
+	spsByte, _ := hex.DecodeString(str)
+
+	fmp4 := NewFmp4(1000)
+	if err := fmp4.AddVideoH264Track(spsByte); err != nil {
+		t.Fatal(err)
+	}
+	if err := fmp4.AddAudioTrack([]byte{0x14, 0x08}); err != nil {
+		t.Fatal(err)
+	}
+
+	cnt := make([]byte, 16)
+	byteio.PutU32BE(cnt, 12)
+	var buf bytes.Buffer
+	for i := int64(0); i < 60; i++ {
+		if err := fmp4.AddVideoFrameWithLen(cnt, i*40, i%25 == 0); err != nil {
+			t.Fatal(err)
+		}
+		// 第二个gop没有音频
+		if i < 25 || i >= 50 {
+			if err := fmp4.AddAudioFrameWithoutLen(cnt[4:], i*40); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := fmp4.WriteFragments(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 最后一个gop没有等到下一个关键帧
+	if err := fmp4.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmp4.WriteFragments(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只按照box头遍历顶层box, moof再解析
+	var types []uint32
+	var seqs []uint32
+	data := buf.Bytes()
+	for offset := 0; offset < len(data); {
+		size := int(byteio.U32BE(data[offset:]))
+		boxType := byteio.U32BE(data[offset+4:])
+		types = append(types, boxType)
+		if boxType == BoxTypeMOOF {
+			box, _, err := NewBox().Parse(bytes.NewReader(data[offset : offset+size]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mfhd := findBoxByType(box.GetSubBoxes(), []uint32{BoxTypeMFHD}).(*MfhdBox)
+			seqs = append(seqs, mfhd.SequenceNumber)
+			tfhd := findBoxByType(box.GetSubBoxes(), []uint32{BoxTypeTRAF, BoxTypeTFHD}).(*TfhdBox)
+			if tfhd.BaseDataOffset != uint64(offset) {
+				t.Fatalf("moof at %d but base data offset %d", offset, tfhd.BaseDataOffset)
+			}
+		}
+		offset += size
+	}
+	expect := []uint32{BoxTypeFTYP, BoxTypeMOOV, BoxTypeMOOF, BoxTypeMDAT, BoxTypeMOOF, BoxTypeMDAT, BoxTypeMOOF, BoxTypeMDAT}
+	if fmt.Sprint(types) != fmt.Sprint(expect) {
+		t.Fatalf("expect boxes %v but %v", expect, types)
+	}
+	if fmt.Sprint(seqs) != "[1 2 3]" {
+		t.Fatalf("wrong sequence numbers %v", seqs)
+	}
+}
+
+func TestFmp4DefaultBaseIsMoof(t *testing.T) {
+	str := "0142c015ffe1001c6742c015d901e096ffc0040003c4000003000400000300c83c58b92001000568cb83cb20"
+	spsByte, _ := hex.DecodeString(str)
+
+	fmp4 := NewFmp4(1000)
+	fmp4.SetDefaultBaseIsMoof()
+	if err := fmp4.AddVideoH264Track(spsByte); err != nil {
+		t.Fatal(err)
+	}
+	init, err := fmp4.InitSegment()
+	if err != nil || byteio.U32BE(init[4:]) != BoxTypeFTYP {
+		t.Fatalf("init segment:%v", err)
+	}
+
+	// 每3帧生成一个分片, 不等关键帧
+	cnt := make([]byte, 16)
+	byteio.PutU32BE(cnt, 12)
+	var frags [][]byte
+	for i := int64(0); i < 7; i++ {
+		if i > 0 && i%3 == 0 {
+			if err := fmp4.FlushBefore(i * 40); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if _, err := fmp4.WriteMoofMdat(&buf); err != nil {
+				t.Fatal(err)
+			}
+			frags = append(frags, buf.Bytes())
+		}
+		if err := fmp4.AddVideoFrameWithLen(cnt, i*40, i == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(frags) != 2 {
+		t.Fatalf("fragments:%d", len(frags))
+	}
+	for i, frag := range frags {
+		size := int(byteio.U32BE(frag))
+		box, _, err := NewBox().Parse(bytes.NewReader(frag[:size]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tfhd := findBoxByType(box.GetSubBoxes(), []uint32{BoxTypeTRAF, BoxTypeTFHD}).(*TfhdBox)
+		if tfhd.isBaseDataOffsetExists() || tfhd.flags24Bit&0x020000 == 0 || tfhd.DefaultSampleDuration != 40 {
+			t.Fatalf("fragment %d tfhd flags:%x duration:%d", i, tfhd.flags24Bit, tfhd.DefaultSampleDuration)
+		}
+		tfdt := findBoxByType(box.GetSubBoxes(), []uint32{BoxTypeTRAF, BoxTypeTFDT}).(*TfdtBox)
+		if tfdt.BaseMediaDecodeTime != uint64(i*120) {
+			t.Fatalf("fragment %d decode time:%d", i, tfdt.BaseMediaDecodeTime)
+		}
+		trun := findBoxByType(box.GetSubBoxes(), []uint32{BoxTypeTRAF, BoxTypeTRUN}).(*TrunBox)
+		if int(trun.DataOffset) != size+8 || byteio.U32BE(frag[size+4:]) != BoxTypeMDAT {
+			t.Fatalf("fragment %d data offset:%d moof size:%d", i, trun.DataOffset, size)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package ts
+
+import (
+	"fmt"
+)
+
+// AvcConfig AVCDecoderConfigurationRecord里面ts需要的部分
+type AvcConfig struct {
+	LengthSize int
+	Sps        [][]byte
+	Pps        [][]byte
+}
+
+// ParseAvcConfig record是flv视频sequence header去掉5个字节之后的部分
+func ParseAvcConfig(record []byte) (*AvcConfig, error) {
+	if len(record) < 7 {
+		return nil, fmt.Errorf("avc decoder configuration record too short:%d", len(record))
+	}
+	c := &AvcConfig{
+		LengthSize: int(record[4]&0x03) + 1,
+	}
+	pos := 6
+	readNalus := func(count int) ([][]byte, error) {
+		var nalus [][]byte
+		for i := 0; i < count; i++ {
+			if len(record) < pos+2 {
+				return nil, fmt.Errorf("wrong avc decoder configuration record")
+			}
+			n := int(record[pos])<<8 | int(record[pos+1])
+			pos += 2
+			if len(record) < pos+n {
+				return nil, fmt.Errorf("wrong avc parameter set length:%d", n)
+			}
+			nalus = append(nalus, record[pos:pos+n])
+			pos += n
+		}
+		return nalus, nil
+	}
+
+	var err error
+	if c.Sps, err = readNalus(int(record[5] & 0x1f)); err != nil {
+		return nil, err
+	}
+	if len(record) <= pos {
+		return nil, fmt.Errorf("avc pps not found")
+	}
+	count := int(record[pos])
+	pos++
+	if c.Pps, err = readNalus(count); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var (
+	startCode = []byte{0x00, 0x00, 0x00, 0x01}
+	avcAud    = []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xf0}
+)
+
+// AvccToAnnexB 长度前缀的nalu换成起始码, 前面加AUD, 关键帧前面加sps pps
+// 流里面自己带的AUD去掉, 带了sps的关键帧不再加
+func AvccToAnnexB(dst []byte, frame []byte, config *AvcConfig, keyFrame bool) ([]byte, error) {
+	dst = append(dst, avcAud...)
+	hasSps := false
+	var nalus [][]byte
+	for pos := 0; pos < len(frame); {
+		if len(frame) < pos+config.LengthSize {
+			return nil, fmt.Errorf("wrong nalu length")
+		}
+		n := 0
+		for i := 0; i < config.LengthSize; i++ {
+			n = n<<8 | int(frame[pos+i])
+		}
+		pos += config.LengthSize
+		if n == 0 || len(frame) < pos+n {
+			return nil, fmt.Errorf("wrong nalu length:%d", n)
+		}
+		nalu := frame[pos : pos+n]
+		pos += n
+		switch nalu[0] & 0x1f {
+		case 9:
+			continue
+		case 7:
+			hasSps = true
+		}
+		nalus = append(nalus, nalu)
+	}
+
+	if keyFrame && !hasSps {
+		for _, sps := range config.Sps {
+			dst = append(dst, startCode...)
+			dst = append(dst, sps...)
+		}
+		for _, pps := range config.Pps {
+			dst = append(dst, startCode...)
+			dst = append(dst, pps...)
+		}
+	}
+	for _, nalu := range nalus {
+		dst = append(dst, startCode...)
+		dst = append(dst, nalu...)
+	}
+	return dst, nil
+}
+
+// AacConfig AudioSpecificConfig里面ADTS需要的部分
+type AacConfig struct {
+	ObjectType      int
+	SampleRateIndex int
+	Channels        int
+}
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// ParseAacConfig asc是flv音频sequence header去掉2个字节之后的部分
+func ParseAacConfig(asc []byte) (*AacConfig, error) {
+	if len(asc) < 2 {
+		return nil, fmt.Errorf("audio specific config too short:%d", len(asc))
+	}
+	c := &AacConfig{
+		ObjectType:      int(asc[0] >> 3),
+		SampleRateIndex: int(asc[0]&0x07)<<1 | int(asc[1]>>7),
+		Channels:        int(asc[1]>>3) & 0x0f,
+	}
+	if c.ObjectType == 0 || c.ObjectType > 4 || c.SampleRateIndex >= len(aacSampleRates) {
+		// ADTS只能表示前4种, 也不能表示显式的采样率
+		return nil, fmt.Errorf("aac config not supported by adts:%d %d", c.ObjectType, c.SampleRateIndex)
+	}
+	return c, nil
+}
+
+func (c *AacConfig) SampleRate() int {
+	return aacSampleRates[c.SampleRateIndex]
+}
+
+// AppendAdts frame前面加7个字节的ADTS头, 没有crc
+func (c *AacConfig) AppendAdts(dst []byte, frame []byte) []byte {
+	n := len(frame) + 7
+	dst = append(dst,
+		0xff,
+		0xf1, // mpeg-4, layer 0, protection_absent
+		byte(c.ObjectType-1)<<6|byte(c.SampleRateIndex)<<2|byte(c.Channels>>2),
+		byte(c.Channels&0x03)<<6|byte(n>>11),
+		byte(n>>3),
+		byte(n&0x07)<<5|0x1f,
+		0xfc,
+	)
+	return append(dst, frame...)
+}
@@ -0,0 +1,280 @@
+package ts
+
+import (
+	"fmt"
+	"io"
+)
+
+/*
+	mpeg-ts封装, hls用
+	1. 一个节目, PAT和PMT在每个切片开头写一次
+	2. 视频h264(Annex-B), 音频aac(ADTS), 时间戳都是90kHz
+	3. PCR放在视频的PID上, 纯音频的时候放在音频的PID上
+	   标准要求至少100毫秒一个PCR, 这个PID上每个PES都带, 比dts早pcrDelay
+*/
+
+const (
+	PacketSize = 188
+	syncByte   = 0x47
+
+	PidPAT   = 0x0000
+	PidPMT   = 0x1000
+	PidVideo = 0x0100
+	PidAudio = 0x0101
+
+	StreamTypeH264 = 0x1b
+	StreamTypeH265 = 0x24
+	StreamTypeAAC  = 0x0f
+
+	streamIDVideo = 0xe0
+	streamIDAudio = 0xc0
+
+	// pcrDelay PCR比dts早100毫秒, 给解码器留缓冲的时间
+	pcrDelay = 9000
+)
+
+// Muxer 不是协程安全的
+type Muxer struct {
+	w               io.Writer
+	videoStreamType uint8 // 0表示没有视频
+	audioStreamType uint8 // 0表示没有音频
+	cc              map[uint16]uint8
+}
+
+func NewMuxer(w io.Writer, videoStreamType, audioStreamType uint8) *Muxer {
+	return &Muxer{
+		w:               w,
+		videoStreamType: videoStreamType,
+		audioStreamType: audioStreamType,
+		cc:              make(map[uint16]uint8),
+	}
+}
+
+// Reset 换一个输出, 连续计数器接着用, 播放器切换切片的时候不会认为丢包
+func (m *Muxer) Reset(w io.Writer) {
+	m.w = w
+}
+
+func (m *Muxer) pcrPid() uint16 {
+	if m.videoStreamType != 0 {
+		return PidVideo
+	}
+	return PidAudio
+}
+
+// nextCC 每个PID带payload的包加1
+func (m *Muxer) nextCC(pid uint16) uint8 {
+	cc := m.cc[pid]
+	m.cc[pid] = (cc + 1) & 0x0f
+	return cc
+}
+
+// WriteTables PAT和PMT
+func (m *Muxer) WriteTables() error {
+	pat := []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator, section_length 13
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number
+		0xe0 | byte(PidPMT>>8), byte(PidPMT & 0xff),
+	}
+	if err := m.writeSection(PidPAT, pat); err != nil {
+		return err
+	}
+
+	pmt := []byte{
+		0x02,       // table_id
+		0xb0, 0x00, // section_length后面填
+		0x00, 0x01, // program_number
+		0xc1,
+		0x00, 0x00,
+		0xe0 | byte(m.pcrPid()>>8), byte(m.pcrPid() & 0xff),
+		0xf0, 0x00, // program_info_length
+	}
+	if m.videoStreamType != 0 {
+		pmt = append(pmt, m.videoStreamType, 0xe0|byte(PidVideo>>8), byte(PidVideo&0xff), 0xf0, 0x00)
+	}
+	if m.audioStreamType != 0 {
+		pmt = append(pmt, m.audioStreamType, 0xe0|byte(PidAudio>>8), byte(PidAudio&0xff), 0xf0, 0x00)
+	}
+	// section_length从它后面开始算, 包括crc
+	sectionLen := len(pmt) - 3 + 4
+	pmt[1] |= byte(sectionLen >> 8)
+	pmt[2] = byte(sectionLen)
+	return m.writeSection(PidPMT, pmt)
+}
+
+// writeSection PSI只有一个包, pointer_field是0
+func (m *Muxer) writeSection(pid uint16, section []byte) error {
+	var pkt [PacketSize]byte
+	for i := range pkt {
+		pkt[i] = 0xff
+	}
+	pkt[0] = syncByte
+	pkt[1] = 0x40 | byte(pid>>8)
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.nextCC(pid)
+	pkt[4] = 0x00
+	n := copy(pkt[5:], section)
+	crc := crc32Mpeg2(section)
+	pkt[5+n] = byte(crc >> 24)
+	pkt[6+n] = byte(crc >> 16)
+	pkt[7+n] = byte(crc >> 8)
+	pkt[8+n] = byte(crc)
+	_, err := m.w.Write(pkt[:])
+	return err
+}
+
+// WriteVideo frame是Annex-B格式, pts dts是90kHz, 每一帧都带PCR, 关键帧带random_access_indicator
+func (m *Muxer) WriteVideo(pts, dts uint64, keyFrame bool, frame []byte) error {
+	if m.videoStreamType == 0 {
+		return fmt.Errorf("ts muxer without video")
+	}
+	pes := pesHeader(streamIDVideo, pts, dts, len(frame))
+	pes = append(pes, frame...)
+	return m.writePES(PidVideo, pes, pcrOf(dts), true, keyFrame)
+}
+
+// WriteAudio frame是带ADTS头的aac
+func (m *Muxer) WriteAudio(pts uint64, frame []byte) error {
+	if m.audioStreamType == 0 {
+		return fmt.Errorf("ts muxer without audio")
+	}
+	pes := pesHeader(streamIDAudio, pts, pts, len(frame))
+	pes = append(pes, frame...)
+	withPCR := m.pcrPid() == PidAudio
+	return m.writePES(PidAudio, pes, pcrOf(pts), withPCR, withPCR)
+}
+
+// pcrOf 开始的时候dts比pcrDelay小就是0
+func pcrOf(dts uint64) uint64 {
+	if dts < pcrDelay {
+		return 0
+	}
+	return dts - pcrDelay
+}
+
+// pesHeader pts和dts一样的时候只写pts
+func pesHeader(streamID uint8, pts, dts uint64, frameLen int) []byte {
+	hdrDataLen := 5
+	flags := byte(0x80)
+	if pts != dts {
+		hdrDataLen = 10
+		flags = 0xc0
+	}
+	pesLen := 3 + hdrDataLen + frameLen
+	if pesLen > 0xffff {
+		// 视频可以是0, 表示不限制
+		pesLen = 0
+	}
+
+	h := make([]byte, 0, 9+hdrDataLen+frameLen)
+	h = append(h, 0x00, 0x00, 0x01, streamID, byte(pesLen>>8), byte(pesLen), 0x80, flags, byte(hdrDataLen))
+	if pts != dts {
+		h = appendTimestamp(h, 0x3, pts)
+		h = appendTimestamp(h, 0x1, dts)
+	} else {
+		h = appendTimestamp(h, 0x2, pts)
+	}
+	return h
+}
+
+// appendTimestamp 33位的pts/dts, 中间穿插marker bit
+func appendTimestamp(b []byte, prefix uint8, ts uint64) []byte {
+	ts &= 0x1ffffffff
+	return append(b,
+		prefix<<4|byte(ts>>29)&0x0e|0x01,
+		byte(ts>>22),
+		byte(ts>>14)&0xfe|0x01,
+		byte(ts>>7),
+		byte(ts<<1)|0x01,
+	)
+}
+
+// writePES 拆成ts包, 第一个包可以带PCR, 最后一个包用adaptation field填充
+func (m *Muxer) writePES(pid uint16, pes []byte, pcr uint64, withPCR, randomAccess bool) error {
+	first := true
+	for len(pes) > 0 {
+		var pkt [PacketSize]byte
+		pkt[0] = syncByte
+		pkt[1] = byte(pid>>8) & 0x1f
+		if first {
+			pkt[1] |= 0x40 // payload_unit_start_indicator
+		}
+		pkt[2] = byte(pid)
+
+		// adaptation field除了长度字节之外的内容
+		var af []byte
+		if first && (withPCR || randomAccess) {
+			var flags byte
+			if randomAccess {
+				flags |= 0x40
+			}
+			af = append(af, flags)
+			if withPCR {
+				af[0] |= 0x10
+				base := pcr & 0x1ffffffff
+				af = append(af, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7e, 0x00)
+			}
+		}
+		minAf := 0
+		if af != nil {
+			minAf = 1 + len(af)
+		}
+		n := len(pes)
+		if n > PacketSize-4-minAf {
+			n = PacketSize - 4 - minAf
+		}
+
+		afTotal := PacketSize - 4 - n
+		if afTotal > 0 {
+			pkt[3] = 0x30 | m.nextCC(pid)
+			pkt[4] = byte(afTotal - 1)
+			if afTotal > 1 {
+				if af == nil {
+					af = []byte{0x00}
+				}
+				copy(pkt[5:], af)
+				for i := 5 + len(af); i < 4+afTotal; i++ {
+					pkt[i] = 0xff
+				}
+			}
+		} else {
+			pkt[3] = 0x10 | m.nextCC(pid)
+		}
+		copy(pkt[4+afTotal:], pes[:n])
+		if _, err := m.w.Write(pkt[:]); err != nil {
+			return err
+		}
+		pes = pes[n:]
+		first = false
+	}
+	return nil
+}
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32Mpeg2 PSI的crc, 不反转, 没有最后的异或
+func crc32Mpeg2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -0,0 +1,184 @@
+package ts
+
+import (
+	"bytes"
+	"testing"
+)
+
+type testPacket struct {
+	pid        uint16
+	start      bool
+	cc         uint8
+	pcr        int64 // -1表示没有
+	randomAcc  bool
+	payload    []byte
+	afLen      int
+	hasPayload bool
+}
+
+func parsePackets(t *testing.T, data []byte) []testPacket {
+	if len(data)%PacketSize != 0 {
+		t.Fatalf("ts length:%d", len(data))
+	}
+	var pkts []testPacket
+	for ; len(data) > 0; data = data[PacketSize:] {
+		b := data[:PacketSize]
+		if b[0] != syncByte {
+			t.Fatalf("sync byte:%x", b[0])
+		}
+		p := testPacket{
+			pid:        uint16(b[1]&0x1f)<<8 | uint16(b[2]),
+			start:      b[1]&0x40 != 0,
+			cc:         b[3] & 0x0f,
+			pcr:        -1,
+			hasPayload: b[3]&0x10 != 0,
+		}
+		pos := 4
+		if b[3]&0x20 != 0 {
+			p.afLen = int(b[4])
+			if p.afLen > 0 {
+				flags := b[5]
+				p.randomAcc = flags&0x40 != 0
+				if flags&0x10 != 0 {
+					p.pcr = int64(b[6])<<25 | int64(b[7])<<17 | int64(b[8])<<9 | int64(b[9])<<1 | int64(b[10]>>7)
+				}
+			}
+			pos += 1 + p.afLen
+		}
+		p.payload = b[pos:]
+		pkts = append(pkts, p)
+	}
+	return pkts
+}
+
+func parseTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+func TestWriteTables(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf, StreamTypeH264, StreamTypeAAC)
+	if err := m.WriteTables(); err != nil {
+		t.Fatal(err)
+	}
+	pkts := parsePackets(t, buf.Bytes())
+	if len(pkts) != 2 || pkts[0].pid != PidPAT || pkts[1].pid != PidPMT {
+		t.Fatalf("tables:%+v", pkts)
+	}
+
+	// 和ffmpeg生成的PAT一样
+	pat := []byte{0x00, 0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00, 0x2a, 0xb1, 0x04, 0xb2}
+	if !bytes.Equal(pkts[0].payload[:len(pat)], pat) {
+		t.Fatalf("pat:%x", pkts[0].payload[:len(pat)])
+	}
+
+	pmt := pkts[1].payload[1:]
+	sectionLen := int(pmt[1]&0x0f)<<8 | int(pmt[2])
+	if sectionLen != 9+5*2+4 {
+		t.Fatalf("pmt section length:%d", sectionLen)
+	}
+	crc := crc32Mpeg2(pmt[:3+sectionLen-4])
+	got := uint32(pmt[3+sectionLen-4])<<24 | uint32(pmt[3+sectionLen-3])<<16 | uint32(pmt[3+sectionLen-2])<<8 | uint32(pmt[3+sectionLen-1])
+	if crc != got {
+		t.Fatalf("pmt crc:%x %x", crc, got)
+	}
+	if pcrPid := uint16(pmt[8]&0x1f)<<8 | uint16(pmt[9]); pcrPid != PidVideo {
+		t.Fatalf("pcr pid:%x", pcrPid)
+	}
+	if pmt[12] != StreamTypeH264 || pmt[17] != StreamTypeAAC {
+		t.Fatalf("stream types:%x %x", pmt[12], pmt[17])
+	}
+}
+
+func TestWriteVideo(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMuxer(&buf, StreamTypeH264, 0)
+	frame := make([]byte, 1000)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	if err := m.WriteVideo(9000+3600, 9000, true, frame); err != nil {
+		t.Fatal(err)
+	}
+	// 非关键帧也带PCR, adaptation field是8个字节
+	if err := m.WriteVideo(12600, 12600, false, frame[:184-8-14]); err != nil {
+		t.Fatal(err)
+	}
+
+	pkts := parsePackets(t, buf.Bytes())
+	var pes []byte
+	for i, p := range pkts {
+		if p.pid != PidVideo || p.cc != uint8(i)&0x0f || !p.hasPayload {
+			t.Fatalf("packet %d:%+v", i, p)
+		}
+		if i == 0 && (!p.start || p.pcr != 9000-pcrDelay || !p.randomAcc) {
+			t.Fatalf("first packet:%+v", p)
+		}
+		if p.start && i > 0 {
+			break
+		}
+		pes = append(pes, p.payload...)
+	}
+
+	// 有dts的pes头
+	if !bytes.Equal(pes[:4], []byte{0, 0, 1, streamIDVideo}) || pes[7] != 0xc0 || pes[8] != 10 {
+		t.Fatalf("pes header:%x", pes[:9])
+	}
+	if pesLen := int(pes[4])<<8 | int(pes[5]); pesLen != len(pes)-6 {
+		t.Fatalf("pes length:%d %d", pesLen, len(pes)-6)
+	}
+	if pts, dts := parseTimestamp(pes[9:]), parseTimestamp(pes[14:]); pts != 12600 || dts != 9000 {
+		t.Fatalf("pts:%d dts:%d", pts, dts)
+	}
+	if !bytes.Equal(pes[19:], frame) {
+		t.Fatal("pes payload")
+	}
+
+	// 加上PCR刚好一个包的pes不需要填充, 非关键帧没有random_access_indicator
+	last := pkts[len(pkts)-1]
+	if !last.start || last.afLen != 7 || last.pcr != 12600-pcrDelay || last.randomAcc || len(last.payload) != 184-8 {
+		t.Fatalf("last packet:%+v", last)
+	}
+}
+
+func TestAvccToAnnexB(t *testing.T) {
+	record := []byte{1, 0x42, 0xc0, 0x15, 0xff, 0xe1, 0x00, 0x03, 0x67, 0x42, 0xc0, 0x01, 0x00, 0x02, 0x68, 0xce}
+	config, err := ParseAvcConfig(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LengthSize != 4 || len(config.Sps) != 1 || len(config.Pps) != 1 || !bytes.Equal(config.Pps[0], []byte{0x68, 0xce}) {
+		t.Fatalf("config:%+v", config)
+	}
+
+	// 自带的AUD去掉, 关键帧加sps pps
+	frame := []byte{0, 0, 0, 2, 0x09, 0xf0, 0, 0, 0, 3, 0x65, 0x88, 0x84}
+	got, err := AvccToAnnexB(nil, frame, config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x67, 0x42, 0xc0, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88, 0x84}
+	if !bytes.Equal(got, expect) {
+		t.Fatalf("annexb:%x", got)
+	}
+
+	if _, err = AvccToAnnexB(nil, []byte{0, 0, 0, 9, 0x41}, config, false); err == nil {
+		t.Fatal("expect wrong nalu length")
+	}
+}
+
+func TestAdts(t *testing.T) {
+	// aac lc 44100 双声道
+	config, err := ParseAacConfig([]byte{0x12, 0x10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ObjectType != 2 || config.SampleRate() != 44100 || config.Channels != 2 {
+		t.Fatalf("config:%+v", config)
+	}
+	got := config.AppendAdts(nil, make([]byte, 100))
+	expect := []byte{0xff, 0xf1, 0x50, 0x80, 0x0d, 0x7f, 0xfc}
+	if !bytes.Equal(got[:7], expect) || len(got) != 107 {
+		t.Fatalf("adts:%x", got[:7])
+	}
+}
@@ -0,0 +1,194 @@
+package exchange
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+)
+
+/*
+	推流和播放的鉴权
+	rtmp在publish/play的时候调用，flvlive在收到第一个script data的时候调用
+	没有设置Authorizer和签名secret的时候都允许
+*/
+
+const (
+	AuthActionPublish = "publish"
+	AuthActionPlay    = "play"
+)
+
+const (
+	AuthAllow        = iota
+	AuthDenyRejected // 没有权限, rtmp回复NetConnection.Connect.Rejected
+	AuthDenyBadName  // 流名不允许, rtmp推流回复NetStream.Publish.BadName, 播放还是Rejected
+)
+
+// AuthRequest 鉴权需要的信息, 查询参数在Key.Args里面
+type AuthRequest struct {
+	Action     string
+	ConnectCmd map[string]interface{} // rtmp的connect命令对象, flvlive是第一个script data
+	TcUrl      string
+	Key        StreamKey
+	RemoteAddr string // ip:port, 拿不到的时候是空
+}
+
+type AuthResult struct {
+	Code   int
+	Reason string
+}
+
+func (r AuthResult) Allowed() bool {
+	return r.Code == AuthAllow
+}
+
+type Authorizer interface {
+	Authorize(req *AuthRequest) AuthResult
+}
+
+// AuthError 鉴权失败返回给协议层的错误
+type AuthError struct {
+	AuthResult
+	Action string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s denied:%s", e.Action, e.Reason)
+}
+
+var (
+	authorizerLock sync.RWMutex
+	authorizer     Authorizer
+)
+
+// SetAuthorizer 设置全局的Authorizer, 只对之后的publish/play生效, nil表示不鉴权
+func SetAuthorizer(a Authorizer) {
+	authorizerLock.Lock()
+	defer authorizerLock.Unlock()
+	authorizer = a
+}
+
+// Authorize 先检查app配置的签名(见sign.go)，再调用Authorizer, 不允许的时候返回*AuthError
+func Authorize(req *AuthRequest) error {
+	if err := checkSign(req); err != nil {
+		return err
+	}
+
+	authorizerLock.RLock()
+	a := authorizer
+	authorizerLock.RUnlock()
+	if a == nil {
+		return nil
+	}
+
+	res := a.Authorize(req)
+	if res.Allowed() {
+		return nil
+	}
+	return &AuthError{AuthResult: res, Action: req.Action}
+}
+
+// StaticAuthConfig 静态白名单, 列表为空表示不限制
+// 流名支持"app/stream"和"vhost/app/stream"两种写法, 每一段都可以用path.Match的通配符，比如"live/*"
+// 地址是ip或者cidr
+type StaticAuthConfig struct {
+	PublishStreams []string
+	PlayStreams    []string
+	PublishAddrs   []string
+	PlayAddrs      []string
+}
+
+type staticAuthRule struct {
+	streams []string
+	nets    []*net.IPNet
+}
+
+type StaticAuthorizer struct {
+	publish staticAuthRule
+	play    staticAuthRule
+}
+
+func NewStaticAuthorizer(config StaticAuthConfig) (*StaticAuthorizer, error) {
+	a := &StaticAuthorizer{
+		publish: staticAuthRule{streams: config.PublishStreams},
+		play:    staticAuthRule{streams: config.PlayStreams},
+	}
+	var err error
+	if a.publish.nets, err = parseAuthAddrs(config.PublishAddrs); err != nil {
+		return nil, err
+	}
+	if a.play.nets, err = parseAuthAddrs(config.PlayAddrs); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseAuthAddrs(addrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("wrong auth addr:%s", addr)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("wrong auth addr:%s", addr)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (a *StaticAuthorizer) Authorize(req *AuthRequest) AuthResult {
+	rule := &a.play
+	if req.Action == AuthActionPublish {
+		rule = &a.publish
+	}
+
+	if len(rule.nets) > 0 && !rule.matchAddr(req.RemoteAddr) {
+		return AuthResult{Code: AuthDenyRejected, Reason: "address not allowed"}
+	}
+	if len(rule.streams) > 0 && !rule.matchStream(req.Key) {
+		return AuthResult{Code: AuthDenyBadName, Reason: "stream not allowed"}
+	}
+	return AuthResult{Code: AuthAllow}
+}
+
+func (r *staticAuthRule) matchAddr(remoteAddr string) bool {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *staticAuthRule) matchStream(key StreamKey) bool {
+	for _, pattern := range r.streams {
+		name := key.App + "/" + key.Stream
+		if strings.Count(pattern, "/") >= 2 {
+			name = key.Vhost + "/" + name
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package exchange
+
+import (
+	"testing"
+)
+
+func TestStaticAuthorizer(t *testing.T) {
+	AddVhost("a.com")
+	AddVhost("b.com")
+	a, err := NewStaticAuthorizer(StaticAuthConfig{
+		PublishStreams: []string{"live/*", "a.com/app/fixed"},
+		PublishAddrs:   []string{"127.0.0.1", "10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newReq := func(action, url, addr string) *AuthRequest {
+		key, err := ParseStreamUrl(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &AuthRequest{Action: action, Key: key, RemoteAddr: addr}
+	}
+
+	for _, c := range []struct {
+		req  *AuthRequest
+		code int
+	}{
+		{newReq(AuthActionPublish, "rtmp://127.0.0.1/live/s?token=1", "127.0.0.1:5000"), AuthAllow},
+		{newReq(AuthActionPublish, "rtmp://a.com/app/fixed", "10.1.2.3:5000"), AuthAllow},
+		{newReq(AuthActionPublish, "rtmp://b.com/app/fixed", "10.1.2.3:5000"), AuthDenyBadName},
+		{newReq(AuthActionPublish, "rtmp://127.0.0.1/other/s", "127.0.0.1:5000"), AuthDenyBadName},
+		{newReq(AuthActionPublish, "rtmp://127.0.0.1/live/s", "192.168.1.1:5000"), AuthDenyRejected},
+		{newReq(AuthActionPublish, "rtmp://127.0.0.1/live/s", ""), AuthDenyRejected},
+		// 播放没有配置，都允许
+		{newReq(AuthActionPlay, "rtmp://127.0.0.1/other/s", "192.168.1.1:5000"), AuthAllow},
+	} {
+		if res := a.Authorize(c.req); res.Code != c.code {
+			t.Fatalf("%s %s %s expect:%d but:%d", c.req.Action, c.req.Key, c.req.RemoteAddr, c.code, res.Code)
+		}
+	}
+
+	if _, err = NewStaticAuthorizer(StaticAuthConfig{PlayAddrs: []string{"abc"}}); err == nil {
+		t.Fatal("expect error for wrong addr")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	req := &AuthRequest{Action: AuthActionPublish, Key: StreamKey{App: "live", Stream: "s"}}
+	if err := Authorize(req); err != nil {
+		t.Fatal("no authorizer should allow:", err)
+	}
+
+	a, _ := NewStaticAuthorizer(StaticAuthConfig{PublishStreams: []string{"other/*"}})
+	SetAuthorizer(a)
+	defer SetAuthorizer(nil)
+	err := Authorize(req)
+	if authErr, ok := err.(*AuthError); !ok || authErr.Code != AuthDenyBadName {
+		t.Fatalf("expect bad name but:%v", err)
+	}
+}
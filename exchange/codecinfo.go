@@ -0,0 +1,333 @@
+package exchange
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/chinasarft/golive/utils/bitreader"
+)
+
+/*
+	从sequence header里面解析出宽高，profile，采样率这些信息，生成服务端的onMetaData用
+	只解析需要的字段，sps后面的vui这些都不管
+*/
+
+type videoCodecInfo struct {
+	CodecID int // flv的codecid, 7 avc, 12 hevc
+	Profile int
+	Level   int
+	Width   int
+	Height  int
+}
+
+type audioCodecInfo struct {
+	SampleRate int
+	Channels   int
+}
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// parseAudioCodecInfo payload是flv audio tag data, 前两个字节之后是AudioSpecificConfig
+func parseAudioCodecInfo(payload []byte) (*audioCodecInfo, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("aac sequence header too short:%d", len(payload))
+	}
+	br := bitreader.NewReader(bytes.NewReader(payload[2:]))
+	if _, err := br.Read8(5); err != nil { // audioObjectType
+		return nil, err
+	}
+	idx, err := br.Read8(4)
+	if err != nil {
+		return nil, err
+	}
+	info := &audioCodecInfo{}
+	if idx == 0x0F {
+		rate, err := br.Read32(24)
+		if err != nil {
+			return nil, err
+		}
+		info.SampleRate = int(rate)
+	} else if int(idx) < len(aacSampleRates) {
+		info.SampleRate = aacSampleRates[idx]
+	}
+	channels, err := br.Read8(4)
+	if err != nil {
+		return nil, err
+	}
+	info.Channels = int(channels)
+	return info, nil
+}
+
+// parseVideoCodecInfo payload是flv video tag data, 5个字节之后是AVC/HEVCDecoderConfigurationRecord
+func parseVideoCodecInfo(payload []byte, avFormat uint8) (*videoCodecInfo, error) {
+	if len(payload) < 6 {
+		return nil, fmt.Errorf("video sequence header too short:%d", len(payload))
+	}
+	if avFormat == AvFormatHEVC {
+		return parseHevcCodecInfo(payload[5:])
+	}
+	return parseAvcCodecInfo(payload[5:])
+}
+
+func parseAvcCodecInfo(record []byte) (*videoCodecInfo, error) {
+	// version profile compatibility level lengthSizeMinusOne numOfSps spsLength(2)
+	if len(record) < 8 || record[5]&0x1F == 0 {
+		return nil, fmt.Errorf("wrong avc decoder configuration record")
+	}
+	spsLen := int(record[6])<<8 | int(record[7])
+	if len(record) < 8+spsLen {
+		return nil, fmt.Errorf("wrong avc sps length:%d", spsLen)
+	}
+	return parseAvcSps(record[8 : 8+spsLen])
+}
+
+func parseHevcCodecInfo(record []byte) (*videoCodecInfo, error) {
+	if len(record) < 23 {
+		return nil, fmt.Errorf("wrong hevc decoder configuration record")
+	}
+	numOfArrays := int(record[22])
+	pos := 23
+	for i := 0; i < numOfArrays; i++ {
+		if len(record) < pos+3 {
+			break
+		}
+		nalType := record[pos] & 0x3F
+		numNalus := int(record[pos+1])<<8 | int(record[pos+2])
+		pos += 3
+		for j := 0; j < numNalus; j++ {
+			if len(record) < pos+2 {
+				break
+			}
+			naluLen := int(record[pos])<<8 | int(record[pos+1])
+			pos += 2
+			if len(record) < pos+naluLen {
+				break
+			}
+			if nalType == 33 { // sps
+				return parseHevcSps(record[pos : pos+naluLen])
+			}
+			pos += naluLen
+		}
+	}
+	return nil, fmt.Errorf("hevc sps not found")
+}
+
+// removeEmulationPrevention 去掉00 00 03里面的03
+func removeEmulationPrevention(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+type expGolombReader struct {
+	bitreader.BitReader
+	err error
+}
+
+func (r *expGolombReader) u(n uint) uint32 {
+	if r.err != nil {
+		return 0
+	}
+	var v uint32
+	v, r.err = r.Read32(n)
+	return v
+}
+
+func (r *expGolombReader) ue() uint32 {
+	zeros := uint(0)
+	for r.err == nil && r.u(1) == 0 {
+		zeros++
+		if zeros > 31 {
+			r.err = fmt.Errorf("wrong exp-golomb code")
+		}
+	}
+	if zeros == 0 {
+		return 0
+	}
+	return (1 << zeros) - 1 + r.u(zeros)
+}
+
+func (r *expGolombReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+func newExpGolombReader(rbsp []byte) *expGolombReader {
+	return &expGolombReader{
+		BitReader: bitreader.NewReader(bytes.NewReader(rbsp)),
+	}
+}
+
+func (r *expGolombReader) skipScalingList(size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+func parseAvcSps(nalu []byte) (*videoCodecInfo, error) {
+	if len(nalu) < 4 {
+		return nil, fmt.Errorf("avc sps too short")
+	}
+	r := newExpGolombReader(removeEmulationPrevention(nalu[1:]))
+	info := &videoCodecInfo{CodecID: 7}
+	info.Profile = int(r.u(8))
+	r.u(8) // constraint flags
+	info.Level = int(r.u(8))
+	r.ue() // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	switch info.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.u(1) // separate_colour_plane_flag
+		}
+		r.ue()           // bit_depth_luma_minus8
+		r.ue()           // bit_depth_chroma_minus8
+		r.u(1)           // qpprime_y_zero_transform_bypass_flag
+		if r.u(1) == 1 { // seq_scaling_matrix_present_flag
+			count := 8
+			if chromaFormat == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				if r.u(1) == 1 {
+					if i < 6 {
+						r.skipScalingList(16)
+					} else {
+						r.skipScalingList(64)
+					}
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.u(1)
+		r.se()
+		r.se()
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue() // max_num_ref_frames
+	r.u(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	frameMbsOnly := r.u(1)
+	if frameMbsOnly == 0 {
+		r.u(1) // mb_adaptive_frame_field_flag
+	}
+	r.u(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.u(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	cropUnitX, cropUnitY := uint32(1), 2-frameMbsOnly
+	switch chromaFormat {
+	case 1:
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropUnitX = 2
+	}
+	info.Width = int(widthInMbs*16 - (cropLeft+cropRight)*cropUnitX)
+	info.Height = int((2-frameMbsOnly)*heightInMapUnits*16 - (cropTop+cropBottom)*cropUnitY)
+	return info, nil
+}
+
+func parseHevcSps(nalu []byte) (*videoCodecInfo, error) {
+	if len(nalu) < 4 {
+		return nil, fmt.Errorf("hevc sps too short")
+	}
+	r := newExpGolombReader(removeEmulationPrevention(nalu[2:]))
+	info := &videoCodecInfo{CodecID: 12}
+	r.u(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1 := int(r.u(3))
+	r.u(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level
+	r.u(3) // general_profile_space, general_tier_flag
+	info.Profile = int(r.u(5))
+	r.u(32) // general_profile_compatibility_flags
+	r.u(32) // progressive, interlaced ... 48位的constraint flags
+	r.u(16)
+	info.Level = int(r.u(8))
+	subLayerProfile := make([]bool, maxSubLayersMinus1)
+	subLayerLevel := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		subLayerProfile[i] = r.u(1) == 1
+		subLayerLevel[i] = r.u(1) == 1
+	}
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			r.u(2)
+		}
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if subLayerProfile[i] {
+			r.u(32)
+			r.u(32)
+			r.u(24)
+		}
+		if subLayerLevel[i] {
+			r.u(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chromaFormat := r.ue()
+	if chromaFormat == 3 {
+		r.u(1) // separate_colour_plane_flag
+	}
+	width := r.ue()
+	height := r.ue()
+	if r.u(1) == 1 { // conformance_window_flag
+		subWidth, subHeight := uint32(1), uint32(1)
+		switch chromaFormat {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		width -= (left + right) * subWidth
+		height -= (top + bottom) * subHeight
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	info.Width = int(width)
+	info.Height = int(height)
+	return info, nil
+}
@@ -0,0 +1,57 @@
+package exchange
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/chinasarft/golive/utils/amf"
+)
+
+func TestParseAvcCodecInfo(t *testing.T) {
+	record, _ := hex.DecodeString("0142c015ffe1001c6742c015d901e096ffc0040003c4000003000400000300c83c58b92001000568cb83cb20")
+	payload := append([]byte{0x17, 0, 0, 0, 0}, record...)
+	info, err := parseVideoCodecInfo(payload, AvFormatAVC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 480 || info.Height != 288 || info.Profile != 66 || info.Level != 21 {
+		t.Fatalf("wrong avc info:%+v", info)
+	}
+}
+
+func TestParseAudioCodecInfo(t *testing.T) {
+	info, err := parseAudioCodecInfo([]byte{0xaf, 0, 0x14, 0x08})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SampleRate != 16000 || info.Channels != 1 {
+		t.Fatalf("wrong aac info:%+v", info)
+	}
+}
+
+func TestMetaDataBuilder(t *testing.T) {
+	b := newMetaDataBuilder(MetaDataConfig{Fields: map[string]interface{}{"server": "golive"}})
+	var pub bytes.Buffer
+	amf.WriteValue(&pub, "onMetaData")
+	amf.WriteValue(&pub, amf.Object{"width": float64(640), "encoder": "obs"})
+	b.setPublisherMetaData(pub.Bytes())
+	record, _ := hex.DecodeString("0142c015ffe1001c6742c015d901e096ffc0040003c4000003000400000300c83c58b92001000568cb83cb20")
+	b.setVideoConfig(&ExData{Payload: append([]byte{0x17, 0, 0, 0, 0}, record...), AvFormat: AvFormatAVC})
+	for i := 0; i <= 125; i++ {
+		b.measure(&ExData{DataType: DataTypeVideoNonKeyFrame, Timestamp: uint64(i * 40), Payload: make([]byte, 1000)})
+	}
+
+	r := bytes.NewReader(b.build())
+	if v, _ := amf.ReadValue(r); v != "onMetaData" {
+		t.Fatalf("expect onMetaData but:%v", v)
+	}
+	v, _ := amf.ReadValue(r)
+	obj := v.(amf.Object)
+	if obj["width"] != float64(480) || obj["height"] != float64(288) || obj["encoder"] != "obs" {
+		t.Fatalf("expect size from sps:%v", obj)
+	}
+	if obj["server"] != "golive" || obj["framerate"] != float64(25) || obj["videodatarate"] != float64(200) {
+		t.Fatalf("wrong metadata:%v", obj)
+	}
+}
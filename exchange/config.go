@@ -0,0 +1,253 @@
+package exchange
+
+import (
+	"sync"
+	"time"
+)
+
+// GopCacheConfig gop缓冲的上限，任意一个超过就丢弃当前gop，等待下一个关键帧
+type GopCacheConfig struct {
+	Disabled    bool   // 追求最低延迟的流可以关闭gop缓冲
+	MaxFrames   int    // 音视频帧数
+	MaxBytes    int    // payload总字节数
+	MaxDuration uint64 // 毫秒
+}
+
+// SinkQueueConfig 观看者发送队列的水位, 见readme卡顿处理
+// 队列长度超过HighWatermark开始丢弃视频帧，低于LowWatermark之后从下一个关键帧开始恢复
+// 队列满了还放不进去（比如sequence header)才断开观看者
+// QueueSize是0的时候用默认值, 两个水位都是0的时候按照默认配置的比例
+type SinkQueueConfig struct {
+	QueueSize     int
+	HighWatermark int
+	LowWatermark  int
+	DropAudio     bool // 丢帧期间是否也丢弃音频
+}
+
+// withDefaults 零值换成默认值, 没有用DefaultAppConfig()构造的配置也会丢帧
+func (c SinkQueueConfig) withDefaults() SinkQueueConfig {
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultAppConfig.SinkQueue.QueueSize
+	}
+	if c.HighWatermark <= 0 && c.LowWatermark <= 0 {
+		c.HighWatermark = c.QueueSize * defaultAppConfig.SinkQueue.HighWatermark / defaultAppConfig.SinkQueue.QueueSize
+		c.LowWatermark = c.QueueSize * defaultAppConfig.SinkQueue.LowWatermark / defaultAppConfig.SinkQueue.QueueSize
+	}
+	return c
+}
+
+// PublishQueueConfig 推流数据队列满了之后的处理策略, 见pubqueue.go
+type PublishQueueConfig struct {
+	QueueSize    int
+	Policy       int           // 0是PublishPolicyDropOldest
+	BlockTimeout time.Duration // PublishPolicyBlock的最长等待时间
+}
+
+const (
+	DuplicatePublishReject      = iota // 拒绝新的推流
+	DuplicatePublishReplace            // 抢流, 断开老的推流，观看者转到新的推流
+	DuplicatePublishReplaceIdle        // 老的推流空闲超过IdleTimeout才抢流，否则拒绝
+)
+
+// DuplicatePublishConfig 同一个key重复推流的处理策略
+// 编码器重连的时候服务端可能还没有发现老的tcp连接已经断了
+type DuplicatePublishConfig struct {
+	Policy      int
+	IdleTimeout time.Duration
+}
+
+// PlayWaitConfig 播放的时候流还没有推上来
+// 超时之后rtmp回复NetStream.Play.StreamNotFound并断开
+type PlayWaitConfig struct {
+	Timeout            time.Duration // 0表示一直等待
+	RejectNotPublished bool          // 不等待，直接返回ErrStreamNotFound
+}
+
+// TimestampConfig 推流时间戳整理, 见timestamp.go
+type TimestampConfig struct {
+	Disabled   bool
+	MaxJump    uint64 // 毫秒, 前后两帧差值超过这个值认为时间戳跳变
+	SinkRebase bool   // 每个观看者的时间戳从0开始
+}
+
+// MetaDataConfig 服务端生成onMetaData, 见metadata.go
+type MetaDataConfig struct {
+	Disabled bool                   // 原样转发推流的onMetaData
+	Fields   map[string]interface{} // 加到onMetaData里面的字段，比如server
+}
+
+// RelayConfig 边缘节点回源, 见relay.go
+// Origins是源站的host:port, 按顺序尝试，出错换下一个
+// 最后一个观看者离开IdleTimeout之后断开回源
+// 一轮拉到过数据之后再来一轮, 间隔从ReconnectMin开始翻倍, 最大ReconnectMax, 连接保持StableAfter以上才重置
+type RelayConfig struct {
+	Origins      []string
+	IdleTimeout  time.Duration
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+	StableAfter  time.Duration
+}
+
+// ForwardConfig 本地推流之后转推到上游, 见relay.go
+// Urls是rtmp/rtmps地址模板, {vhost} {app} {stream}替换成本地流的名字
+// 断开之后重连，间隔从ReconnectMin开始翻倍，最大ReconnectMax
+type ForwardConfig struct {
+	Urls         []string
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+}
+
+// RecordConfig 录制成flv文件, 见record.go
+// Path是文件路径模板, {vhost} {app} {stream} {time}替换成流的名字和分段开始的时间
+// 分段超过MaxDuration或者MaxSize之后在下一个关键帧切换文件, 0表示不限制
+// MaxAge和MaxTotalBytes是这个app的录制目录的保留策略, 只清理Path生成的文件, 0表示不限制
+// PublishPath是rtmp publish类型为record/append的时候写的文件模板, 没有{time}, 不分段也不清理, 只支持flv
+// Format是RecordFormatFmp4的时候Path的扩展名也要改成.mp4
+type RecordConfig struct {
+	Enabled       bool
+	Format        string
+	Path          string
+	PublishPath   string
+	MaxDuration   time.Duration
+	MaxSize       int64
+	MaxAge        time.Duration
+	MaxTotalBytes int64
+}
+
+// DvrConfig 时移回看, 见dvr.go
+// source保留最近Window的数据, 0表示不开启
+// 内存里面的数据超过MaxMemory之后, 配置了SpillDir就把老的数据写到磁盘, 否则丢弃老的数据
+type DvrConfig struct {
+	Window    time.Duration
+	MaxMemory int64
+	SpillDir  string
+}
+
+// HlsConfig hls切片, 见app/hls
+// 第一次请求m3u8的时候开始切片, IdleTimeout没有请求之后停止
+// 切片在关键帧切换, 不短于SegmentDuration, m3u8里面保留最近PlaylistLength个切片
+// Dir是切片目录模板, {vhost} {app} {stream}替换成流的名字, 空表示切片只放在内存里面
+// LowLatency是ll-hls, 切片是fmp4, 每PartDuration左右一个EXT-X-PART, 延迟要低的话SegmentDuration也要改成1到2秒
+type HlsConfig struct {
+	SegmentDuration time.Duration
+	PlaylistLength  int
+	Dir             string
+	IdleTimeout     time.Duration
+	LowLatency      bool
+	PartDuration    time.Duration
+}
+
+const (
+	RecordFormatFlv  = "flv"
+	RecordFormatFmp4 = "mp4" // 只支持h264和aac
+)
+
+// AppConfig 每个app一份配置，没有配置的app使用defaultAppConfig
+type AppConfig struct {
+	GopCache         GopCacheConfig
+	SinkQueue        SinkQueueConfig
+	PublishQueue     PublishQueueConfig
+	DuplicatePublish DuplicatePublishConfig
+	PlayWait         PlayWaitConfig
+	Timestamp        TimestampConfig
+	MetaData         MetaDataConfig
+	Sign             SignConfig
+	Relay            RelayConfig
+	Forward          ForwardConfig
+	Record           RecordConfig
+	Dvr              DvrConfig
+	Hls              HlsConfig
+}
+
+var defaultAppConfig = AppConfig{
+	GopCache: GopCacheConfig{
+		MaxFrames:   1024,
+		MaxBytes:    8 * 1024 * 1024,
+		MaxDuration: 10000,
+	},
+	SinkQueue: SinkQueueConfig{
+		QueueSize:     100,
+		HighWatermark: 60,
+		LowWatermark:  30,
+	},
+	PublishQueue: PublishQueueConfig{
+		QueueSize:    100,
+		Policy:       PublishPolicyDropOldest,
+		BlockTimeout: 2 * time.Second,
+	},
+	DuplicatePublish: DuplicatePublishConfig{
+		Policy:      DuplicatePublishReject,
+		IdleTimeout: 5 * time.Second,
+	},
+	PlayWait: PlayWaitConfig{
+		Timeout: 10 * time.Second,
+	},
+	Timestamp: TimestampConfig{
+		MaxJump: 10000,
+	},
+	MetaData: MetaDataConfig{
+		Fields: map[string]interface{}{
+			"server": "golive",
+		},
+	},
+	Relay: RelayConfig{
+		IdleTimeout:  10 * time.Second,
+		ReconnectMin: time.Second,
+		ReconnectMax: 30 * time.Second,
+		StableAfter:  10 * time.Second,
+	},
+	Forward: ForwardConfig{
+		ReconnectMin: time.Second,
+		ReconnectMax: 30 * time.Second,
+	},
+	Record: RecordConfig{
+		Format:      RecordFormatFlv,
+		Path:        "record/{vhost}/{app}/{stream}-{time}.flv",
+		PublishPath: "record/{vhost}/{app}/{stream}.flv",
+		MaxDuration: 30 * time.Minute,
+	},
+	Dvr: DvrConfig{
+		MaxMemory: 64 * 1024 * 1024,
+	},
+	Hls: HlsConfig{
+		SegmentDuration: 4 * time.Second,
+		PlaylistLength:  5,
+		IdleTimeout:     30 * time.Second,
+		PartDuration:    300 * time.Millisecond,
+	},
+}
+
+var (
+	appConfigLock sync.RWMutex
+	appConfigs    = make(map[string]*AppConfig)
+)
+
+func DefaultAppConfig() AppConfig {
+	return defaultAppConfig
+}
+
+// SetAppConfig 设置app的配置，只对之后注册的source/sink生效
+// app可以是"app"或者"vhost/app", 查找的时候先找vhost/app再找app
+func SetAppConfig(app string, config AppConfig) {
+	appConfigLock.Lock()
+	defer appConfigLock.Unlock()
+	c := config
+	appConfigs[app] = &c
+}
+
+// GetAppConfig 查询key对应的配置
+func GetAppConfig(key StreamKey) AppConfig {
+	return *getAppConfig(key)
+}
+
+func getAppConfig(key StreamKey) *AppConfig {
+	appConfigLock.RLock()
+	defer appConfigLock.RUnlock()
+	if c, ok := appConfigs[key.Vhost+"/"+key.App]; ok {
+		return c
+	}
+	if c, ok := appConfigs[key.App]; ok {
+		return c
+	}
+	return &defaultAppConfig
+}
@@ -43,6 +43,7 @@ type gopBlock struct {
 	buf    []byte
 	items  []*BlockItem
 	config Config
+	hint   uint32 // 下一次分配开始查找的位置，避免每次都从头开始
 }
 
 func newGopBlock(config Config) *gopBlock {
@@ -57,7 +58,7 @@ func newGopBlock(config Config) *gopBlock {
 			block: block,
 			flag:  item_not_used,
 		}
-		item.rw = bytes.NewBuffer(item.Buf)
+		item.rw = bytes.NewBuffer(item.Buf[:0])
 		block.items = append(block.items, item)
 	}
 
@@ -67,7 +68,10 @@ func newGopBlock(config Config) *gopBlock {
 // TODO 如果失败，应该往另外一个partner丢
 func (b *gopBlock) AllocBlockItem() (*BlockItem, error) {
 
-	for i := 0; i < len(b.items); i++ {
+	count := len(b.items)
+	start := int(atomic.AddUint32(&b.hint, 1)) % count
+	for j := 0; j < count; j++ {
+		i := (start + j) % count
 		if atomic.CompareAndSwapInt32(&b.items[i].flag, item_not_used, int32(i)) {
 			return b.items[i], nil
 		}
@@ -80,7 +84,7 @@ func (b *gopBlock) AllocBlockItem() (*BlockItem, error) {
 func (b *gopBlock) usedCount() int {
 	count := 0
 	for i := 0; i < len(b.items); i++ {
-		if b.items[i].flag > item_not_used {
+		if atomic.LoadInt32(&b.items[i].flag) > item_not_used {
 			count++
 		}
 	}
@@ -94,10 +98,13 @@ func (b *gopBlock) ReleaseBlockItem(item *BlockItem) {
 		if tmpItem == nil {
 			return
 		}
-		if tmpItem.flag > item_not_used {
-			tmpItem.flag = item_not_used
+		next := tmpItem.next
+		if atomic.LoadInt32(&tmpItem.flag) > item_not_used {
+			tmpItem.next = nil
+			tmpItem.rw.Reset()
+			atomic.StoreInt32(&tmpItem.flag, item_not_used)
 		}
-		tmpItem = tmpItem.next
+		tmpItem = next
 	}
 
 }
@@ -123,8 +130,9 @@ func (item *BlockItem) Write(data []byte) (int, error) {
 				flag: item_invalid_flag,
 				Buf:  make([]byte, item.block.config.ItemSizeK*1024),
 			}
-			item.addNext(newItem)
+			newItem.rw = bytes.NewBuffer(newItem.Buf[:0])
 		}
+		item.addNext(newItem)
 		return newItem.rw.Write(data)
 	} else {
 		return item.rw.Write(data)
@@ -139,6 +147,6 @@ func (item *BlockItem) addNext(newItem *BlockItem) {
 			tmpItem.next = newItem
 			break
 		}
-		tmpItem = item.next
+		tmpItem = tmpItem.next
 	}
 }
@@ -0,0 +1,578 @@
+package exchange
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+	时移回看
+	1. source保留最近Window的数据, 从关键帧(纯音频每秒)开始切成chunk, chunk带着开始时候的metadata和sequence header
+	2. 内存超过MaxMemory之后, 配置了SpillDir就在单独的协程里面把老的chunk写到磁盘, 否则丢弃老的chunk
+	3. 时移的观看者不在source的sinks里面, DvrPlayer一个协程按照时间戳的节奏读chunk, 读到最新的就等新数据
+	   所以一直落后直播Offset, 不会加速追赶
+	4. 暂停的时候不读, 恢复之后接着读, 读的位置已经被淘汰了就从最老的chunk开始
+	5. 推流结束的时候删除磁盘上的chunk, 时移的观看者也断开
+*/
+
+// 纯音频的流没有关键帧, 按照这个时长切chunk
+const dvrAudioChunkDuration = 1000
+
+var ErrDvrChunkEvicted = errors.New("dvr chunk evicted")
+
+// DvrRequest 时移播放的参数
+type DvrRequest struct {
+	Offset   time.Duration // 从直播往前多少开始
+	Duration time.Duration // 播放多长, 0表示不限制
+}
+
+// DvrSink 可选, 观看者返回的DvrRequest不是nil并且app开启了dvr, 就从时移缓冲播放
+// OnDvrStart在OnSinkDetermined里面回调, 用来暂停和恢复
+// 流不存在或者app没有开启dvr的时候还是当作直播的观看者
+type DvrSink interface {
+	StreamHandler
+	DvrRequest() *DvrRequest
+	OnDvrStart(p *DvrPlayer)
+}
+
+type dvrChunk struct {
+	seq       uint64
+	start     uint64
+	end       uint64
+	headers   []*ExData // chunk开始的时候的metadata和sequence header
+	msgs      []*ExData // 写到磁盘之后是nil
+	size      int64
+	spillPath string
+	evicted   bool
+}
+
+type dvrBuffer struct {
+	key    string
+	config DvrConfig
+
+	lock        sync.Mutex
+	chunks      []*dvrChunk
+	nextSeq     uint64
+	memBytes    int64
+	latest      uint64
+	hasVideo    bool
+	metaData    *ExData
+	videoConfig *ExData
+	audioConfig *ExData
+	notify      chan struct{} // 有新数据的时候close, 然后换一个新的
+	closed      bool
+	spilling    bool
+}
+
+func newDvrBuffer(key string, config DvrConfig) *dvrBuffer {
+	if config.Window <= 0 {
+		return nil
+	}
+	return &dvrBuffer{
+		key:    key,
+		config: config,
+		notify: make(chan struct{}),
+	}
+}
+
+func copyExData(m *ExData) *ExData {
+	return &ExData{
+		Timestamp:       m.Timestamp,
+		CompositionTime: m.CompositionTime,
+		DataType:        m.DataType,
+		AvFormat:        m.AvFormat,
+		OriginProtocol:  m.OriginProtocol,
+		Payload:         append([]byte(nil), m.Payload...),
+	}
+}
+
+// push 在source协程里面调用, m的payload可能是内存池的，拷贝一份
+func (b *dvrBuffer) push(m *ExData) {
+	d := copyExData(m)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var cur *dvrChunk
+	if len(b.chunks) > 0 {
+		cur = b.chunks[len(b.chunks)-1]
+	}
+
+	switch d.DataType {
+	case DataTypeDataAMF0:
+		b.metaData = d
+	case DataTypeVideoConfig:
+		b.videoConfig = d
+		b.hasVideo = true
+	case DataTypeAudioConfig:
+		b.audioConfig = d
+	case DataTypeVideoKeyFrame:
+		cur = b.newChunk(d.Timestamp)
+	case DataTypeAudio:
+		if !b.hasVideo && (cur == nil || d.Timestamp >= cur.start+dvrAudioChunkDuration) {
+			cur = b.newChunk(d.Timestamp)
+		}
+	}
+	if cur == nil {
+		// 等第一个关键帧
+		return
+	}
+
+	cur.msgs = append(cur.msgs, d)
+	cur.size += int64(len(d.Payload))
+	b.memBytes += int64(len(d.Payload))
+	if d.Timestamp > cur.end {
+		cur.end = d.Timestamp
+	}
+	if d.Timestamp > b.latest {
+		b.latest = d.Timestamp
+	}
+
+	b.evict()
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+func (b *dvrBuffer) newChunk(ts uint64) *dvrChunk {
+	c := &dvrChunk{
+		seq:   b.nextSeq,
+		start: ts,
+		end:   ts,
+	}
+	for _, h := range []*ExData{b.metaData, b.videoConfig, b.audioConfig} {
+		if h != nil {
+			c.headers = append(c.headers, h)
+		}
+	}
+	b.nextSeq++
+	b.chunks = append(b.chunks, c)
+	return c
+}
+
+// evict 加锁调用, 淘汰超过Window的chunk, 内存超过MaxMemory的时候写磁盘或者淘汰
+func (b *dvrBuffer) evict() {
+	window := uint64(b.config.Window / time.Millisecond)
+	for len(b.chunks) > 1 && b.latest > b.chunks[0].end && b.latest-b.chunks[0].end > window {
+		b.removeOldest()
+	}
+
+	if b.config.MaxMemory <= 0 || b.memBytes <= b.config.MaxMemory {
+		return
+	}
+	if b.config.SpillDir == "" {
+		for len(b.chunks) > 1 && b.memBytes > b.config.MaxMemory {
+			b.removeOldest()
+		}
+		return
+	}
+	if b.spilling {
+		return
+	}
+
+	// 最新的chunk还在写, 不写磁盘
+	var spill []*dvrChunk
+	memBytes := b.memBytes
+	for _, c := range b.chunks[:len(b.chunks)-1] {
+		if memBytes <= b.config.MaxMemory {
+			break
+		}
+		if c.msgs == nil {
+			continue
+		}
+		spill = append(spill, c)
+		memBytes -= c.size
+	}
+	if len(spill) > 0 {
+		b.spilling = true
+		go b.spill(spill)
+	}
+}
+
+func (b *dvrBuffer) removeOldest() {
+	c := b.chunks[0]
+	b.chunks[0] = nil
+	b.chunks = b.chunks[1:]
+	c.evicted = true
+	if c.msgs != nil {
+		b.memBytes -= c.size
+	}
+	if c.spillPath != "" {
+		os.Remove(c.spillPath)
+	}
+}
+
+// spill 在单独的协程里面写磁盘, 写完之后再释放内存
+func (b *dvrBuffer) spill(chunks []*dvrChunk) {
+	defer func() {
+		b.lock.Lock()
+		b.spilling = false
+		b.lock.Unlock()
+	}()
+
+	if err := os.MkdirAll(b.config.SpillDir, 0755); err != nil {
+		log.Println(b.key, "dvr spill:", err)
+		return
+	}
+	h := fnv.New64a()
+	h.Write([]byte(b.key))
+	for _, c := range chunks {
+		path := filepath.Join(b.config.SpillDir, fmt.Sprintf("%x-%p-%d.dvr", h.Sum64(), b, c.seq))
+		// 写磁盘的chunk已经不会再追加了
+		if err := writeDvrChunk(path, c.msgs); err != nil {
+			log.Println(b.key, "dvr spill:", err)
+			os.Remove(path)
+			return
+		}
+
+		b.lock.Lock()
+		if c.evicted || b.closed {
+			os.Remove(path)
+		} else {
+			c.spillPath = path
+			c.msgs = nil
+			b.memBytes -= c.size
+		}
+		b.lock.Unlock()
+	}
+}
+
+// writeDvrChunk 每个消息: DataType AvFormat CompositionTime Timestamp 长度 Payload
+func writeDvrChunk(path string, msgs []*ExData) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var hdr [18]byte
+	for _, m := range msgs {
+		hdr[0] = m.DataType
+		hdr[1] = m.AvFormat
+		binary.BigEndian.PutUint32(hdr[2:6], uint32(m.CompositionTime))
+		binary.BigEndian.PutUint64(hdr[6:14], m.Timestamp)
+		binary.BigEndian.PutUint32(hdr[14:18], uint32(len(m.Payload)))
+		w.Write(hdr[:])
+		w.Write(m.Payload)
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readDvrChunk(path string) ([]*ExData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var msgs []*ExData
+	var hdr [18]byte
+	for {
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return msgs, nil
+			}
+			return nil, err
+		}
+		m := &ExData{
+			DataType:        hdr[0],
+			AvFormat:        hdr[1],
+			CompositionTime: int32(binary.BigEndian.Uint32(hdr[2:6])),
+			Timestamp:       binary.BigEndian.Uint64(hdr[6:14]),
+			Payload:         make([]byte, binary.BigEndian.Uint32(hdr[14:18])),
+		}
+		if _, err = io.ReadFull(r, m.Payload); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+// seek 返回离直播offset的chunk, 超出窗口的时候是最老的
+func (b *dvrBuffer) seek(offset time.Duration) (uint64, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.chunks) == 0 {
+		return 0, false
+	}
+
+	target := uint64(0)
+	if ms := uint64(offset / time.Millisecond); b.latest > ms {
+		target = b.latest - ms
+	}
+	seq := b.chunks[0].seq
+	for _, c := range b.chunks {
+		if c.start > target {
+			break
+		}
+		seq = c.seq
+	}
+	return seq, true
+}
+
+// oldest 读的位置被淘汰之后从这里开始
+func (b *dvrBuffer) oldest() (uint64, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.chunks) == 0 {
+		return 0, false
+	}
+	return b.chunks[0].seq, true
+}
+
+// dvrRead 读一个chunk的结果
+type dvrRead struct {
+	headers []*ExData
+	msgs    []*ExData
+	last    bool          // 是最新的chunk, 读完之后等notify
+	notify  chan struct{} // 最新的chunk有新数据
+	closed  bool
+}
+
+// read 读seq这个chunk目前所有的数据, 已经写到磁盘的从文件读
+func (b *dvrBuffer) read(seq uint64) (*dvrRead, error) {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return &dvrRead{closed: true}, nil
+	}
+	if len(b.chunks) == 0 || seq < b.chunks[0].seq {
+		b.lock.Unlock()
+		return nil, ErrDvrChunkEvicted
+	}
+	idx := int(seq - b.chunks[0].seq)
+	if idx >= len(b.chunks) {
+		b.lock.Unlock()
+		return nil, fmt.Errorf("dvr chunk %d not exists", seq)
+	}
+	c := b.chunks[idx]
+	res := &dvrRead{
+		headers: c.headers,
+		msgs:    c.msgs[:len(c.msgs):len(c.msgs)],
+		last:    idx == len(b.chunks)-1,
+		notify:  b.notify,
+	}
+	spillPath := c.spillPath
+	b.lock.Unlock()
+
+	if res.msgs == nil && spillPath != "" {
+		var err error
+		if res.msgs, err = readDvrChunk(spillPath); err != nil {
+			// 读的时候被淘汰删除了
+			return nil, ErrDvrChunkEvicted
+		}
+	}
+	return res, nil
+}
+
+func (b *dvrBuffer) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for _, c := range b.chunks {
+		if c.spillPath != "" {
+			os.Remove(c.spillPath)
+		}
+	}
+	b.chunks = nil
+	b.memBytes = 0
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// DvrPlayer 一个时移的观看者
+type DvrPlayer struct {
+	buf *dvrBuffer
+	h   StreamHandler
+	req DvrRequest
+
+	lock   sync.Mutex
+	paused bool
+	resume chan struct{} // 暂停的时候等待
+}
+
+func newDvrPlayer(buf *dvrBuffer, h StreamHandler, req DvrRequest) *DvrPlayer {
+	return &DvrPlayer{
+		buf: buf,
+		h:   h,
+		req: req,
+	}
+}
+
+func (p *DvrPlayer) Pause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.paused {
+		p.paused = true
+		p.resume = make(chan struct{})
+	}
+}
+
+func (p *DvrPlayer) Resume() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.paused {
+		p.paused = false
+		close(p.resume)
+	}
+}
+
+// waitResume 暂停的时候阻塞, 返回是否暂停过
+func (p *DvrPlayer) waitResume(ctx context.Context) (bool, error) {
+	p.lock.Lock()
+	paused, resume := p.paused, p.resume
+	p.lock.Unlock()
+	if !paused {
+		return false, nil
+	}
+	select {
+	case <-ctx.Done():
+		return true, ctx.Err()
+	case <-resume:
+		return true, nil
+	}
+}
+
+// dvrClock 按照时间戳的节奏发送
+type dvrClock struct {
+	baseTs   uint64
+	baseWall time.Time
+	started  bool
+}
+
+func (c *dvrClock) reset() {
+	c.started = false
+}
+
+func (c *dvrClock) wait(ctx context.Context, ts uint64) error {
+	if !c.started {
+		c.baseTs, c.baseWall, c.started = ts, time.Now(), true
+		return nil
+	}
+	if ts <= c.baseTs {
+		return nil
+	}
+	d := time.Until(c.baseWall.Add(time.Duration(ts-c.baseTs) * time.Millisecond))
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (p *DvrPlayer) write(m *ExData) error {
+	// 同一个ExData所有的时移观看者共用, 不能修改
+	d := *m
+	return p.h.WriteData(&d)
+}
+
+// run 播放到Duration, 推流结束或者观看者断开为止
+func (p *DvrPlayer) run(ctx context.Context) {
+	defer p.h.Cancel()
+
+	seq, ok := p.buf.seek(p.req.Offset)
+	if !ok {
+		return
+	}
+	var clock dvrClock
+	idx := 0
+	sendHeaders := true
+	var firstTs, lastTs uint64
+	played := false
+
+	for {
+		if paused, err := p.waitResume(ctx); err != nil {
+			return
+		} else if paused {
+			clock.reset()
+		}
+
+		res, err := p.buf.read(seq)
+		if err == ErrDvrChunkEvicted {
+			// 暂停太久或者读得太慢, 从最老的开始
+			if seq, ok = p.buf.oldest(); !ok {
+				return
+			}
+			log.Println(p.buf.key, "dvr position evicted, jump to", seq)
+			idx, sendHeaders = 0, true
+			clock.reset()
+			continue
+		}
+		if err != nil {
+			log.Println(p.buf.key, "dvr read:", err)
+			return
+		}
+		if res.closed {
+			return
+		}
+
+		if sendHeaders {
+			for _, m := range res.headers {
+				if err = p.write(m); err != nil {
+					return
+				}
+			}
+			sendHeaders = false
+		}
+
+		for ; idx < len(res.msgs); idx++ {
+			m := res.msgs[idx]
+			if !played {
+				firstTs, played = m.Timestamp, true
+			}
+			if m.Timestamp > lastTs {
+				lastTs = m.Timestamp
+			}
+			if p.req.Duration > 0 && lastTs-firstTs >= uint64(p.req.Duration/time.Millisecond) {
+				log.Println(p.buf.key, "dvr play duration reached")
+				return
+			}
+			if err = clock.wait(ctx, m.Timestamp); err != nil {
+				return
+			}
+			if err = p.write(m); err != nil {
+				return
+			}
+			if paused, _ := p.waitResume(ctx); paused {
+				// 暂停之后重新读一次, 位置可能已经被淘汰了
+				clock.reset()
+				idx++
+				break
+			}
+		}
+		if idx < len(res.msgs) {
+			continue
+		}
+
+		if !res.last {
+			seq++
+			idx = 0
+			continue
+		}
+		// 读到最新了, 等新数据
+		select {
+		case <-ctx.Done():
+			return
+		case <-res.notify:
+		}
+	}
+}
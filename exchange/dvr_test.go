@@ -0,0 +1,301 @@
+package exchange
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// pushDvrFrames 每10毫秒一帧, 每100毫秒一个关键帧
+func pushDvrFrames(push func(m *ExData), from, to uint64) {
+	for ts := from; ts < to; ts += 10 {
+		dataType := DataTypeVideoNonKeyFrame
+		if ts%100 == 0 {
+			dataType = DataTypeVideoKeyFrame
+		}
+		m := newTestFrame(dataType, ts, 100)
+		m.Payload[0] = byte(ts / 10)
+		push(m)
+	}
+}
+
+func TestDvrBufferWindow(t *testing.T) {
+	b := newDvrBuffer("dvr/window", DvrConfig{Window: 300 * time.Millisecond})
+	b.push(newTestFrame(DataTypeVideoConfig, 0, 10))
+	// 第一个关键帧之前的不要
+	b.push(newTestFrame(DataTypeVideoNonKeyFrame, 0, 10))
+	pushDvrFrames(b.push, 100, 1000)
+
+	// 最新的990, 结束时间超过窗口的chunk淘汰
+	if len(b.chunks) != 4 || b.chunks[0].start != 600 {
+		t.Fatalf("chunks:%d start:%d", len(b.chunks), b.chunks[0].start)
+	}
+	if len(b.chunks[0].headers) != 1 || b.chunks[0].headers[0].DataType != DataTypeVideoConfig {
+		t.Fatal("chunk without sequence header")
+	}
+	if b.memBytes != 40*100 {
+		t.Fatalf("memBytes:%d", b.memBytes)
+	}
+
+	// 超过内存限制, 没有配置SpillDir就丢弃
+	b.config.MaxMemory = 2000
+	pushDvrFrames(b.push, 1000, 1010)
+	if len(b.chunks) != 2 || b.memBytes > 2000 {
+		t.Fatalf("chunks:%d memBytes:%d", len(b.chunks), b.memBytes)
+	}
+
+	if seq, _ := b.seek(time.Hour); seq != b.chunks[0].seq {
+		t.Fatalf("seek out of window:%d", seq)
+	}
+	if seq, _ := b.seek(0); seq != b.chunks[1].seq {
+		t.Fatalf("seek live:%d", seq)
+	}
+	if _, err := b.read(0); err != ErrDvrChunkEvicted {
+		t.Fatalf("read evicted:%v", err)
+	}
+}
+
+func TestDvrBufferSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dvr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newDvrBuffer("dvr/spill", DvrConfig{Window: time.Minute, MaxMemory: 2500, SpillDir: dir})
+	pushDvrFrames(b.push, 0, 1000)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.lock.Lock()
+		memBytes, spilling := b.memBytes, b.spilling
+		if memBytes > 2500 && !spilling {
+			// 最后几帧写进来的时候上一次还没写完
+			b.evict()
+		}
+		b.lock.Unlock()
+		if memBytes <= 2500 && !spilling {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spill timeout memBytes:%d", memBytes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) == 0 {
+		t.Fatal("no chunk spilled")
+	}
+
+	// 写到磁盘的和内存里面的读出来一样
+	ts := uint64(0)
+	for seq := uint64(0); seq < 10; seq++ {
+		res, err := b.read(seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.msgs) != 10 {
+			t.Fatalf("chunk %d msgs:%d", seq, len(res.msgs))
+		}
+		for _, m := range res.msgs {
+			if m.Timestamp != ts || m.Payload[0] != byte(ts/10) || len(m.Payload) != 100 {
+				t.Fatalf("chunk %d wrong msg:%d", seq, m.Timestamp)
+			}
+			ts += 10
+		}
+	}
+
+	b.close()
+	if files, _ = ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("spill files not removed:%d", len(files))
+	}
+}
+
+func TestDvrChunkFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "dvr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	msgs := []*ExData{
+		{DataType: DataTypeVideoKeyFrame, AvFormat: AvFormatAVC, Timestamp: 1 << 33, CompositionTime: -40, Payload: []byte{1, 2, 3}},
+		{DataType: DataTypeAudio, AvFormat: AvFormatAAC, Timestamp: 10, Payload: []byte{}},
+	}
+	if err = writeDvrChunk(f.Name(), msgs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readDvrChunk(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(msgs) {
+		t.Fatalf("msgs:%d", len(got))
+	}
+	for i, m := range got {
+		if m.DataType != msgs[i].DataType || m.AvFormat != msgs[i].AvFormat || m.Timestamp != msgs[i].Timestamp ||
+			m.CompositionTime != msgs[i].CompositionTime || !bytes.Equal(m.Payload, msgs[i].Payload) {
+			t.Fatalf("msg %d:%+v", i, m)
+		}
+	}
+}
+
+type testDvrHandler struct {
+	*testStreamHandler
+	req    *DvrRequest
+	player chan *DvrPlayer
+}
+
+func (h *testDvrHandler) DvrRequest() *DvrRequest {
+	return h.req
+}
+
+func (h *testDvrHandler) OnDvrStart(p *DvrPlayer) {
+	h.player <- p
+}
+
+func newTestDvrHandler(app string, req *DvrRequest) *testDvrHandler {
+	return &testDvrHandler{
+		testStreamHandler: newTestStreamHandler(app, "s"),
+		req:               req,
+		player:            make(chan *DvrPlayer, 1),
+	}
+}
+
+// nextFrame 跳过sequence header和metadata
+func (h *testStreamHandler) nextFrame(t *testing.T, timeout time.Duration) *ExData {
+	for {
+		select {
+		case m := <-h.received:
+			if m.DataType == DataTypeVideoKeyFrame || m.DataType == DataTypeVideoNonKeyFrame {
+				return m
+			}
+		case <-time.After(timeout):
+			return nil
+		}
+	}
+}
+
+func TestDvrPlay(t *testing.T) {
+	pool := GetExchanger()
+	config := DefaultAppConfig()
+	config.Dvr.Window = time.Minute
+	SetAppConfig("dvrplay", config)
+
+	pub := newTestStreamHandler("dvrplay", "s")
+	put, err := pool.OnSourceDetermined(pub, pub.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		pub.Cancel()
+		pool.OnDestroySource(pub)
+	}()
+	put(newTestFrame(DataTypeVideoConfig, 0, 10))
+	pushDvrFrames(func(m *ExData) { put(m) }, 0, 500)
+	time.Sleep(20 * time.Millisecond)
+
+	// 从最新的490往前200毫秒的关键帧开始
+	player := newTestDvrHandler("dvrplay", &DvrRequest{Offset: 200 * time.Millisecond})
+	if err = pool.OnSinkDetermined(player, player.ctx); err != nil {
+		t.Fatal(err)
+	}
+	p := <-player.player
+	if m := player.nextFrame(t, time.Second); m == nil || m.Timestamp != 200 {
+		t.Fatalf("first frame:%v", m)
+	}
+
+	// 按照时间戳的节奏发送, 暂停之后不再发送
+	start := time.Now()
+	player.waitData(t, 250)
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("not paced:%v", d)
+	}
+	p.Pause()
+	for player.nextFrame(t, 50*time.Millisecond) != nil {
+	}
+	if m := player.nextFrame(t, 100*time.Millisecond); m != nil {
+		t.Fatalf("paused but received:%d", m.Timestamp)
+	}
+
+	// 恢复之后接着暂停的位置, 读完之后等直播的数据
+	p.Resume()
+	if m := player.nextFrame(t, time.Second); m == nil || m.Timestamp > 300 {
+		t.Fatalf("resume:%v", m)
+	}
+	player.waitData(t, 490)
+	pushDvrFrames(func(m *ExData) { put(m) }, 500, 520)
+	player.waitData(t, 510)
+
+	pool.OnDestroySink(player)
+	player.Cancel()
+}
+
+func TestDvrPlayDuration(t *testing.T) {
+	pool := GetExchanger()
+	config := DefaultAppConfig()
+	config.Dvr.Window = time.Minute
+	SetAppConfig("dvrduration", config)
+
+	pub := newTestStreamHandler("dvrduration", "s")
+	put, err := pool.OnSourceDetermined(pub, pub.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(newTestFrame(DataTypeVideoConfig, 0, 10))
+	pushDvrFrames(func(m *ExData) { put(m) }, 0, 500)
+	time.Sleep(20 * time.Millisecond)
+
+	player := newTestDvrHandler("dvrduration", &DvrRequest{Offset: time.Hour, Duration: 100 * time.Millisecond})
+	if err = pool.OnSinkDetermined(player, player.ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-player.player
+	var last uint64
+	for {
+		m := player.nextFrame(t, time.Second)
+		if m == nil {
+			break
+		}
+		last = m.Timestamp
+	}
+	// 超出窗口从最老的开始, 播放100毫秒之后断开
+	if last != 90 {
+		t.Fatalf("last:%d", last)
+	}
+	select {
+	case <-player.ctx.Done():
+	default:
+		t.Fatal("player not canceled")
+	}
+
+	// 推流结束之后时移的观看者也断开
+	player2 := newTestDvrHandler("dvrduration", &DvrRequest{})
+	if err = pool.OnSinkDetermined(player2, player2.ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-player2.player
+	pub.Cancel()
+	pool.OnDestroySource(pub)
+	select {
+	case <-player2.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("player not canceled after source quit")
+	}
+
+	// 没有开启dvr的app还是直播
+	player3 := newTestDvrHandler("dvrnone", &DvrRequest{})
+	if err = pool.OnSinkDetermined(player3, player3.ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-player3.player:
+		t.Fatal("dvr started without config")
+	default:
+	}
+	pool.OnDestroySink(player3)
+	player3.Cancel()
+}
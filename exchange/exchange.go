@@ -28,11 +28,28 @@ const (
 )
 
 type ExData struct {
-	Timestamp      uint64
-	DataType       uint8
-	AvFormat       uint8
-	OriginProtocol uint8
+	Timestamp       uint64 // dts
+	CompositionTime int32  // 毫秒, pts = Timestamp + CompositionTime, 只有avc/hevc视频帧有，B帧之前的P帧大于0
+	DataType        uint8
+	AvFormat        uint8
+	OriginProtocol  uint8
 
 	//flv tag的data部分，以这个为标准来交换，这样flv和rtmp就不用转换了
 	Payload []byte
+
+	buf *payloadBuf // 内存池分配的payload才有, 见payload.go
+}
+
+// ParseCompositionTime avc/hevc的video tag data: FrameType|CodecID, AVCPacketType, 24位有符号CompositionTime
+// Payload本身保留了CompositionTime，flv/rtmp直接透传，fmp4和ts这些需要pts的封装用这个字段
+func ParseCompositionTime(payload []byte) int32 {
+	if len(payload) < 5 || payload[1] != 1 {
+		return 0
+	}
+	cts := int32(uint32(payload[2])<<16 | uint32(payload[3])<<8 | uint32(payload[4]))
+	return (cts << 8) >> 8
+}
+
+func (m *ExData) PTS() uint64 {
+	return uint64(int64(m.Timestamp) + int64(m.CompositionTime))
 }
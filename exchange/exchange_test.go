@@ -0,0 +1,77 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCompositionTime(t *testing.T) {
+	if cts := ParseCompositionTime([]byte{0x27, 1, 0, 0, 0x78}); cts != 120 {
+		t.Fatalf("expect:120 but:%d", cts)
+	}
+	if cts := ParseCompositionTime([]byte{0x27, 1, 0xFF, 0xFF, 0xD8}); cts != -40 {
+		t.Fatalf("expect:-40 but:%d", cts)
+	}
+	// sequence header没有CompositionTime
+	if cts := ParseCompositionTime([]byte{0x17, 0, 0, 0, 0x78}); cts != 0 {
+		t.Fatalf("expect:0 but:%d", cts)
+	}
+}
+
+// 有B帧的流经过exchange之后pts不变
+func TestCompositionTimeRoundTrip(t *testing.T) {
+	pool := newConnPool(4)
+
+	pub := newTestStreamHandler("bframe", "s")
+	put, err := pool.OnSourceDetermined(pub, pub.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := newTestStreamHandler("bframe", "s")
+	if err = pool.OnSinkDetermined(player, player.ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// 解码顺序 I P B B P B B, 显示顺序 I B B P B B P
+	ctsList := []int32{40, 120, 0, 0, 120, 0, 0}
+	for i, cts := range ctsList {
+		payload := []byte{0x27, 1, byte(cts >> 16), byte(cts >> 8), byte(cts), 0, 0, 0, 0}
+		dataType := DataTypeVideoNonKeyFrame
+		if i == 0 {
+			payload[0] = 0x17
+			dataType = DataTypeVideoKeyFrame
+		}
+		m := NewPooledExData(payload)
+		m.Timestamp = uint64(1000 + i*40)
+		m.DataType = dataType
+		m.AvFormat = AvFormatAVC
+		m.CompositionTime = ParseCompositionTime(payload)
+		if err = put(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pts := make(map[uint64]bool)
+	for i, cts := range ctsList {
+		select {
+		case m := <-player.received:
+			if m.CompositionTime != cts || m.Timestamp != uint64(1000+i*40) {
+				t.Fatalf("frame %d expect:%d %d but:%d %d", i, 1000+i*40, cts, m.Timestamp, m.CompositionTime)
+			}
+			pts[m.PTS()] = true
+		case <-time.After(time.Second):
+			t.Fatalf("wait frame %d timeout", i)
+		}
+	}
+	for i := 0; i < len(ctsList); i++ {
+		if !pts[uint64(1040+i*40)] {
+			t.Fatalf("missing pts:%d", 1040+i*40)
+		}
+	}
+
+	player.Cancel()
+	pool.OnDestroySink(player)
+	pub.Cancel()
+	pool.OnDestroySource(pub)
+}
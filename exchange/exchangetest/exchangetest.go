@@ -0,0 +1,103 @@
+package exchangetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/chinasarft/golive/exchange"
+)
+
+/*
+	测试用的推流端和音视频帧, 各个包的测试共用
+	exchange包自己的测试不能引用这个包, 用expair_test.go里面的testStreamHandler
+*/
+
+var (
+	// VideoConfig avc sequence header, 带sps pps
+	VideoConfig = []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, 0x15, 0xff, 0xe1, 0x00, 0x02, 0x67, 0x42, 0x01, 0x00, 0x02, 0x68, 0xce}
+	// AudioConfig aac sequence header
+	AudioConfig = []byte{0xaf, 0, 0x12, 0x10}
+)
+
+// Frames from是0的时候先是sequence header, 然后每40毫秒一帧视频, 每秒一个关键帧
+// withAudio的时候每一帧视频后面跟一帧同样时间戳的音频
+func Frames(from, to uint64, withAudio bool) []*exchange.ExData {
+	var frames []*exchange.ExData
+	if from == 0 {
+		frames = append(frames, &exchange.ExData{DataType: exchange.DataTypeVideoConfig, AvFormat: exchange.AvFormatAVC, Payload: VideoConfig})
+		if withAudio {
+			frames = append(frames, &exchange.ExData{DataType: exchange.DataTypeAudioConfig, AvFormat: exchange.AvFormatAAC, Payload: AudioConfig})
+		}
+	}
+	for ts := from; ts < to; ts += 40 {
+		dataType, flag := exchange.DataTypeVideoNonKeyFrame, byte(0x27)
+		if ts%1000 == 0 {
+			dataType, flag = exchange.DataTypeVideoKeyFrame, 0x17
+		}
+		frames = append(frames, &exchange.ExData{Timestamp: ts, DataType: dataType, AvFormat: exchange.AvFormatAVC, Payload: []byte{flag, 1, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88}})
+		if withAudio {
+			frames = append(frames, &exchange.ExData{Timestamp: ts, DataType: exchange.DataTypeAudio, AvFormat: exchange.AvFormatAAC, Payload: []byte{0xaf, 1, 0x21, 0x10}})
+		}
+	}
+	return frames
+}
+
+// PutFrames 时间戳从0开始一直推Frames, 每一帧之间等interval, ctx结束的时候返回
+func PutFrames(ctx context.Context, put exchange.PutData, withAudio bool, interval time.Duration) {
+	for ts := uint64(0); ; ts += 40 {
+		for _, m := range Frames(ts, ts+40, withAudio) {
+			put(m)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Publisher 推流rtmp://127.0.0.1/app/s, 收到的数据丢掉
+type Publisher struct {
+	pad         exchange.Pad
+	key         exchange.StreamKey
+	publishType string
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// Publish 在pad上注册一路live推流, 失败的时候测试结束
+func Publish(t testing.TB, pad exchange.Pad, app string) (*Publisher, exchange.PutData) {
+	return PublishWithType(t, pad, app, exchange.PublishTypeLive)
+}
+
+// PublishWithType publishType是rtmp publish的类型, live record append
+func PublishWithType(t testing.TB, pad exchange.Pad, app, publishType string) (*Publisher, exchange.PutData) {
+	key, err := exchange.ParseStreamUrl("rtmp://127.0.0.1/" + app + "/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Publisher{pad: pad, key: key, publishType: publishType}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	put, err := pad.OnSourceDetermined(p, p.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, put
+}
+
+func (p *Publisher) GetStreamKey() exchange.StreamKey   { return p.key }
+func (p *Publisher) Cancel()                            { p.cancel() }
+func (p *Publisher) WriteData(m *exchange.ExData) error { return nil }
+func (p *Publisher) PublishType() string                { return p.publishType }
+
+// Context 推流结束的时候Done
+func (p *Publisher) Context() context.Context {
+	return p.ctx
+}
+
+// Unpublish 断开推流并且注销source
+func (p *Publisher) Unpublish() {
+	p.Cancel()
+	p.pad.OnDestroySource(p)
+}
@@ -3,9 +3,12 @@ package exchange
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/chinasarft/golive/utils/amf"
 )
@@ -18,20 +21,31 @@ type Pad interface {
 	OnDestroySink(h StreamHandler)
 }
 
+// StreamHandler WriteData返回之后m.Payload可能被内存池回收，需要保留的话自己拷贝
 type StreamHandler interface {
-	GetAppStreamKey() string
+	GetStreamKey() StreamKey
 	Cancel()
 	WriteData(m *ExData) error
 }
 
 const (
-	cmd_register_source = iota
-	cmd_register_sink
-	cmd_data_message
-	cmd_unregister_source
+	cmd_register_sink = iota
 	cmd_unregister_sink
+	cmd_query_sink_stats
+	cmd_transfer_sinks
 )
 
+var (
+	ErrStreamAlreadyPublished = errors.New("stream is already published")
+	ErrStreamNotFound         = errors.New("stream not found")
+)
+
+// StreamNotFoundHandler 可选, 观看者等待推流超时的时候回调，之后会Cancel
+// rtmp在这里回复NetStream.Play.StreamNotFound
+type StreamNotFoundHandler interface {
+	OnStreamNotFound()
+}
+
 type PadMessage struct {
 	cmd int
 	msg interface{}
@@ -40,355 +54,348 @@ type PadMessage struct {
 
 type Source struct {
 	StreamHandler
-	srcChan chan *PadMessage
-	result  chan error
-	sinks   map[string]*Sink
-	err     error
-
-	gopCache circularVarQueue
+	srcChan   chan *PadMessage
+	dataQueue *publishQueue // 音视频数据单独一个队列，srcChan只放控制消息
+	done      chan struct{} // work退出的时候close
+	closeLock sync.Mutex
+	closed    bool
+	sinks     map[string]*Sink
+	sinkCount int // 上次通知的观看者个数
+	err       error
+	config    *AppConfig
+
+	gopCache   circularVarQueue
+	timestamps *timestampNormalizer
+	metaData   *metaDataBuilder
+	dvr        *dvrBuffer // 没有开启时移是nil
 
 	VideoDecoderConfigurationRecord []byte // avc hevc
 	AACSequenceHeader               []byte
-	avMetaData                      []byte // 或者至少是在推流h265的时候是不支持的
+	avMetaData                      []byte // 去掉@setDataFrame之后的onMetaData
 }
 
 type Sink struct {
 	StreamHandler
-	result   chan error
 	msgChan  chan *ExData
+	gopChan  chan []*ExData // metadata, sequence header和gop缓冲, 在msgChan之前发送
 	keyInSrc string
-}
 
-type ConnPool struct {
-	pipe           chan *PadMessage
-	receivers      map[string]*Source
-	waitingSenders map[string]map[string]*PadMessage
+	waitTimer *time.Timer // 等待推流超时, 只在registry的分片锁里面访问
+	rebase    *sinkTimestampRebase
+
+	// 以下只在source的协程里面访问
+	queueConfig  SinkQueueConfig
+	dropping     bool // 超过高水位，视频要等到低于低水位之后的关键帧才恢复
+	droppedVideo uint64
+	droppedAudio uint64
 }
 
-var conns *ConnPool
+type SinkStats struct {
+	Key          string
+	Queued       int
+	Dropping     bool
+	DroppedVideo uint64
+	DroppedAudio uint64
+}
 
-func init() {
-	conns = &ConnPool{
-		pipe:           make(chan *PadMessage, 100),
-		receivers:      make(map[string]*Source),
-		waitingSenders: make(map[string]map[string]*PadMessage),
+func (src *Source) canReplace(oldSrc *Source) bool {
+	switch src.config.DuplicatePublish.Policy {
+	case DuplicatePublishReplace:
+		return true
+	case DuplicatePublishReplaceIdle:
+		idle := oldSrc.dataQueue.idleTime()
+		log.Println("old publisher idle:", idle)
+		return idle >= src.config.DuplicatePublish.IdleTimeout
 	}
-	go conns.pairPad()
+	return false
 }
 
-func GetExchanger() *ConnPool {
-	return conns
+// transferSinks 在老的source协程里面执行
+func (src *Source) transferSinks(msg *PadMessage) {
+	newSrc := msg.msg.(*Source)
+	for keyInSrc, sink := range src.sinks {
+		delete(src.sinks, keyInSrc)
+		sink.dropping = false
+		// 老的gop观看者还没有读走的话, 新的source放gop的时候会一直阻塞
+		sink.dropGop()
+		newSrc.postSink(&PadMessage{
+			cmd: cmd_register_sink,
+			msg: sink,
+		})
+	}
+	src.err = ErrStreamAlreadyPublished
+	src.Cancel()
 }
 
-func (p *ConnPool) pairPad() {
+func (s *Source) work(ctx context.Context) {
+	log.Println("source work start------->")
+	ctx, _ = context.WithCancel(ctx)
 	for {
 		var msg *PadMessage
 		select {
-		case msg = <-p.pipe:
+		case <-ctx.Done():
+			s.close()
+			if s.dvr != nil {
+				s.dvr.close()
+			}
+			s.cancelSinks()
+			for _, m := range s.dataQueue.popAll() {
+				m.Release()
+			}
+			s.gopCache.Reset()
+			log.Println("source work quit------->")
+			return
+		case <-s.dataQueue.notify:
+			for _, m := range s.dataQueue.popAll() {
+				s.handleRtmpMessage(m)
+			}
+			s.notifySinkCount()
+			continue
+		case msg = <-s.srcChan:
 		}
-		log.Println("pair")
+
 		switch msg.cmd {
-		case cmd_register_source:
-			p.handleRegisterSource(msg)
-		case cmd_unregister_source:
-			p.handleUnregisterSource(msg)
 		case cmd_register_sink:
-			p.handleRegisterSink(msg)
+			s.connectSink(msg)
 		case cmd_unregister_sink:
-			p.handleUnregisterSink(msg)
+			s.deleteSink(msg)
+		case cmd_query_sink_stats:
+			s.querySinkStats(msg)
+		case cmd_transfer_sinks:
+			s.transferSinks(msg)
 		}
+		s.notifySinkCount()
 	}
 }
 
-func (cp *ConnPool) OnSourceDetermined(h StreamHandler, ctx context.Context) (PutData, error) {
-
-	src := &Source{
-		StreamHandler: h,
-		result:        make(chan error),
-		sinks:         make(map[string]*Sink),
-		srcChan:       make(chan *PadMessage, 100),
+// post 给source发控制消息，source已经退出返回false
+func (src *Source) post(msg *PadMessage) bool {
+	src.closeLock.Lock()
+	defer src.closeLock.Unlock()
+	if src.closed {
+		return false
 	}
-	conns.pipe <- &PadMessage{
-		cmd: cmd_register_source,
-		msg: src,
-		ctx: ctx,
-	}
-
-	// 同步返回结果
-	err := <-src.result
-
-	output := func(m *ExData) error {
-		if src.err != nil {
-			return src.err
-		}
-
-		select {
-		case src.srcChan <- &PadMessage{
-			cmd: cmd_data_message,
-			msg: m,
-		}:
-			//log.Println("--------->put message")
-		default:
-			return fmt.Errorf("chan is full. drop this msg")
-		}
-		return nil
+	select {
+	case src.srcChan <- msg:
+		return true
+	case <-src.done:
+		return false
 	}
-
-	return output, err
 }
 
-func (p *ConnPool) handleRegisterSource(msg *PadMessage) {
-
-	src, ok := msg.msg.(*Source)
-	if !ok {
-		panic("handleRegisterSource wrong type")
-	}
-
-	key := src.GetAppStreamKey()
-
-	_, ok = p.receivers[key]
-	log.Println("handleRegisterSource:", key, ok)
-	if ok {
-		// TODO 存在是否抢流等？
-		src.result <- fmt.Errorf("is already exits")
-	} else {
-		p.receivers[key] = src
-		src.result <- nil
-		go src.work(msg.ctx)
-		p.notifyWaitSenders(src)
+// postSink source已经退出的时候断开观看者，客户端自己重连
+func (src *Source) postSink(msg *PadMessage) {
+	if !src.post(msg) {
+		sink := msg.msg.(*Sink)
+		log.Println(sink.GetStreamKey().String(), "source quit before sink registered")
+		sink.Cancel()
 	}
 }
 
-func (p *ConnPool) notifyWaitSenders(src *Source) {
-	key := src.GetAppStreamKey()
-	if waitingSource, srcExits := p.waitingSenders[key]; srcExits {
-		for _, regSingMsg := range waitingSource {
-			src.srcChan <- regSingMsg
-		}
-		delete(p.waitingSenders, key)
-	}
-}
+// close 先close(done)让阻塞在post里面的返回，closed之后不会再有消息放进srcChan
+func (src *Source) close() {
+	close(src.done)
+	src.closeLock.Lock()
+	src.closed = true
+	src.closeLock.Unlock()
 
-func (s *Source) work(ctx context.Context) {
-	log.Println("source work start------->")
-	ctx, _ = context.WithCancel(ctx)
 	for {
-		var msg *PadMessage
 		select {
-		case <-ctx.Done():
-			s.cancelSinks()
-			log.Println("source work quit------->")
+		case msg := <-src.srcChan:
+			if msg.cmd == cmd_register_sink {
+				sink := msg.msg.(*Sink)
+				src.sinks[sink.GetStreamKey().String()+fmt.Sprintf("%p", sink.StreamHandler)] = sink
+			}
+		default:
 			return
-		case msg = <-s.srcChan:
 		}
+	}
+}
 
-		switch msg.cmd {
-		case cmd_register_sink:
-			s.connectSink(msg)
-		case cmd_data_message:
-			rtmpMsg, ok := msg.msg.(*ExData)
-			if !ok {
-				panic("not rtmp message")
-			}
-			//log.Println("srcwork:", rtmpMsg.Timestamp)
-			s.handleRtmpMessage(rtmpMsg)
-		case cmd_unregister_sink:
-			s.deleteSink(msg)
-		}
+// setMetaData 保留最新的onMetaData, 后来的观看者最先收到
+// 转发给观看者的也换成服务端生成的
+func (src *Source) setMetaData(m *ExData) {
+	log.Println("source metadata updated:", len(m.Payload))
+	src.metaData.setPublisherMetaData(m.Payload)
+	src.avMetaData = src.metaData.build()
+	if src.avMetaData != nil {
+		m.Payload = src.avMetaData
 	}
 }
 
+// updateMetaData sequence header变化之后重新生成, 已经连上的观看者也发一份
+func (src *Source) updateMetaData() {
+	src.avMetaData = src.metaData.build()
+	if src.avMetaData == nil || src.config.MetaData.Disabled {
+		return
+	}
+	src.writeData(&ExData{
+		Timestamp: src.timestamps.current(),
+		DataType:  DataTypeDataAMF0,
+		AvFormat:  AvFormatData,
+		Payload:   src.avMetaData,
+	})
+}
+
 func (src *Source) handleRtmpMessage(m *ExData) {
 	//fmt.Printf("==========>handle msg:%d %d\n", m.Payload[1], m.DataType)
 	// DataTypeAudioConfig DataTypeVideoConfig不return原因
 	//    1. 如果没有waitsenders这个时候也没有sink
 	//    2. 如果有waitsenders 这个时候source还没有收到啊sequenceconfig，会造成waitsenders收不到equenceconfig
 	//    应该有可能会发送两次equenceconfig，还没有具体分析
+	src.timestamps.normalize(m)
 	switch m.DataType {
 	case DataTypeAudioConfig:
-		src.AACSequenceHeader = m.Payload
+		// sequence header一直持有，拷贝一份，不占用内存池
+		src.AACSequenceHeader = append([]byte(nil), m.Payload...)
+		if src.metaData.setAudioConfig(m) {
+			src.updateMetaData()
+		}
 	case DataTypeVideoConfig:
-		src.VideoDecoderConfigurationRecord = m.Payload
+		src.VideoDecoderConfigurationRecord = append([]byte(nil), m.Payload...)
+		if src.metaData.setVideoConfig(m) {
+			src.updateMetaData()
+		}
 	case DataTypeDataAMF0:
 		fallthrough
 	case DataTypeDataAMF3:
 		src.handleDataMessaage(m)
 	case DataTypeAudio, DataTypeVideo, DataTypeVideoNonKeyFrame, DataTypeVideoKeyFrame:
 		src.gopCache.PushExData(m)
+		if src.metaData.measure(m) {
+			// 帧率码率只给后来的观看者
+			src.avMetaData = src.metaData.build()
+		}
 	}
 	src.writeData(m)
+	m.Release()
 }
 
 func (src *Source) writeData(m *ExData) {
+	if src.dvr != nil {
+		src.dvr.push(m)
+	}
 	for _, sink := range src.sinks {
-		toSinkMsg := new(ExData)
-		toSinkMsg.DataType = m.DataType
-		toSinkMsg.Payload = m.Payload
-		toSinkMsg.Timestamp = m.Timestamp
-		err := sink.writeData(toSinkMsg)
+		err := sink.writeData(m.shareTo())
 		if err != nil {
 			// TODO cancel?
 			log.Println(err)
 			sink.Cancel()
 			delete(src.sinks, sink.keyInSrc)
+			sink.drain()
 		}
 	}
 }
 
+// writeData m的引用交给sink, 丢弃的时候释放
 func (sink *Sink) writeData(m *ExData) error {
+	switch m.DataType {
+	case DataTypeVideo, DataTypeVideoKeyFrame, DataTypeVideoNonKeyFrame:
+		if sink.shouldDropVideo(m) {
+			sink.droppedVideo++
+			m.Release()
+			return nil
+		}
+	case DataTypeAudio:
+		if sink.dropping && sink.queueConfig.DropAudio {
+			sink.droppedAudio++
+			m.Release()
+			return nil
+		}
+	}
+
+	// sequence header和metadata不丢，放不进去只能断开
 	select {
 	case sink.msgChan <- m:
 		return nil
 	default:
+		m.Release()
 		return fmt.Errorf("sink rtmpMsgChan full")
 	}
 }
 
-func (src *Source) handleDataMessaage(m *ExData) {
-	r := bytes.NewReader(m.Payload)
-	v, e := amf.ReadValue(r)
-	if e == nil {
-		switch v.(type) {
-		case string:
-			value := v.(string)
-			switch value {
-			case "@setDataFrame":
-				// @setDataFrame固定长度是16字节
-				m.Payload = m.Payload[16:]
-				return
+// drain sink不再使用之后释放队列里面的数据，source和sink的协程都可能调用
+func (sink *Sink) drain() {
+	for {
+		select {
+		case m := <-sink.msgChan:
+			m.Release()
+		case gop := <-sink.gopChan:
+			for _, m := range gop {
+				m.Release()
 			}
-		}
-	} else {
-		if e != io.EOF {
-			src.err = e
+		default:
+			return
 		}
 	}
 }
 
-func (p *ConnPool) handleUnregisterSource(msg *PadMessage) {
-
-	h, ok := msg.msg.(StreamHandler)
-	if !ok {
-		panic("handleUnegisterSource wrong type")
-	}
-
-	key := h.GetAppStreamKey()
-
-	_, ok = p.receivers[key]
-	log.Println("handleUnregisterSource:", key, ok)
-	if ok {
-		delete(p.receivers, key)
-	} else {
-		panic(key + " source not registerd")
-	}
-}
-
-func (cp *ConnPool) OnDestroySource(h StreamHandler) {
-
-	cp.pipe <- &PadMessage{
-		cmd: cmd_unregister_source,
-		msg: h,
-	}
-
-	return
-}
-
-func (cp *ConnPool) OnSinkDetermined(h StreamHandler, ctx context.Context) error {
-
-	sink := &Sink{
-		StreamHandler: h,
-		result:        make(chan error),
-		msgChan:       make(chan *ExData, 50),
-	}
-	cp.pipe <- &PadMessage{
-		cmd: cmd_register_sink,
-		msg: sink,
-		ctx: ctx,
+// dropGop 丢掉还没有发送的gop
+func (sink *Sink) dropGop() {
+	select {
+	case gop := <-sink.gopChan:
+		for _, m := range gop {
+			m.Release()
+		}
+	default:
 	}
-	// 同步返回结果
-	err := <-sink.result
-
-	return err
 }
 
-func (p *ConnPool) handleRegisterSink(msg *PadMessage) {
-	sink, ok := msg.msg.(*Sink)
-	if !ok {
-		panic("handleRegisterSource wrong type")
+func (sink *Sink) shouldDropVideo(m *ExData) bool {
+	queued := len(sink.msgChan)
+	if !sink.dropping {
+		if sink.queueConfig.HighWatermark > 0 && queued >= sink.queueConfig.HighWatermark {
+			log.Println(sink.keyInSrc, "start drop video frame, queued:", queued)
+			sink.dropping = true
+			return true
+		}
+		return false
 	}
-	key := sink.GetAppStreamKey()
 
-	src, ok := p.receivers[key]
-	log.Println("handleRegisterSink:", key, ok)
-	if !ok {
-		// 推流还不存在，wait
-		p.addObserver(sink, msg)
-
-		sink.result <- nil
-		//sink.result <- fmt.Errorf("%s not exits", key)
-	} else {
-		sink.result <- nil
-		src.srcChan <- msg
+	if m.DataType == DataTypeVideoKeyFrame && queued <= sink.queueConfig.LowWatermark {
+		log.Println(sink.keyInSrc, "resume video frame, queued:", queued, "dropped:", sink.droppedVideo)
+		sink.dropping = false
+		return false
 	}
-	go sink.work(msg.ctx)
+	return true
 }
 
-func (p *ConnPool) addObserver(sink *Sink, msg *PadMessage) {
-	key := sink.GetAppStreamKey()
-	sink.keyInSrc = key + fmt.Sprintf("%p", sink.StreamHandler)
-	if waitingSource, sourceExits := p.waitingSenders[key]; sourceExits {
-		if waitingSource[sink.keyInSrc] != nil {
-			panic(sink.keyInSrc + " has waited")
-		}
-		waitingSource[sink.keyInSrc] = msg
-	} else {
-		waitingSource = make(map[string]*PadMessage)
-		waitingSource[sink.keyInSrc] = msg
-		p.waitingSenders[key] = waitingSource
+func (sink *Sink) stats() SinkStats {
+	return SinkStats{
+		Key:          sink.keyInSrc,
+		Queued:       len(sink.msgChan),
+		Dropping:     sink.dropping,
+		DroppedVideo: sink.droppedVideo,
+		DroppedAudio: sink.droppedAudio,
 	}
-	return
 }
 
-func (p *ConnPool) handleUnregisterSink(msg *PadMessage) {
-	h, ok := msg.msg.(StreamHandler)
-	if !ok {
-		panic("handleRegisterSource wrong type")
-	}
-	key := h.GetAppStreamKey()
-
-	src, ok := p.receivers[key]
-	log.Println("handleUnregisterSink:", key, ok)
-	if !ok {
-		// 情况1:play时候还没有source, 检查是否在wating
-		if p.deleteObserver(h) {
-			return
+func (src *Source) handleDataMessaage(m *ExData) {
+	r := bytes.NewReader(m.Payload)
+	v, e := amf.ReadValue(r)
+	if e == nil {
+		switch v.(type) {
+		case string:
+			value := v.(string)
+			switch value {
+			case "@setDataFrame":
+				// @setDataFrame固定长度是16字节
+				m.Payload = m.Payload[16:]
+				if v, e = amf.ReadValue(r); e == nil && v == "onMetaData" {
+					src.setMetaData(m)
+				}
+				return
+			case "onMetaData":
+				// flv推流直接就是onMetaData
+				src.setMetaData(m)
+				return
+			}
 		}
-		// 情况2:unregsrc和unregsink几乎同时，先unregsrc，的却可能出现这种情况
-		log.Println(key + " source not registered(from sink)")
 	} else {
-		src.srcChan <- msg
-	}
-}
-
-func (p *ConnPool) deleteObserver(h StreamHandler) bool {
-	key := h.GetAppStreamKey()
-	if waitingSource, ok := p.waitingSenders[key]; ok {
-		keyInSrc := key + fmt.Sprintf("%p", h)
-		delete(waitingSource, keyInSrc) // 不会报错，不用检查是否存在
-		if len(waitingSource) == 0 {
-			delete(p.waitingSenders, key)
+		if e != io.EOF {
+			src.err = e
 		}
-		return true
 	}
-	return false
-}
-
-func (hs *ConnPool) OnDestroySink(h StreamHandler) {
-	conns.pipe <- &PadMessage{
-		cmd: cmd_unregister_sink,
-		msg: h,
-	}
-	return
 }
 
 func (sink *Sink) work(ctx context.Context) {
@@ -397,19 +404,46 @@ func (sink *Sink) work(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
+			sink.drain()
 			log.Println("sink work quit------->")
 			return
+		case gop := <-sink.gopChan:
+			sink.writeGop(gop)
 		case m := <-sink.msgChan:
 			//log.Println("=======>receive message")
-			sink.WriteData(m)
+			// gopChan一定比msgChan先放入，select是随机的，这里保证先发送gop
+			select {
+			case gop := <-sink.gopChan:
+				sink.writeGop(gop)
+			default:
+			}
+			sink.writeRebased(m)
+			m.Release()
 		}
 	}
 }
 
+func (sink *Sink) writeRebased(m *ExData) error {
+	if sink.rebase != nil {
+		sink.rebase.rebase(m)
+	}
+	return sink.WriteData(m)
+}
+
+func (sink *Sink) writeGop(gop []*ExData) {
+	var err error
+	for _, m := range gop {
+		if err == nil {
+			err = sink.writeRebased(m)
+		}
+		m.Release()
+	}
+}
+
 func (src *Source) connectSink(msg *PadMessage) {
 	log.Println("src connectSink")
 	sink := msg.msg.(*Sink)
-	sink.keyInSrc = sink.GetAppStreamKey() + fmt.Sprintf("%p", sink.StreamHandler)
+	sink.keyInSrc = sink.GetStreamKey().String() + fmt.Sprintf("%p", sink.StreamHandler)
 
 	if _, ok := src.sinks[sink.keyInSrc]; !ok {
 		src.sinks[sink.keyInSrc] = sink
@@ -417,50 +451,49 @@ func (src *Source) connectSink(msg *PadMessage) {
 		panic("repeater register")
 	}
 
+	var gop []*ExData
 	if src.avMetaData != nil {
-		avMetaData := &ExData{
-			DataType:  0x12,
+		gop = append(gop, &ExData{
+			DataType:  DataTypeDataAMF0,
+			AvFormat:  AvFormatData,
 			Timestamp: 0,
 			Payload:   src.avMetaData,
-		}
-		sink.msgChan <- avMetaData
+		})
 	}
 
 	if src.VideoDecoderConfigurationRecord != nil {
-		vmsg := &ExData{
-			DataType:  DataTypeVideo,
+		gop = append(gop, &ExData{
+			DataType:  DataTypeVideoConfig,
 			Timestamp: 0,
 			Payload:   src.VideoDecoderConfigurationRecord,
-		}
-		sink.msgChan <- vmsg
-		log.Println("=======>write video metadata", len(vmsg.Payload), len(src.gopCache.q))
+		})
+		log.Println("=======>write video metadata", len(src.VideoDecoderConfigurationRecord), src.gopCache.Len())
 	}
 
 	if src.AACSequenceHeader != nil {
-		amsg := &ExData{
-			DataType:  DataTypeAudio,
+		gop = append(gop, &ExData{
+			DataType:  DataTypeAudioConfig,
+			AvFormat:  AvFormatAAC,
 			Timestamp: 0,
 			Payload:   src.AACSequenceHeader,
-		}
-		sink.msgChan <- amsg
-		log.Println("=======>write audio metadata", len(amsg.Payload))
-	}
-	/*
-		if src.VideoDecoderConfigurationRecord != nil {
-			// TODO 只需要在这里发送gopcache就行了
-			// 如果是waitsenders
-			for i := 0; i < len(src.gopCache.q); i++ {
-				log.Println("send gopcache:", i)
-				sink.msgChan <- src.gopCache.q[i]
-			}
-		}
-	*/
+		})
+		log.Println("=======>write audio metadata", len(src.AACSequenceHeader))
+	}
+
+	// 没有sequence header的gop发送了也没法解码
+	if src.VideoDecoderConfigurationRecord != nil {
+		gop = append(gop, src.gopCache.Snapshot()...)
+	}
+
+	if len(gop) > 0 {
+		sink.gopChan <- gop
+	}
 }
 
 func (src *Source) deleteSink(msg *PadMessage) {
 
 	h := msg.msg.(StreamHandler)
-	keyInSrc := h.GetAppStreamKey() + fmt.Sprintf("%p", h)
+	keyInSrc := h.GetStreamKey().String() + fmt.Sprintf("%p", h)
 
 	sink, ok := src.sinks[keyInSrc]
 	log.Println("src deleteSink", keyInSrc, ok)
@@ -471,11 +504,26 @@ func (src *Source) deleteSink(msg *PadMessage) {
 	} else {
 		delete(src.sinks, keyInSrc)
 		sink.Cancel()
+		sink.drain()
+	}
+}
+
+type sinkStatsQuery struct {
+	result chan []SinkStats
+}
+
+func (src *Source) querySinkStats(msg *PadMessage) {
+	query := msg.msg.(*sinkStatsQuery)
+	stats := make([]SinkStats, 0, len(src.sinks))
+	for _, sink := range src.sinks {
+		stats = append(stats, sink.stats())
 	}
+	query.result <- stats
 }
 
 func (src *Source) cancelSinks() {
 	for _, sink := range src.sinks {
 		sink.Cancel()
+		sink.drain()
 	}
 }
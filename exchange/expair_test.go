@@ -0,0 +1,284 @@
+package exchange
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/chinasarft/golive/utils/amf"
+)
+
+func newTestSink(config SinkQueueConfig) *Sink {
+	return &Sink{
+		msgChan:     make(chan *ExData, config.QueueSize),
+		gopChan:     make(chan []*ExData, 1),
+		queueConfig: config,
+	}
+}
+
+func TestSinkDropNonKeyFrame(t *testing.T) {
+	sink := newTestSink(SinkQueueConfig{
+		QueueSize:     10,
+		HighWatermark: 6,
+		LowWatermark:  3,
+	})
+
+	for i := 0; i < 6; i++ {
+		if err := sink.writeData(newTestFrame(DataTypeVideoNonKeyFrame, uint64(i), 1)); err != nil {
+			t.Fatalf("writeData:%s", err.Error())
+		}
+	}
+
+	// 超过高水位, 视频丢弃，音频照常
+	sink.writeData(newTestFrame(DataTypeVideoNonKeyFrame, 6, 1))
+	sink.writeData(newTestFrame(DataTypeAudio, 6, 1))
+	if !sink.dropping || sink.droppedVideo != 1 || len(sink.msgChan) != 7 {
+		t.Fatalf("expect dropping:%v %d %d", sink.dropping, sink.droppedVideo, len(sink.msgChan))
+	}
+
+	// 没有低于低水位，关键帧也丢弃
+	sink.writeData(newTestFrame(DataTypeVideoKeyFrame, 7, 1))
+	if sink.droppedVideo != 2 {
+		t.Fatalf("expect:%d but:%d", 2, sink.droppedVideo)
+	}
+
+	for len(sink.msgChan) > 3 {
+		<-sink.msgChan
+	}
+
+	// 低于低水位，非关键帧还是丢弃，从关键帧开始恢复
+	sink.writeData(newTestFrame(DataTypeVideoNonKeyFrame, 8, 1))
+	sink.writeData(newTestFrame(DataTypeVideoKeyFrame, 9, 1))
+	if sink.dropping || sink.droppedVideo != 3 || len(sink.msgChan) != 4 {
+		t.Fatalf("expect resume:%v %d %d", sink.dropping, sink.droppedVideo, len(sink.msgChan))
+	}
+}
+
+func TestSinkDisconnectWhenFull(t *testing.T) {
+	sink := newTestSink(SinkQueueConfig{
+		QueueSize:     4,
+		HighWatermark: 2,
+		LowWatermark:  1,
+		DropAudio:     true,
+	})
+
+	sink.writeData(newTestFrame(DataTypeVideoKeyFrame, 0, 1))
+	sink.writeData(newTestFrame(DataTypeVideoNonKeyFrame, 1, 1))
+	sink.writeData(newTestFrame(DataTypeVideoNonKeyFrame, 2, 1))
+	sink.writeData(newTestFrame(DataTypeAudio, 2, 1))
+	if sink.droppedVideo != 1 || sink.droppedAudio != 1 {
+		t.Fatalf("expect drop:%d %d", sink.droppedVideo, sink.droppedAudio)
+	}
+
+	sink.writeData(newTestFrame(DataTypeVideoConfig, 3, 1))
+	sink.writeData(newTestFrame(DataTypeAudioConfig, 3, 1))
+	if err := sink.writeData(newTestFrame(DataTypeAudioConfig, 3, 1)); err == nil {
+		t.Fatal("expect error when queue is full")
+	}
+}
+
+type testStreamHandler struct {
+	key      StreamKey
+	ctx      context.Context
+	cancel   context.CancelFunc
+	received chan *ExData
+}
+
+func newTestStreamHandler(app, stream string) *testStreamHandler {
+	key, _ := NewStreamKey("rtmp://127.0.0.1/"+app, app, stream)
+	h := &testStreamHandler{
+		key:      key,
+		received: make(chan *ExData, 100),
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	return h
+}
+
+func (h *testStreamHandler) GetStreamKey() StreamKey {
+	return h.key
+}
+
+func (h *testStreamHandler) Cancel() {
+	h.cancel()
+}
+
+func (h *testStreamHandler) WriteData(m *ExData) error {
+	h.received <- m
+	return nil
+}
+
+func (h *testStreamHandler) waitData(t *testing.T, ts uint64) {
+	for {
+		select {
+		case m := <-h.received:
+			if m.Timestamp == ts {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("wait data timeout:%d", ts)
+		}
+	}
+}
+
+func TestDuplicatePublish(t *testing.T) {
+	pool := GetExchanger()
+
+	SetAppConfig("dupreject", DefaultAppConfig())
+	pub1 := newTestStreamHandler("dupreject", "s")
+	if _, err := pool.OnSourceDetermined(pub1, pub1.ctx); err != nil {
+		t.Fatal(err)
+	}
+	pub2 := newTestStreamHandler("dupreject", "s")
+	if _, err := pool.OnSourceDetermined(pub2, pub2.ctx); err != ErrStreamAlreadyPublished {
+		t.Fatalf("expect:%v but:%v", ErrStreamAlreadyPublished, err)
+	}
+	pool.OnDestroySource(pub2)
+	pub1.Cancel()
+	pool.OnDestroySource(pub1)
+
+	config := DefaultAppConfig()
+	config.DuplicatePublish.Policy = DuplicatePublishReplace
+	SetAppConfig("dupreplace", config)
+
+	pub1 = newTestStreamHandler("dupreplace", "s")
+	put1, err := pool.OnSourceDetermined(pub1, pub1.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := newTestStreamHandler("dupreplace", "s")
+	if err = pool.OnSinkDetermined(player, player.ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	put1(newTestFrame(DataTypeAudio, 1, 1))
+	player.waitData(t, 1)
+
+	pub2 = newTestStreamHandler("dupreplace", "s")
+	put2, err := pool.OnSourceDetermined(pub2, pub2.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-pub1.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("old publisher not cancelled")
+	}
+	pool.OnDestroySource(pub1)
+
+	// 观看者转到新的source是异步的
+	time.Sleep(10 * time.Millisecond)
+	put2(newTestFrame(DataTypeAudio, 2, 1))
+	player.waitData(t, 2)
+
+	if stats := pool.GetPublishStats(pub2.key); stats == nil {
+		t.Fatal("new publisher not registered")
+	}
+	player.Cancel()
+	pool.OnDestroySink(player)
+	pub2.Cancel()
+	pool.OnDestroySource(pub2)
+}
+
+func newTestMetaData(width float64) *ExData {
+	var buf bytes.Buffer
+	amf.WriteValue(&buf, "@setDataFrame")
+	amf.WriteValue(&buf, "onMetaData")
+	amf.WriteValue(&buf, amf.Object{"width": width})
+	m := NewPooledExData(buf.Bytes())
+	m.DataType = DataTypeDataAMF0
+	m.AvFormat = AvFormatData
+	return m
+}
+
+func (h *testStreamHandler) waitMetaData(t *testing.T) amf.Object {
+	select {
+	case m := <-h.received:
+		if m.DataType != DataTypeDataAMF0 {
+			t.Fatalf("expect metadata first but:%d", m.DataType)
+		}
+		r := bytes.NewReader(m.Payload)
+		if v, _ := amf.ReadValue(r); v != "onMetaData" {
+			t.Fatalf("expect onMetaData but:%v", v)
+		}
+		v, _ := amf.ReadValue(r)
+		return v.(amf.Object)
+	case <-time.After(time.Second):
+		t.Fatal("wait metadata timeout")
+	}
+	return nil
+}
+
+func TestLateJoinerGetsMetaData(t *testing.T) {
+	pool := newConnPool(4)
+
+	pub := newTestStreamHandler("metadata", "s")
+	put, err := pool.OnSourceDetermined(pub, pub.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(newTestMetaData(640))
+	put(newTestFrame(DataTypeAudio, 1, 1))
+	time.Sleep(10 * time.Millisecond)
+
+	player := newTestStreamHandler("metadata", "s")
+	pool.OnSinkDetermined(player, player.ctx)
+	if obj := player.waitMetaData(t); obj["width"] != float64(640) {
+		t.Fatalf("unexpected metadata:%v", obj)
+	}
+
+	// 推流更新了metadata, 之后的观看者收到新的
+	put(newTestMetaData(1280))
+	if obj := player.waitMetaData(t); obj["width"] != float64(1280) {
+		t.Fatalf("unexpected metadata:%v", obj)
+	}
+	player2 := newTestStreamHandler("metadata", "s")
+	pool.OnSinkDetermined(player2, player2.ctx)
+	if obj := player2.waitMetaData(t); obj["width"] != float64(1280) {
+		t.Fatalf("unexpected metadata:%v", obj)
+	}
+
+	player.Cancel()
+	pool.OnDestroySink(player)
+	player2.Cancel()
+	pool.OnDestroySink(player2)
+	pub.Cancel()
+	pool.OnDestroySource(pub)
+}
+
+func TestTransferSinkWithPendingGop(t *testing.T) {
+	newSource := func(h StreamHandler) *Source {
+		return &Source{
+			StreamHandler:                   h,
+			sinks:                           make(map[string]*Sink),
+			srcChan:                         make(chan *PadMessage, 1),
+			done:                            make(chan struct{}),
+			gopCache:                        newCircularVarQueue(defaultAppConfig.GopCache),
+			VideoDecoderConfigurationRecord: []byte{0x17, 0},
+		}
+	}
+	oldSrc := newSource(newTestStreamHandler("transfer", "s"))
+	newSrc := newSource(newTestStreamHandler("transfer", "s"))
+	newSrc.VideoDecoderConfigurationRecord = []byte{0x17, 0, 1}
+
+	// 观看者还没有读走老的source的gop
+	sink := newTestSink(defaultAppConfig.SinkQueue)
+	sink.StreamHandler = newTestStreamHandler("transfer", "s")
+	oldSrc.connectSink(&PadMessage{cmd: cmd_register_sink, msg: sink})
+	oldSrc.transferSinks(&PadMessage{cmd: cmd_transfer_sinks, msg: newSrc})
+
+	connected := make(chan struct{})
+	go func() {
+		newSrc.connectSink(<-newSrc.srcChan)
+		close(connected)
+	}()
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("new source blocked on sink gopChan")
+	}
+	if gop := <-sink.gopChan; len(gop) != 1 || len(gop[0].Payload) != 3 {
+		t.Fatalf("unexpected gop:%d", len(gop))
+	}
+}
@@ -0,0 +1,121 @@
+package exchange
+
+/*
+	gop缓冲, 新的观看者连接上来之后先发送这个缓冲，这样就不用等到下一个关键帧才出画面
+	1. 收到关键帧的时候清空，从关键帧开始缓冲
+	2. 超过帧数/字节数/时长的任意一个上限，整个gop丢弃，直到下一个关键帧
+	   gop缺了开头是没法解码的，所以不会只丢最老的帧
+	3. 只有source的协程访问，不需要加锁
+	4. 缓冲的帧各持有一个payload引用
+*/
+
+type circularVarQueue struct {
+	q     []*ExData // 环形缓冲，长度可变，按需扩容直到maxFrames
+	head  int
+	count int
+	bytes int
+
+	config  GopCacheConfig
+	started bool // 是否已经收到关键帧
+}
+
+func newCircularVarQueue(config GopCacheConfig) circularVarQueue {
+	return circularVarQueue{
+		config: config,
+	}
+}
+
+func (c *circularVarQueue) Len() int {
+	return c.count
+}
+
+func (c *circularVarQueue) Bytes() int {
+	return c.bytes
+}
+
+func (c *circularVarQueue) Reset() {
+	for i := 0; i < len(c.q); i++ {
+		if c.q[i] != nil {
+			c.q[i].Release()
+			c.q[i] = nil
+		}
+	}
+	c.head = 0
+	c.count = 0
+	c.bytes = 0
+	c.started = false
+}
+
+func (c *circularVarQueue) push(m *ExData) {
+	if c.count == len(c.q) {
+		newLen := len(c.q) * 2
+		if newLen == 0 {
+			newLen = 64
+		}
+		if c.config.MaxFrames > 0 && newLen > c.config.MaxFrames {
+			newLen = c.config.MaxFrames
+		}
+		newQ := make([]*ExData, newLen)
+		for i := 0; i < c.count; i++ {
+			newQ[i] = c.q[(c.head+i)%len(c.q)]
+		}
+		c.q = newQ
+		c.head = 0
+	}
+	m.Retain()
+	c.q[(c.head+c.count)%len(c.q)] = m
+	c.count++
+	c.bytes += len(m.Payload)
+}
+
+func (c *circularVarQueue) at(i int) *ExData {
+	return c.q[(c.head+i)%len(c.q)]
+}
+
+func (c *circularVarQueue) overflow(m *ExData) bool {
+	if c.config.MaxFrames > 0 && c.count+1 > c.config.MaxFrames {
+		return true
+	}
+	if c.config.MaxBytes > 0 && c.bytes+len(m.Payload) > c.config.MaxBytes {
+		return true
+	}
+	if c.config.MaxDuration > 0 && c.count > 0 && m.Timestamp > c.at(0).Timestamp &&
+		m.Timestamp-c.at(0).Timestamp > c.config.MaxDuration {
+		return true
+	}
+	return false
+}
+
+// PushExData 只缓冲音视频帧, sequence header和metadata由Source单独保存
+func (c *circularVarQueue) PushExData(m *ExData) {
+	if c.config.Disabled {
+		return
+	}
+
+	if m.DataType == DataTypeVideoKeyFrame {
+		c.Reset()
+		c.started = true
+	}
+
+	if !c.started {
+		return
+	}
+
+	if c.overflow(m) {
+		c.Reset()
+		return
+	}
+	c.push(m)
+}
+
+// Snapshot 返回当前gop的拷贝，交给sink在自己的协程里面发送, 每一帧都增加了引用
+func (c *circularVarQueue) Snapshot() []*ExData {
+	if c.count == 0 {
+		return nil
+	}
+	s := make([]*ExData, c.count)
+	for i := 0; i < c.count; i++ {
+		s[i] = c.at(i).shareTo()
+	}
+	return s
+}
@@ -0,0 +1,84 @@
+package exchange
+
+import (
+	"testing"
+)
+
+func newTestFrame(dataType uint8, ts uint64, size int) *ExData {
+	return &ExData{
+		DataType:  dataType,
+		Timestamp: ts,
+		Payload:   make([]byte, size),
+	}
+}
+
+func TestGopCacheResetOnKeyFrame(t *testing.T) {
+	c := newCircularVarQueue(defaultAppConfig.GopCache)
+
+	// 关键帧之前的帧不缓冲
+	c.PushExData(newTestFrame(DataTypeVideoNonKeyFrame, 0, 10))
+	c.PushExData(newTestFrame(DataTypeAudio, 0, 10))
+	if c.Len() != 0 {
+		t.Fatalf("expect:%d but:%d", 0, c.Len())
+	}
+
+	c.PushExData(newTestFrame(DataTypeVideoKeyFrame, 40, 10))
+	for i := 0; i < 100; i++ {
+		c.PushExData(newTestFrame(DataTypeVideoNonKeyFrame, uint64(80+i*40), 10))
+	}
+	if c.Len() != 101 {
+		t.Fatalf("expect:%d but:%d", 101, c.Len())
+	}
+
+	c.PushExData(newTestFrame(DataTypeVideoKeyFrame, 5000, 10))
+	c.PushExData(newTestFrame(DataTypeAudio, 5010, 10))
+	if c.Len() != 2 {
+		t.Fatalf("expect:%d but:%d", 2, c.Len())
+	}
+
+	gop := c.Snapshot()
+	if gop[0].DataType != DataTypeVideoKeyFrame || gop[0].Timestamp != 5000 {
+		t.Fatalf("gop not start with keyframe:%d %d", gop[0].DataType, gop[0].Timestamp)
+	}
+}
+
+func TestGopCacheLimit(t *testing.T) {
+	c := newCircularVarQueue(GopCacheConfig{MaxFrames: 10})
+	c.PushExData(newTestFrame(DataTypeVideoKeyFrame, 0, 10))
+	for i := 0; i < 9; i++ {
+		c.PushExData(newTestFrame(DataTypeVideoNonKeyFrame, uint64(i*40), 10))
+	}
+	if c.Len() != 10 {
+		t.Fatalf("expect:%d but:%d", 10, c.Len())
+	}
+	// 超过上限丢弃整个gop, 直到下一个关键帧
+	c.PushExData(newTestFrame(DataTypeVideoNonKeyFrame, 400, 10))
+	c.PushExData(newTestFrame(DataTypeVideoNonKeyFrame, 440, 10))
+	if c.Len() != 0 {
+		t.Fatalf("expect:%d but:%d", 0, c.Len())
+	}
+
+	c = newCircularVarQueue(GopCacheConfig{MaxBytes: 100})
+	c.PushExData(newTestFrame(DataTypeVideoKeyFrame, 0, 60))
+	c.PushExData(newTestFrame(DataTypeVideoNonKeyFrame, 40, 60))
+	if c.Len() != 0 {
+		t.Fatalf("expect:%d but:%d", 0, c.Len())
+	}
+
+	c = newCircularVarQueue(GopCacheConfig{MaxDuration: 1000})
+	c.PushExData(newTestFrame(DataTypeVideoKeyFrame, 0, 10))
+	c.PushExData(newTestFrame(DataTypeVideoNonKeyFrame, 1000, 10))
+	if c.Len() != 2 {
+		t.Fatalf("expect:%d but:%d", 2, c.Len())
+	}
+	c.PushExData(newTestFrame(DataTypeVideoNonKeyFrame, 1040, 10))
+	if c.Len() != 0 {
+		t.Fatalf("expect:%d but:%d", 0, c.Len())
+	}
+
+	c = newCircularVarQueue(GopCacheConfig{Disabled: true})
+	c.PushExData(newTestFrame(DataTypeVideoKeyFrame, 0, 10))
+	if c.Len() != 0 {
+		t.Fatalf("expect:%d but:%d", 0, c.Len())
+	}
+}
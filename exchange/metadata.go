@@ -0,0 +1,146 @@
+package exchange
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/chinasarft/golive/utils/amf"
+)
+
+/*
+	服务端生成onMetaData
+	很多编码器的onMetaData不全或者不对，librtmp根本不发@setDataFrame
+	1. 推流的onMetaData作为基础
+	2. 宽高profile来自AVC/HEVCDecoderConfigurationRecord, 采样率声道数来自AudioSpecificConfig
+	3. 帧率码率按照时间戳统计
+	4. 最后是配置里面的字段
+	后面的覆盖前面的
+*/
+
+const metaDataMeasureWindow = 5000 // 毫秒
+
+type metaDataBuilder struct {
+	config    MetaDataConfig
+	publisher amf.Object // 推流的onMetaData
+	codec     amf.Object // 从sequence header解析的
+	measured  amf.Object // 统计的帧率码率
+	raw       []byte     // 关闭的时候原样转发推流的onMetaData
+
+	windowStart uint64
+	started     bool
+	videoFrames int
+	videoBytes  int
+	audioBytes  int
+}
+
+func newMetaDataBuilder(config MetaDataConfig) *metaDataBuilder {
+	return &metaDataBuilder{
+		config:   config,
+		codec:    make(amf.Object),
+		measured: make(amf.Object),
+	}
+}
+
+// setPublisherMetaData payload是去掉@setDataFrame之后的onMetaData
+func (b *metaDataBuilder) setPublisherMetaData(payload []byte) {
+	b.raw = append([]byte(nil), payload...)
+
+	r := bytes.NewReader(payload)
+	if v, err := amf.ReadValue(r); err != nil || v != "onMetaData" {
+		return
+	}
+	if v, err := amf.ReadValue(r); err == nil {
+		if obj, ok := v.(amf.Object); ok {
+			b.publisher = obj
+		}
+	}
+}
+
+func (b *metaDataBuilder) setVideoConfig(m *ExData) bool {
+	info, err := parseVideoCodecInfo(m.Payload, m.AvFormat)
+	if err != nil {
+		log.Println("parse video sequence header:", err)
+		return false
+	}
+	b.codec["videocodecid"] = float64(info.CodecID)
+	b.codec["width"] = float64(info.Width)
+	b.codec["height"] = float64(info.Height)
+	if info.CodecID == 7 {
+		b.codec["avcprofile"] = float64(info.Profile)
+		b.codec["avclevel"] = float64(info.Level)
+	} else {
+		b.codec["hevcprofile"] = float64(info.Profile)
+		b.codec["hevclevel"] = float64(info.Level)
+	}
+	return true
+}
+
+func (b *metaDataBuilder) setAudioConfig(m *ExData) bool {
+	info, err := parseAudioCodecInfo(m.Payload)
+	if err != nil {
+		log.Println("parse audio sequence header:", err)
+		return false
+	}
+	b.codec["audiocodecid"] = float64(10)
+	b.codec["audiosamplerate"] = float64(info.SampleRate)
+	b.codec["audiochannels"] = float64(info.Channels)
+	b.codec["stereo"] = info.Channels >= 2
+	return true
+}
+
+// measure 返回true表示统计出了新的帧率码率, 超过窗口的这一帧算到下一个窗口
+func (b *metaDataBuilder) measure(m *ExData) bool {
+	if !b.started {
+		b.started = true
+		b.windowStart = m.Timestamp
+	}
+
+	updated := false
+	if m.Timestamp >= b.windowStart+metaDataMeasureWindow {
+		duration := float64(m.Timestamp - b.windowStart)
+		if b.videoFrames > 0 {
+			b.measured["framerate"] = float64(int(float64(b.videoFrames)*1000/duration*100)) / 100
+			b.measured["videodatarate"] = float64(int(float64(b.videoBytes) * 8 / duration)) // kbps
+		}
+		if b.audioBytes > 0 {
+			b.measured["audiodatarate"] = float64(int(float64(b.audioBytes) * 8 / duration))
+		}
+		b.windowStart = m.Timestamp
+		b.videoFrames, b.videoBytes, b.audioBytes = 0, 0, 0
+		updated = true
+	}
+
+	switch m.DataType {
+	case DataTypeAudio:
+		b.audioBytes += len(m.Payload)
+	default:
+		b.videoFrames++
+		b.videoBytes += len(m.Payload)
+	}
+	return updated
+}
+
+// build 生成onMetaData的payload, 每次都是新的slice, 已经发给sink的不会被修改
+func (b *metaDataBuilder) build() []byte {
+	if b.config.Disabled {
+		return b.raw
+	}
+
+	obj := make(amf.Object)
+	for _, fields := range []amf.Object{b.publisher, b.codec, b.measured, amf.Object(b.config.Fields)} {
+		for k, v := range fields {
+			obj[k] = v
+		}
+	}
+	if len(obj) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	amf.WriteValue(&buf, "onMetaData")
+	if _, err := amf.WriteValue(&buf, obj); err != nil {
+		log.Println("write metadata:", err)
+		return b.raw
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,152 @@
+package exchange
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	ExData的payload从gopBlock分配，引用计数
+	1. 推流端NewPooledExData分配，引用计数为1，PutData之后这个引用就交给了exchange
+	2. gop缓冲和每个sink的发送队列各持有一个引用
+	3. sink.WriteData返回之后释放，所以StreamHandler.WriteData不能在返回之后继续持有payload
+	4. 引用计数为0的时候归还给gopBlock
+	按照不同的item大小启动多个gopBlock, 分配的时候选最小的能放下的，都没有了就从堆上分配
+*/
+
+type payloadBuf struct {
+	refs int32
+	item *BlockItem
+}
+
+type PayloadPoolClassStats struct {
+	ItemSize  int
+	ItemCount int
+	Used      int
+}
+
+type PayloadPoolStats struct {
+	Classes      []PayloadPoolClassStats
+	PooledAllocs uint64
+	HeapAllocs   uint64 // 没有合适的item或者item用完了，从堆上分配
+}
+
+type payloadPool struct {
+	blocks       []*gopBlock // 按照item大小从小到大
+	pooledAllocs uint64
+	heapAllocs   uint64
+}
+
+var defaultPayloadPoolConfig = []Config{
+	{ItemCount: 2048, ItemSizeK: 1},
+	{ItemCount: 1024, ItemSizeK: 4},
+	{ItemCount: 512, ItemSizeK: 16},
+	{ItemCount: 128, ItemSizeK: 64},
+	{ItemCount: 32, ItemSizeK: 256},
+}
+
+var (
+	payloadPoolOnce   sync.Once
+	payloadPoolConfig = defaultPayloadPoolConfig
+	gPayloadPool      *payloadPool
+)
+
+// SetPayloadPoolConfig 在第一次分配之前调用才有效，configs为空表示不使用内存池
+func SetPayloadPoolConfig(configs []Config) {
+	payloadPoolConfig = configs
+}
+
+func getPayloadPool() *payloadPool {
+	payloadPoolOnce.Do(func() {
+		gPayloadPool = newPayloadPool(payloadPoolConfig)
+	})
+	return gPayloadPool
+}
+
+func newPayloadPool(configs []Config) *payloadPool {
+	p := &payloadPool{}
+	for _, c := range configs {
+		if c.ItemCount <= 0 || c.ItemSizeK <= 0 {
+			continue
+		}
+		p.blocks = append(p.blocks, newGopBlock(c))
+	}
+	sort.Slice(p.blocks, func(i, j int) bool {
+		return p.blocks[i].config.ItemSizeK < p.blocks[j].config.ItemSizeK
+	})
+	return p
+}
+
+func (p *payloadPool) alloc(size int) (*payloadBuf, []byte) {
+	for _, b := range p.blocks {
+		if b.config.ItemSizeK*1024 < size {
+			continue
+		}
+		item, err := b.AllocBlockItem()
+		if err != nil {
+			continue
+		}
+		atomic.AddUint64(&p.pooledAllocs, 1)
+		return &payloadBuf{refs: 1, item: item}, item.Buf[:size]
+	}
+	atomic.AddUint64(&p.heapAllocs, 1)
+	return nil, make([]byte, size)
+}
+
+func (p *payloadPool) stats() PayloadPoolStats {
+	stats := PayloadPoolStats{
+		PooledAllocs: atomic.LoadUint64(&p.pooledAllocs),
+		HeapAllocs:   atomic.LoadUint64(&p.heapAllocs),
+	}
+	for _, b := range p.blocks {
+		stats.Classes = append(stats.Classes, PayloadPoolClassStats{
+			ItemSize:  b.config.ItemSizeK * 1024,
+			ItemCount: b.config.ItemCount,
+			Used:      b.usedCount(),
+		})
+	}
+	return stats
+}
+
+func GetPayloadPoolStats() PayloadPoolStats {
+	return getPayloadPool().stats()
+}
+
+// NewPooledExData 从内存池分配payload并拷贝data, 其它字段由调用者填写
+func NewPooledExData(data []byte) *ExData {
+	buf, payload := getPayloadPool().alloc(len(data))
+	copy(payload, data)
+	return &ExData{
+		Payload: payload,
+		buf:     buf,
+	}
+}
+
+// Retain 增加一个引用，堆上分配的payload什么也不做
+func (m *ExData) Retain() {
+	if m.buf != nil {
+		atomic.AddInt32(&m.buf.refs, 1)
+	}
+}
+
+// Release 释放一个引用，最后一个引用释放的时候归还内存池
+func (m *ExData) Release() {
+	if m.buf == nil {
+		return
+	}
+	refs := atomic.AddInt32(&m.buf.refs, -1)
+	if refs == 0 {
+		item := m.buf.item
+		item.block.ReleaseBlockItem(item)
+	} else if refs < 0 {
+		panic("ExData released too many times")
+	}
+}
+
+// shareTo 给sink的ExData, 共享payload
+func (m *ExData) shareTo() *ExData {
+	d := *m
+	d.Retain()
+	return &d
+}
@@ -0,0 +1,72 @@
+package exchange
+
+import (
+	"testing"
+)
+
+func TestPayloadPoolRefCount(t *testing.T) {
+	pool := newPayloadPool([]Config{
+		{ItemCount: 2, ItemSizeK: 4},
+		{ItemCount: 2, ItemSizeK: 1},
+	})
+
+	buf, payload := pool.alloc(100)
+	if buf == nil || len(payload) != 100 || buf.item.block.config.ItemSizeK != 1 {
+		t.Fatal("expect alloc from smallest block")
+	}
+	m := &ExData{Payload: payload, buf: buf}
+
+	// gop缓冲和两个sink
+	sink1 := m.shareTo()
+	sink2 := m.shareTo()
+	m.Retain()
+	if pool.stats().Classes[0].Used != 1 {
+		t.Fatalf("expect used:%d but:%d", 1, pool.stats().Classes[0].Used)
+	}
+
+	m.Release()
+	sink1.Release()
+	sink2.Release()
+	if pool.stats().Classes[0].Used != 1 {
+		t.Fatal("payload released before last reference")
+	}
+	m.Release()
+	if pool.stats().Classes[0].Used != 0 {
+		t.Fatalf("expect used:%d but:%d", 0, pool.stats().Classes[0].Used)
+	}
+}
+
+func TestPayloadPoolFallback(t *testing.T) {
+	pool := newPayloadPool([]Config{
+		{ItemCount: 1, ItemSizeK: 1},
+		{ItemCount: 1, ItemSizeK: 4},
+	})
+
+	buf1, _ := pool.alloc(1024)
+	// 1K的用完了，用4K的
+	buf2, _ := pool.alloc(10)
+	if buf2 == nil || buf2.item.block.config.ItemSizeK != 4 {
+		t.Fatal("expect alloc from larger block")
+	}
+	// 都用完了，从堆上分配
+	buf3, payload := pool.alloc(10)
+	if buf3 != nil || len(payload) != 10 {
+		t.Fatal("expect heap alloc")
+	}
+	// 太大了，从堆上分配
+	buf4, payload := pool.alloc(8 * 1024)
+	if buf4 != nil || len(payload) != 8*1024 {
+		t.Fatal("expect heap alloc")
+	}
+
+	stats := pool.stats()
+	if stats.PooledAllocs != 2 || stats.HeapAllocs != 2 {
+		t.Fatalf("unexpected stats:%+v", stats)
+	}
+
+	(&ExData{buf: buf1}).Release()
+	(&ExData{buf: buf2}).Release()
+	if buf, _ := pool.alloc(10); buf == nil {
+		t.Fatal("expect alloc after release")
+	}
+}
@@ -0,0 +1,264 @@
+package exchange
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+	推流数据队列, 推流协程放入, source协程取出
+	原来用的是chan，满了直接丢弃且推流端也没有处理错误，关键帧和sequence header都可能悄悄丢失
+	chan没法丢弃中间的元素，所以这里用一个加锁的slice + 通知chan
+
+	满了之后的处理策略:
+	1. PublishPolicyDropOldest 丢弃最老的非关键帧，被丢弃帧之后直到下一个关键帧的视频帧也要丢弃，否则没法解码
+	2. PublishPolicyBlock 阻塞等待，超时之后断开推流
+	3. PublishPolicyDisconnect 直接断开推流
+	sequence header和metadata在任何策略下都不丢弃
+	put拿走m的引用，丢弃或者出错的时候释放
+*/
+
+// 默认的DropOldest是0, 没有用DefaultAppConfig()构造的配置也不会阻塞推流
+const (
+	PublishPolicyDropOldest = iota
+	PublishPolicyBlock
+	PublishPolicyDisconnect
+)
+
+var ErrPublishQueueFull = errors.New("publish queue is full")
+var ErrPublishQueueTimeout = errors.New("publish queue block timeout")
+
+type PublishStats struct {
+	Queued       int
+	DroppedVideo uint64
+	DroppedAudio uint64
+}
+
+type publishQueue struct {
+	lock   sync.Mutex
+	q      []*ExData
+	notify chan struct{} // 有新数据
+	space  chan struct{} // 有空闲位置, 只有block策略使用
+
+	config        PublishQueueConfig
+	waitKeyFrame  bool // 丢弃过非关键帧，直到下一个关键帧之前的视频帧都丢弃
+	droppedVideo  uint64
+	droppedAudio  uint64
+	hardLimitSize int
+	lastPut       time.Time // 判断推流是否空闲, 见DuplicatePublishReplaceIdle
+}
+
+func newPublishQueue(config PublishQueueConfig) *publishQueue {
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultAppConfig.PublishQueue.QueueSize
+	}
+	return &publishQueue{
+		q:             make([]*ExData, 0, config.QueueSize),
+		notify:        make(chan struct{}, 1),
+		space:         make(chan struct{}, 1),
+		config:        config,
+		hardLimitSize: config.QueueSize * 2,
+		lastPut:       time.Now(),
+	}
+}
+
+func isNeverDrop(m *ExData) bool {
+	switch m.DataType {
+	case DataTypeAudioConfig, DataTypeVideoConfig, DataTypeData, DataTypeDataAMF0, DataTypeDataAMF3:
+		return true
+	}
+	return false
+}
+
+func isNonKeyVideo(m *ExData) bool {
+	return m.DataType == DataTypeVideoNonKeyFrame || m.DataType == DataTypeVideo
+}
+
+func (q *publishQueue) signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (q *publishQueue) put(m *ExData, done <-chan struct{}) error {
+	q.lock.Lock()
+	q.lastPut = time.Now()
+
+	if m.DataType == DataTypeVideoKeyFrame {
+		q.waitKeyFrame = false
+	} else if q.waitKeyFrame && isNonKeyVideo(m) {
+		q.droppedVideo++
+		q.lock.Unlock()
+		m.Release()
+		return nil
+	}
+
+	if len(q.q) < q.config.QueueSize {
+		q.q = append(q.q, m)
+		q.lock.Unlock()
+		q.signal(q.notify)
+		return nil
+	}
+
+	var err error
+	switch q.config.Policy {
+	case PublishPolicyDropOldest:
+		err = q.dropOldestLocked(m)
+		q.lock.Unlock()
+		q.signal(q.notify)
+	case PublishPolicyBlock:
+		q.lock.Unlock()
+		err = q.putBlock(m, done)
+	default:
+		q.lock.Unlock()
+		err = ErrPublishQueueFull
+	}
+	if err != nil {
+		m.Release()
+	}
+	return err
+}
+
+func (q *publishQueue) putBlock(m *ExData, done <-chan struct{}) error {
+	timeout := q.config.BlockTimeout
+	if timeout <= 0 {
+		timeout = defaultAppConfig.PublishQueue.BlockTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-q.space:
+		case <-timer.C:
+			return ErrPublishQueueTimeout
+		case <-done:
+			return ErrPublishQueueFull
+		}
+
+		q.lock.Lock()
+		if len(q.q) < q.config.QueueSize {
+			q.q = append(q.q, m)
+			q.lock.Unlock()
+			q.signal(q.notify)
+			return nil
+		}
+		q.lock.Unlock()
+	}
+}
+
+// 调用者持有锁, 队列是满的
+func (q *publishQueue) dropOldestLocked(m *ExData) error {
+	if !q.dropOldestVideoLocked() && !q.dropOldestAudioLocked() {
+		// 队列里面全是关键帧或者不能丢弃的数据
+		if !isNeverDrop(m) && m.DataType != DataTypeVideoKeyFrame {
+			q.countDropped(m)
+			m.Release()
+			return nil
+		}
+		if len(q.q) >= q.hardLimitSize {
+			return ErrPublishQueueFull
+		}
+	}
+	if q.waitKeyFrame && isNonKeyVideo(m) {
+		q.droppedVideo++
+		m.Release()
+		return nil
+	}
+	q.q = append(q.q, m)
+	return nil
+}
+
+// 丢弃最老的非关键视频帧, 以及它之后直到下一个关键帧的非关键视频帧
+func (q *publishQueue) dropOldestVideoLocked() bool {
+	start := -1
+	for i, m := range q.q {
+		if isNonKeyVideo(m) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return false
+	}
+
+	kept := q.q[:start]
+	i := start
+	for ; i < len(q.q); i++ {
+		m := q.q[i]
+		if m.DataType == DataTypeVideoKeyFrame {
+			break
+		}
+		if isNonKeyVideo(m) {
+			q.droppedVideo++
+			m.Release()
+			continue
+		}
+		kept = append(kept, m)
+	}
+	if i == len(q.q) {
+		q.waitKeyFrame = true
+	}
+	kept = append(kept, q.q[i:]...)
+	for j := len(kept); j < len(q.q); j++ {
+		q.q[j] = nil
+	}
+	q.q = kept
+	return true
+}
+
+func (q *publishQueue) dropOldestAudioLocked() bool {
+	for i, m := range q.q {
+		if m.DataType == DataTypeAudio {
+			m.Release()
+			copy(q.q[i:], q.q[i+1:])
+			q.q[len(q.q)-1] = nil
+			q.q = q.q[:len(q.q)-1]
+			q.droppedAudio++
+			return true
+		}
+	}
+	return false
+}
+
+func (q *publishQueue) countDropped(m *ExData) {
+	if m.DataType == DataTypeAudio {
+		q.droppedAudio++
+	} else {
+		q.droppedVideo++
+		q.waitKeyFrame = true
+	}
+}
+
+// popAll 取出队列里面所有数据, 只有source协程调用, 引用交给调用者
+func (q *publishQueue) popAll() []*ExData {
+	q.lock.Lock()
+	if len(q.q) == 0 {
+		q.lock.Unlock()
+		return nil
+	}
+	out := q.q
+	q.q = make([]*ExData, 0, q.config.QueueSize)
+	q.lock.Unlock()
+
+	q.signal(q.space)
+	return out
+}
+
+func (q *publishQueue) stats() PublishStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return PublishStats{
+		Queued:       len(q.q),
+		DroppedVideo: q.droppedVideo,
+		DroppedAudio: q.droppedAudio,
+	}
+}
+
+func (q *publishQueue) idleTime() time.Duration {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return time.Since(q.lastPut)
+}
@@ -0,0 +1,114 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishQueueDropOldest(t *testing.T) {
+	q := newPublishQueue(PublishQueueConfig{
+		QueueSize: 6,
+		Policy:    PublishPolicyDropOldest,
+	})
+
+	q.put(newTestFrame(DataTypeVideoConfig, 0, 1), nil)
+	q.put(newTestFrame(DataTypeVideoKeyFrame, 0, 1), nil)
+	q.put(newTestFrame(DataTypeVideoNonKeyFrame, 40, 1), nil)
+	q.put(newTestFrame(DataTypeAudio, 40, 1), nil)
+	q.put(newTestFrame(DataTypeVideoNonKeyFrame, 80, 1), nil)
+	q.put(newTestFrame(DataTypeVideoKeyFrame, 120, 1), nil)
+
+	// 满了，丢弃40 80两个非关键帧(直到下一个关键帧)
+	if err := q.put(newTestFrame(DataTypeVideoNonKeyFrame, 160, 1), nil); err != nil {
+		t.Fatalf("put:%s", err.Error())
+	}
+	stats := q.stats()
+	if stats.Queued != 5 || stats.DroppedVideo != 2 {
+		t.Fatalf("unexpected stats:%+v", stats)
+	}
+
+	// 再满了，队列里面最老的非关键帧是160之后没有关键帧，新的非关键帧也要丢弃
+	q.put(newTestFrame(DataTypeAudio, 160, 1), nil)
+	q.put(newTestFrame(DataTypeVideoNonKeyFrame, 200, 1), nil)
+	stats = q.stats()
+	if stats.Queued != 5 || stats.DroppedVideo != 4 {
+		t.Fatalf("unexpected stats:%+v", stats)
+	}
+
+	// sequence header不丢弃
+	q.put(newTestFrame(DataTypeAudioConfig, 200, 1), nil)
+	q.put(newTestFrame(DataTypeAudioConfig, 200, 1), nil)
+	out := q.popAll()
+	configCount := 0
+	for _, m := range out {
+		if m.DataType == DataTypeVideoNonKeyFrame {
+			t.Fatalf("non-key frame should be dropped:%d", m.Timestamp)
+		}
+		if m.DataType == DataTypeAudioConfig || m.DataType == DataTypeVideoConfig {
+			configCount++
+		}
+	}
+	if configCount != 3 {
+		t.Fatalf("expect:%d but:%d", 3, configCount)
+	}
+}
+
+func TestPublishQueueDisconnectAndBlock(t *testing.T) {
+	q := newPublishQueue(PublishQueueConfig{
+		QueueSize: 1,
+		Policy:    PublishPolicyDisconnect,
+	})
+	q.put(newTestFrame(DataTypeVideoKeyFrame, 0, 1), nil)
+	if err := q.put(newTestFrame(DataTypeVideoNonKeyFrame, 40, 1), nil); err != ErrPublishQueueFull {
+		t.Fatalf("expect:%v but:%v", ErrPublishQueueFull, err)
+	}
+
+	q = newPublishQueue(PublishQueueConfig{
+		QueueSize:    1,
+		Policy:       PublishPolicyBlock,
+		BlockTimeout: 50 * time.Millisecond,
+	})
+	q.put(newTestFrame(DataTypeVideoKeyFrame, 0, 1), nil)
+	if err := q.put(newTestFrame(DataTypeVideoNonKeyFrame, 40, 1), nil); err != ErrPublishQueueTimeout {
+		t.Fatalf("expect:%v but:%v", ErrPublishQueueTimeout, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.popAll()
+	}()
+	if err := q.put(newTestFrame(DataTypeVideoNonKeyFrame, 80, 1), nil); err != nil {
+		t.Fatalf("put:%s", err.Error())
+	}
+}
+
+func TestQueueConfigZeroValue(t *testing.T) {
+	// 没有用DefaultAppConfig()构造的配置, 推流满了丢帧而不是阻塞
+	q := newPublishQueue(PublishQueueConfig{QueueSize: 2})
+	q.put(newTestFrame(DataTypeVideoKeyFrame, 0, 1), nil)
+	q.put(newTestFrame(DataTypeVideoNonKeyFrame, 40, 1), nil)
+	done := make(chan error, 1)
+	go func() {
+		done <- q.put(newTestFrame(DataTypeVideoNonKeyFrame, 80, 1), nil)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("zero policy should not block")
+	}
+	if stats := q.stats(); stats.DroppedVideo == 0 {
+		t.Fatalf("expect drop:%+v", stats)
+	}
+
+	// 观看者队列的水位按照默认配置的比例
+	c := SinkQueueConfig{QueueSize: 10}.withDefaults()
+	if c.HighWatermark != 6 || c.LowWatermark != 3 {
+		t.Fatalf("unexpected watermarks:%+v", c)
+	}
+	if c = (SinkQueueConfig{}).withDefaults(); c != defaultAppConfig.SinkQueue {
+		t.Fatalf("expect default:%+v", c)
+	}
+}
@@ -0,0 +1,54 @@
+package exchange
+
+import (
+	"sync"
+)
+
+/*
+	录制, 见app/record
+	本地推流注册成功之后调用Recorder, Recorder作为普通的sink注册，推流结束的时候被Cancel
+	是否录制由Recorder决定: app配置的Enabled, 或者单独对某一路流打开/关闭
+	rtmp publish命令的类型是record/append的时候, 录制到RecordConfig.PublishPath这一个文件
+*/
+
+// rtmp publish命令里面的Publishing Type
+const (
+	PublishTypeLive   = "live"
+	PublishTypeRecord = "record" // 录制到新文件，已经存在的覆盖
+	PublishTypeAppend = "append" // 追加到已经存在的文件
+)
+
+// PublishTypeSource 可选, 没有实现的推流都是live
+type PublishTypeSource interface {
+	PublishType() string
+}
+
+// Recorder 抢流的时候同一个key会调用多次，需要自己去重
+type Recorder interface {
+	Record(key StreamKey, publishType string, config RecordConfig)
+}
+
+var (
+	recorderLock sync.RWMutex
+	recorder     Recorder
+)
+
+func SetRecorder(r Recorder) {
+	recorderLock.Lock()
+	defer recorderLock.Unlock()
+	recorder = r
+}
+
+func startRecord(h StreamHandler, config RecordConfig) {
+	recorderLock.RLock()
+	r := recorder
+	recorderLock.RUnlock()
+	if r == nil {
+		return
+	}
+	publishType := PublishTypeLive
+	if p, ok := h.(PublishTypeSource); ok {
+		publishType = p.PublishType()
+	}
+	r.Record(h.GetStreamKey(), publishType, config)
+}
@@ -0,0 +1,367 @@
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+	流的注册表
+	原来所有流的注册注销都经过一个pairPad协程，OnSourceDetermined/OnSinkDetermined还要同步等待它
+	网络抖动之后几千个观看者同时重连，不相关的流也要互相排队
+	现在按照stream key分片:
+	1. 查找source用sync.Map，不加锁
+	2. 注册注销加分片的锁，只和同一个分片的流竞争
+	3. 发给source的消息直接放到source的srcChan, source退出之后不再阻塞
+*/
+
+const defaultShardCount = 64
+
+type registryShard struct {
+	lock           sync.Mutex // 注册注销的时候加锁，查找不加锁
+	receivers      sync.Map   // key -> *Source
+	waitingSenders map[string]map[string]*PadMessage
+}
+
+type ConnPool struct {
+	shards []*registryShard
+}
+
+var conns *ConnPool
+
+func init() {
+	conns = newConnPool(defaultShardCount)
+}
+
+func newConnPool(shardCount int) *ConnPool {
+	cp := &ConnPool{
+		shards: make([]*registryShard, shardCount),
+	}
+	for i := 0; i < shardCount; i++ {
+		cp.shards[i] = &registryShard{
+			waitingSenders: make(map[string]map[string]*PadMessage),
+		}
+	}
+	return cp
+}
+
+func GetExchanger() *ConnPool {
+	return conns
+}
+
+func (cp *ConnPool) getShard(key string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return cp.shards[h.Sum32()%uint32(len(cp.shards))]
+}
+
+func (cp *ConnPool) getSource(key string) *Source {
+	if v, ok := cp.getShard(key).receivers.Load(key); ok {
+		return v.(*Source)
+	}
+	return nil
+}
+
+func (cp *ConnPool) OnSourceDetermined(h StreamHandler, ctx context.Context) (PutData, error) {
+
+	config := getAppConfig(h.GetStreamKey())
+	src := &Source{
+		StreamHandler: h,
+		sinks:         make(map[string]*Sink),
+		srcChan:       make(chan *PadMessage, 100),
+		done:          make(chan struct{}),
+		dataQueue:     newPublishQueue(config.PublishQueue),
+		gopCache:      newCircularVarQueue(config.GopCache),
+		timestamps:    newTimestampNormalizer(config.Timestamp),
+		metaData:      newMetaDataBuilder(config.MetaData),
+		dvr:           newDvrBuffer(h.GetStreamKey().String(), config.Dvr),
+		config:        config,
+	}
+
+	if err := cp.registerSource(src, ctx); err != nil {
+		return nil, err
+	}
+	startForward(h, config.Forward)
+	startRecord(h, config.Record)
+
+	output := func(m *ExData) error {
+		if src.err != nil {
+			m.Release()
+			return src.err
+		}
+
+		// 返回错误的时候推流端应该断开
+		return src.dataQueue.put(m, ctx.Done())
+	}
+
+	return output, nil
+}
+
+func (cp *ConnPool) registerSource(src *Source, ctx context.Context) error {
+	key := src.GetStreamKey().String()
+	shard := cp.getShard(key)
+
+	shard.lock.Lock()
+	v, ok := shard.receivers.Load(key)
+	log.Println("registerSource:", key, ok)
+	var oldSrc *Source
+	if ok {
+		oldSrc = v.(*Source)
+		if !src.canReplace(oldSrc) {
+			shard.lock.Unlock()
+			return ErrStreamAlreadyPublished
+		}
+	}
+	shard.receivers.Store(key, src)
+	waiting := shard.waitingSenders[key]
+	delete(shard.waitingSenders, key)
+	for _, regSinkMsg := range waiting {
+		if sink := regSinkMsg.msg.(*Sink); sink.waitTimer != nil {
+			sink.waitTimer.Stop()
+		}
+	}
+	shard.lock.Unlock()
+
+	go src.work(ctx)
+	if oldSrc != nil {
+		// 抢流, 老的source把观看者转过来之后断开老的推流
+		log.Println("registerSource replace:", key)
+		oldSrc.post(&PadMessage{
+			cmd: cmd_transfer_sinks,
+			msg: src,
+		})
+	}
+	for _, regSinkMsg := range waiting {
+		src.postSink(regSinkMsg)
+	}
+	return nil
+}
+
+func (cp *ConnPool) OnDestroySource(h StreamHandler) {
+
+	key := h.GetStreamKey().String()
+	shard := cp.getShard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	v, ok := shard.receivers.Load(key)
+	log.Println("unregisterSource:", key, ok)
+	if !ok {
+		// 注册失败(比如重复推流)的推流断开的时候也会走到这里
+		log.Println(key + " source not registerd")
+	} else if v.(*Source).StreamHandler != h {
+		// 被抢流的老推流断开，key已经是新的推流了
+		log.Println(key + " source has been replaced")
+	} else {
+		shard.receivers.Delete(key)
+	}
+}
+
+func (cp *ConnPool) OnSinkDetermined(h StreamHandler, ctx context.Context) error {
+
+	config := getAppConfig(h.GetStreamKey())
+	if cp.startDvr(h, ctx) {
+		return nil
+	}
+	queueConfig := config.SinkQueue.withDefaults()
+	sink := &Sink{
+		StreamHandler: h,
+		msgChan:       make(chan *ExData, queueConfig.QueueSize),
+		gopChan:       make(chan []*ExData, 1),
+		queueConfig:   queueConfig,
+	}
+	if config.Timestamp.SinkRebase {
+		sink.rebase = &sinkTimestampRebase{}
+	}
+	msg := &PadMessage{
+		cmd: cmd_register_sink,
+		msg: sink,
+		ctx: ctx,
+	}
+
+	if err := cp.registerSink(sink, msg, config.PlayWait, config.Relay); err != nil {
+		return err
+	}
+	go sink.work(ctx)
+
+	return nil
+}
+
+// startDvr 时移的观看者不进source的sinks, 由DvrPlayer从source的时移缓冲读
+func (cp *ConnPool) startDvr(h StreamHandler, ctx context.Context) bool {
+	ds, ok := h.(DvrSink)
+	if !ok {
+		return false
+	}
+	req := ds.DvrRequest()
+	if req == nil {
+		return false
+	}
+	src := cp.getSource(h.GetStreamKey().String())
+	if src == nil || src.dvr == nil {
+		log.Println(h.GetStreamKey().String(), "dvr not available, play live")
+		return false
+	}
+
+	log.Println(h.GetStreamKey().String(), "dvr play offset:", req.Offset, "duration:", req.Duration)
+	p := newDvrPlayer(src.dvr, h, *req)
+	ds.OnDvrStart(p)
+	go p.run(ctx)
+	return true
+}
+
+func (cp *ConnPool) registerSink(sink *Sink, msg *PadMessage, config PlayWaitConfig, relayConfig RelayConfig) error {
+	key := sink.GetStreamKey().String()
+	shard := cp.getShard(key)
+
+	shard.lock.Lock()
+	v, ok := shard.receivers.Load(key)
+	log.Println("registerSink:", key, ok)
+	if !ok {
+		if config.RejectNotPublished {
+			shard.lock.Unlock()
+			return ErrStreamNotFound
+		}
+		// 推流还不存在，wait, 边缘节点同时去源站拉流
+		shard.addObserver(sink, msg)
+		if config.Timeout > 0 {
+			sink.waitTimer = time.AfterFunc(config.Timeout, func() {
+				shard.onWaitTimeout(msg)
+			})
+		}
+		shard.lock.Unlock()
+		startPull(sink.GetStreamKey(), relayConfig)
+		return nil
+	}
+	shard.lock.Unlock()
+
+	v.(*Source).postSink(msg)
+	return nil
+}
+
+// onWaitTimeout 定时器和推流注册同时发生的时候，以是否还在waitingSenders里面为准
+func (shard *registryShard) onWaitTimeout(msg *PadMessage) {
+	sink := msg.msg.(*Sink)
+	key := sink.GetStreamKey().String()
+
+	shard.lock.Lock()
+	waitingSource := shard.waitingSenders[key]
+	if waitingSource == nil || waitingSource[sink.keyInSrc] != msg {
+		shard.lock.Unlock()
+		return
+	}
+	shard.deleteObserver(sink.StreamHandler)
+	shard.lock.Unlock()
+
+	log.Println(key, "wait for source timeout")
+	if h, ok := sink.StreamHandler.(StreamNotFoundHandler); ok {
+		h.OnStreamNotFound()
+	}
+	sink.Cancel()
+}
+
+func (shard *registryShard) addObserver(sink *Sink, msg *PadMessage) {
+	key := sink.GetStreamKey().String()
+	sink.keyInSrc = key + fmt.Sprintf("%p", sink.StreamHandler)
+	if waitingSource, sourceExits := shard.waitingSenders[key]; sourceExits {
+		if waitingSource[sink.keyInSrc] != nil {
+			panic(sink.keyInSrc + " has waited")
+		}
+		waitingSource[sink.keyInSrc] = msg
+	} else {
+		waitingSource = make(map[string]*PadMessage)
+		waitingSource[sink.keyInSrc] = msg
+		shard.waitingSenders[key] = waitingSource
+	}
+	return
+}
+
+func (shard *registryShard) deleteObserver(h StreamHandler) bool {
+	key := h.GetStreamKey().String()
+	if waitingSource, ok := shard.waitingSenders[key]; ok {
+		keyInSrc := key + fmt.Sprintf("%p", h)
+		if msg, ok := waitingSource[keyInSrc]; ok {
+			if sink := msg.msg.(*Sink); sink.waitTimer != nil {
+				sink.waitTimer.Stop()
+			}
+		}
+		delete(waitingSource, keyInSrc) // 不会报错，不用检查是否存在
+		if len(waitingSource) == 0 {
+			delete(shard.waitingSenders, key)
+		}
+		return true
+	}
+	return false
+}
+
+func (cp *ConnPool) OnDestroySink(h StreamHandler) {
+	key := h.GetStreamKey().String()
+	shard := cp.getShard(key)
+
+	shard.lock.Lock()
+	v, ok := shard.receivers.Load(key)
+	log.Println("unregisterSink:", key, ok)
+	if !ok {
+		// 情况1:play时候还没有source, 检查是否在wating
+		found := shard.deleteObserver(h)
+		shard.lock.Unlock()
+		if !found {
+			// 情况2:unregsrc和unregsink几乎同时，先unregsrc，的却可能出现这种情况
+			log.Println(key + " source not registered(from sink)")
+		}
+		return
+	}
+	shard.lock.Unlock()
+
+	v.(*Source).post(&PadMessage{
+		cmd: cmd_unregister_sink,
+		msg: h,
+	})
+}
+
+// GetWaitingCount 等待推流的观看者个数
+func (cp *ConnPool) GetWaitingCount(key StreamKey) int {
+	k := key.String()
+	shard := cp.getShard(k)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	return len(shard.waitingSenders[k])
+}
+
+// GetSinkStats 查询某一路流所有观看者的队列和丢帧情况, 流不存在返回nil
+func (cp *ConnPool) GetSinkStats(key StreamKey) []SinkStats {
+	src := cp.getSource(key.String())
+	if src == nil {
+		return nil
+	}
+
+	query := &sinkStatsQuery{
+		result: make(chan []SinkStats, 1),
+	}
+	if !src.post(&PadMessage{
+		cmd: cmd_query_sink_stats,
+		msg: query,
+	}) {
+		return nil
+	}
+	select {
+	case stats := <-query.result:
+		return stats
+	case <-src.done:
+		return nil
+	}
+}
+
+// GetPublishStats 查询推流队列和丢帧情况, 流不存在返回nil
+func (cp *ConnPool) GetPublishStats(key StreamKey) *PublishStats {
+	src := cp.getSource(key.String())
+	if src == nil {
+		return nil
+	}
+	stats := src.dataQueue.stats()
+	return &stats
+}
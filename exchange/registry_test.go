@@ -0,0 +1,239 @@
+package exchange
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// registryBench 注册表的几种实现, 用同样的负载比较
+type registryBench interface {
+	lookup(key string) *Source
+	waitAndLeave(sink *Sink, msg *PadMessage)
+}
+
+// pairPadRegistry 原来的设计: 所有流的查找注册注销都发给一个pairPad协程, 调用的地方同步等它处理完
+type pairPadRegistry struct {
+	shard *registryShard
+	pipe  chan func()
+	done  chan struct{}
+}
+
+func newPairPadRegistry() *pairPadRegistry {
+	r := &pairPadRegistry{
+		shard: &registryShard{waitingSenders: make(map[string]map[string]*PadMessage)},
+		pipe:  make(chan func(), 100),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		for f := range r.pipe {
+			f()
+		}
+		close(r.done)
+	}()
+	return r
+}
+
+func (r *pairPadRegistry) call(f func()) {
+	result := make(chan struct{})
+	r.pipe <- func() {
+		f()
+		close(result)
+	}
+	<-result
+}
+
+func (r *pairPadRegistry) lookup(key string) (src *Source) {
+	r.call(func() {
+		if v, ok := r.shard.receivers.Load(key); ok {
+			src = v.(*Source)
+		}
+	})
+	return
+}
+
+func (r *pairPadRegistry) waitAndLeave(sink *Sink, msg *PadMessage) {
+	r.call(func() { r.shard.addObserver(sink, msg) })
+	r.call(func() { r.shard.deleteObserver(sink.StreamHandler) })
+}
+
+func (r *pairPadRegistry) close() {
+	close(r.pipe)
+	<-r.done
+}
+
+// connPoolRegistry 分片的注册表, 1个分片就是只有一把锁的版本
+type connPoolRegistry struct {
+	*ConnPool
+}
+
+func (r connPoolRegistry) lookup(key string) *Source {
+	return r.getSource(key)
+}
+
+func (r connPoolRegistry) waitAndLeave(sink *Sink, msg *PadMessage) {
+	r.registerSink(sink, msg, PlayWaitConfig{}, RelayConfig{})
+	r.OnDestroySink(sink.StreamHandler)
+}
+
+// benchmarkRegistry 模拟网络抖动之后大量观看者同时重连:
+// 每次操作查找一路在推的流, 再有一个观看者等待还没有推的流然后断开
+// 不同的流之间不应该互相排队
+func benchmarkRegistry(b *testing.B, newRegistry func(sources map[string]*Source) registryBench) {
+	// 整个benchmark期间都不输出日志, 所有协程结束之后才恢复
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	sources := make(map[string]*Source)
+	var keys []string
+	for i := 0; i < 256; i++ {
+		key := newTestStreamHandler("bench", fmt.Sprintf("s%d", i)).key.String()
+		sources[key] = &Source{}
+		keys = append(keys, key)
+	}
+	r := newRegistry(sources)
+
+	var seq uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := atomic.AddUint32(&seq, 1)
+		player := newTestStreamHandler("bench", fmt.Sprintf("waiting%d", n))
+		sink := &Sink{StreamHandler: player}
+		msg := &PadMessage{cmd: cmd_register_sink, msg: sink, ctx: player.ctx}
+		i := n
+		for pb.Next() {
+			i++
+			if r.lookup(keys[i%uint32(len(keys))]) == nil {
+				b.Fatal("source not found")
+			}
+			r.waitAndLeave(sink, msg)
+		}
+	})
+	b.StopTimer()
+
+	if pr, ok := r.(*pairPadRegistry); ok {
+		pr.close()
+	}
+}
+
+func BenchmarkRegistryPairPad(b *testing.B) {
+	benchmarkRegistry(b, func(sources map[string]*Source) registryBench {
+		r := newPairPadRegistry()
+		for key, src := range sources {
+			r.shard.receivers.Store(key, src)
+		}
+		return r
+	})
+}
+
+func benchmarkConnPool(b *testing.B, shardCount int) {
+	benchmarkRegistry(b, func(sources map[string]*Source) registryBench {
+		cp := newConnPool(shardCount)
+		for key, src := range sources {
+			cp.getShard(key).receivers.Store(key, src)
+		}
+		return connPoolRegistry{cp}
+	})
+}
+
+func BenchmarkRegistrySingleLock(b *testing.B) {
+	benchmarkConnPool(b, 1)
+}
+
+func BenchmarkRegistrySharded(b *testing.B) {
+	benchmarkConnPool(b, defaultShardCount)
+}
+
+func TestRegistrySinkWaitForSource(t *testing.T) {
+	pool := newConnPool(4)
+
+	player := newTestStreamHandler("wait", "s")
+	if err := pool.OnSinkDetermined(player, player.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.GetWaitingCount(player.key); n != 1 {
+		t.Fatalf("expect 1 waiting but:%d", n)
+	}
+
+	pub := newTestStreamHandler("wait", "s")
+	put, err := pool.OnSourceDetermined(pub, pub.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// srcChan和数据队列是两个chan, 观看者连上之前的数据收不到, 一直推到收到为止
+	deadline := time.After(time.Second)
+	for ts := uint64(1); ; ts++ {
+		put(newTestFrame(DataTypeAudio, ts, 1))
+		select {
+		case <-player.received:
+		case <-time.After(5 * time.Millisecond):
+			continue
+		case <-deadline:
+			t.Fatal("sink not connected to source")
+		}
+		break
+	}
+
+	// 推流断开之后观看者也要断开
+	pub.Cancel()
+	pool.OnDestroySource(pub)
+	<-player.ctx.Done()
+	pool.OnDestroySink(player)
+
+	if pool.GetPublishStats(pub.key) != nil {
+		t.Fatal("source not unregistered")
+	}
+}
+
+type notFoundStreamHandler struct {
+	*testStreamHandler
+	notFound chan struct{}
+}
+
+func (h *notFoundStreamHandler) OnStreamNotFound() {
+	close(h.notFound)
+}
+
+func TestRegistrySinkWaitTimeout(t *testing.T) {
+	pool := newConnPool(4)
+
+	config := DefaultAppConfig()
+	config.PlayWait.Timeout = 20 * time.Millisecond
+	SetAppConfig("waittimeout", config)
+
+	player := &notFoundStreamHandler{
+		testStreamHandler: newTestStreamHandler("waittimeout", "s"),
+		notFound:          make(chan struct{}),
+	}
+	if err := pool.OnSinkDetermined(player, player.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.GetWaitingCount(player.key); n != 1 {
+		t.Fatalf("expect 1 waiting but:%d", n)
+	}
+
+	select {
+	case <-player.notFound:
+	case <-time.After(time.Second):
+		t.Fatal("wait timeout not fired")
+	}
+	<-player.ctx.Done()
+	if n := pool.GetWaitingCount(player.key); n != 0 {
+		t.Fatalf("expect 0 waiting but:%d", n)
+	}
+	pool.OnDestroySink(player)
+
+	config.PlayWait.RejectNotPublished = true
+	SetAppConfig("waittimeout", config)
+	player2 := newTestStreamHandler("waittimeout", "s")
+	if err := pool.OnSinkDetermined(player2, player2.ctx); err != ErrStreamNotFound {
+		t.Fatalf("expect:%v but:%v", ErrStreamNotFound, err)
+	}
+	if n := pool.GetWaitingCount(player2.key); n != 0 {
+		t.Fatalf("expect 0 waiting but:%d", n)
+	}
+}
@@ -0,0 +1,90 @@
+package exchange
+
+import (
+	"sync"
+)
+
+/*
+	边缘节点回源和转推, 见readme relay和forward模块
+	回源: 观看者请求的流在本机不存在，并且app配置了Origins, 就调用Puller去源站拉流
+	      Puller拉到流之后作为普通的source注册，观看者个数变成0之后由Puller自己决定什么时候断开
+	转推: 本地推流注册成功之后，app配置了Forward.Urls, 就调用Forwarder
+	      Forwarder作为普通的sink注册，推流结束的时候被Cancel
+	exchange不依赖rtmp, 具体的实现在app/relay
+*/
+
+// Puller 同一个key在拉流成功之前可能调用多次，需要自己去重
+type Puller interface {
+	Pull(key StreamKey, config RelayConfig)
+}
+
+// Forwarder 抢流的时候同一个key会调用多次，需要自己去重
+type Forwarder interface {
+	Forward(key StreamKey, config ForwardConfig)
+}
+
+// RelaySource 可选, 回源拉的流不转推
+type RelaySource interface {
+	IsRelay() bool
+}
+
+// SinkCountHandler 可选, source的观看者个数变化的时候在source协程里面回调
+type SinkCountHandler interface {
+	OnSinkCountChanged(count int)
+}
+
+var (
+	pullerLock sync.RWMutex
+	puller     Puller
+	forwarder  Forwarder
+)
+
+func SetPuller(p Puller) {
+	pullerLock.Lock()
+	defer pullerLock.Unlock()
+	puller = p
+}
+
+func startPull(key StreamKey, config RelayConfig) {
+	if len(config.Origins) == 0 {
+		return
+	}
+	pullerLock.RLock()
+	p := puller
+	pullerLock.RUnlock()
+	if p != nil {
+		p.Pull(key, config)
+	}
+}
+
+func SetForwarder(f Forwarder) {
+	pullerLock.Lock()
+	defer pullerLock.Unlock()
+	forwarder = f
+}
+
+func startForward(h StreamHandler, config ForwardConfig) {
+	if len(config.Urls) == 0 {
+		return
+	}
+	if r, ok := h.(RelaySource); ok && r.IsRelay() {
+		return
+	}
+	pullerLock.RLock()
+	f := forwarder
+	pullerLock.RUnlock()
+	if f != nil {
+		f.Forward(h.GetStreamKey(), config)
+	}
+}
+
+// notifySinkCount 在source协程里面调用
+func (src *Source) notifySinkCount() {
+	if len(src.sinks) == src.sinkCount {
+		return
+	}
+	src.sinkCount = len(src.sinks)
+	if h, ok := src.StreamHandler.(SinkCountHandler); ok {
+		h.OnSinkCountChanged(src.sinkCount)
+	}
+}
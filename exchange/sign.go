@@ -0,0 +1,91 @@
+package exchange
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	内置的带时间限制的签名url, 不需要外部鉴权服务
+	rtmp://host/app/stream?expires=1700000000&sign=xxx
+	sign = hex(hmac-sha256(secret, app + "/" + stream + "/" + expires)), expires是unix秒
+	http-flv和hls的地址http://host/app/stream.flv, 流名不带扩展名
+	推流和播放可以用不同的secret, 播放的url就不能拿来推流
+*/
+
+// SignConfig 每个app的签名secret, 为空表示不检查
+type SignConfig struct {
+	PublishSecret string
+	PlaySecret    string
+}
+
+func SignStream(secret, app, stream string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(app + "/" + stream + "/" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// httpStreamExts http播放地址的扩展名, 和http-flv hls的服务端一样去掉之后才是流名
+var httpStreamExts = []string{".flv", ".m3u8"}
+
+// SignStreamUrl 给rtmp://host/app/stream或者http://host/app/stream.flv加上expires和sign参数, 原来的参数保留
+func SignStreamUrl(rawurl, secret string, expires int64) (string, error) {
+	key, err := ParseStreamUrl(rawurl)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "https", "ws", "wss":
+		for _, ext := range httpStreamExts {
+			key.Stream = strings.TrimSuffix(key.Stream, ext)
+		}
+	}
+	query := u.Query()
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sign", SignStream(secret, key.App, key.Stream, expires))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func checkSign(req *AuthRequest) *AuthError {
+	config := getAppConfig(req.Key).Sign
+	secret := config.PlaySecret
+	if req.Action == AuthActionPublish {
+		secret = config.PublishSecret
+	}
+	if secret == "" {
+		return nil
+	}
+
+	deny := func(reason string) *AuthError {
+		return &AuthError{
+			AuthResult: AuthResult{Code: AuthDenyRejected, Reason: reason},
+			Action:     req.Action,
+		}
+	}
+	expires, err := strconv.ParseInt(req.Key.Arg("expires"), 10, 64)
+	if err != nil {
+		return deny("missing expires")
+	}
+	if time.Now().Unix() > expires {
+		return deny("url expired")
+	}
+	sign, err := hex.DecodeString(req.Key.Arg("sign"))
+	if err != nil {
+		return deny("wrong sign")
+	}
+	expect, _ := hex.DecodeString(SignStream(secret, req.Key.App, req.Key.Stream, expires))
+	if !hmac.Equal(sign, expect) {
+		return deny("wrong sign")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package exchange
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignStreamUrl(t *testing.T) {
+	config := DefaultAppConfig()
+	config.Sign = SignConfig{PublishSecret: "pub", PlaySecret: "play"}
+	SetAppConfig("signed", config)
+
+	expires := time.Now().Add(time.Minute).Unix()
+	authorize := func(action, rawurl string) error {
+		key, err := ParseStreamUrl(rawurl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Authorize(&AuthRequest{Action: action, TcUrl: rawurl, Key: key})
+	}
+
+	publishUrl, err := SignStreamUrl("rtmp://a.com/signed/s?x=1", "pub", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = authorize(AuthActionPublish, publishUrl); err != nil {
+		t.Fatal(publishUrl, err)
+	}
+	// 播放的secret不一样
+	if err = authorize(AuthActionPlay, publishUrl); err == nil {
+		t.Fatal("publish url should not play")
+	}
+	playUrl, _ := SignStreamUrl("rtmp://a.com/signed/s", "play", expires)
+	if err = authorize(AuthActionPlay, playUrl); err != nil {
+		t.Fatal(playUrl, err)
+	}
+
+	otherStream, _ := SignStreamUrl("rtmp://a.com/signed/s2", "pub", expires)
+	key, _ := ParseStreamUrl(otherStream)
+	if err = authorize(AuthActionPublish, "rtmp://a.com/signed/s?expires="+key.Arg("expires")+"&sign="+key.Arg("sign")); err == nil {
+		t.Fatal("sign of other stream should fail")
+	}
+
+	expired := time.Now().Add(-time.Second).Unix()
+	if err = authorize(AuthActionPublish, "rtmp://a.com/signed/s?expires="+strconv.FormatInt(expired, 10)+
+		"&sign="+SignStream("pub", "signed", "s", expired)); err == nil {
+		t.Fatal("expired url should fail")
+	}
+	if err = authorize(AuthActionPublish, "rtmp://a.com/signed/s"); err == nil {
+		t.Fatal("no sign should fail")
+	}
+	// 没有配置secret的app不检查
+	if err = authorize(AuthActionPublish, "rtmp://a.com/live/s"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignVhostArg(t *testing.T) {
+	AddVhost("tenant.com")
+	config := DefaultAppConfig()
+	config.Sign = SignConfig{PublishSecret: "pub"}
+	SetAppConfig("tenant.com/signvhost", config)
+
+	// ?vhost=指定没有配置的vhost不能绕过tenant.com的签名
+	for _, rawurl := range []string{
+		"rtmp://tenant.com/signvhost/s",
+		"rtmp://tenant.com/signvhost/s?vhost=nosuch.com",
+	} {
+		key, err := ParseStreamUrl(rawurl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Authorize(&AuthRequest{Action: AuthActionPublish, TcUrl: rawurl, Key: key}); err == nil {
+			t.Fatalf("%s should need sign", rawurl)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package exchange
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultVhost tcUrl没有域名(ip, localhost)或者域名不是配置的vhost的时候使用的vhost
+const DefaultVhost = "__defaultVhost__"
+
+var (
+	vhostLock sync.RWMutex
+	vhosts    = make(map[string]bool)
+)
+
+// AddVhost 配置一个vhost, 只有配置了的域名才作为vhost
+// 否则rtmp://1.2.3.4/live/s和rtmp://example.com/live/s会是两路流
+func AddVhost(vhost string) {
+	vhostLock.Lock()
+	defer vhostLock.Unlock()
+	vhosts[strings.ToLower(vhost)] = true
+}
+
+func isVhost(host string) bool {
+	vhostLock.RLock()
+	defer vhostLock.RUnlock()
+	return vhosts[host]
+}
+
+// StreamKey 一路流的标识
+// 原来用app + "-" + name拼接，live/a-b和live-a/b会冲突，?token=也成了流名的一部分
+// tcUrl里面的host作为vhost, 这样一个服务可以跑多个租户
+// Args是流名(以及app)后面的查询参数，不参与流的标识
+type StreamKey struct {
+	Vhost  string
+	App    string
+	Stream string
+	Args   url.Values
+}
+
+// NewStreamKey rtmp用, tcUrl来自connect命令，app来自connect命令，stream来自publish/play命令
+func NewStreamKey(tcUrl, app, stream string) (StreamKey, error) {
+	key := StreamKey{
+		Vhost: DefaultVhost,
+		Args:  make(url.Values),
+	}
+
+	if tcUrl != "" {
+		u, err := url.Parse(tcUrl)
+		if err != nil {
+			return key, fmt.Errorf("wrong tcUrl:%s", tcUrl)
+		}
+		key.Vhost = vhostFromHost(u.Host)
+		mergeArgs(key.Args, u.Query())
+	}
+
+	var err error
+	if key.App, err = splitArgs(app, key.Args); err != nil {
+		return key, err
+	}
+	if key.Stream, err = splitArgs(stream, key.Args); err != nil {
+		return key, err
+	}
+	key.App = strings.Trim(key.App, "/")
+
+	if key.App == "" || key.Stream == "" {
+		return key, fmt.Errorf("empty app or stream:%s/%s", app, stream)
+	}
+
+	// 和srs一样，可以通过参数指定vhost, 也只能是配置了的vhost
+	// 否则客户端可以用别的租户的配置, 或者用不存在的vhost绕过签名
+	if vhost := strings.ToLower(key.Args.Get("vhost")); vhost != "" && isVhost(vhost) {
+		key.Vhost = vhost
+	}
+
+	return key, nil
+}
+
+// ParseStreamUrl 解析rtmp://host/app/stream?args这种完整的url, 最后一段是stream
+func ParseStreamUrl(rawurl string) (StreamKey, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return StreamKey{}, fmt.Errorf("wrong url:%s", rawurl)
+	}
+
+	path := strings.Trim(u.Path, "/")
+	idx := strings.LastIndex(path, "/")
+	if idx <= 0 {
+		return StreamKey{}, fmt.Errorf("wrong url:%s", rawurl)
+	}
+
+	tcUrl := u.Scheme + "://" + u.Host + "/" + path[:idx]
+	if u.RawQuery != "" {
+		tcUrl += "?" + u.RawQuery
+	}
+	return NewStreamKey(tcUrl, path[:idx], path[idx+1:])
+}
+
+func vhostFromHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if !isVhost(host) {
+		return DefaultVhost
+	}
+	return host
+}
+
+func splitArgs(s string, args url.Values) (string, error) {
+	idx := strings.Index(s, "?")
+	if idx < 0 {
+		return s, nil
+	}
+	query, err := url.ParseQuery(s[idx+1:])
+	if err != nil {
+		return "", fmt.Errorf("wrong query:%s", s)
+	}
+	mergeArgs(args, query)
+	return s[:idx], nil
+}
+
+func mergeArgs(dst, src url.Values) {
+	for k, v := range src {
+		dst[k] = append(dst[k], v...)
+	}
+}
+
+// String 作为map的key使用, 每一段都转义过，不会因为名字里面的分隔符冲突
+func (k StreamKey) String() string {
+	return url.PathEscape(k.Vhost) + "/" + url.PathEscape(k.App) + "/" + url.PathEscape(k.Stream)
+}
+
+func (k StreamKey) Arg(name string) string {
+	if k.Args == nil {
+		return ""
+	}
+	return k.Args.Get(name)
+}
+
+// CheckPathName vhost app stream都是客户端给的, 作为文件路径的一部分之前检查
+// 不能是空, .和.., 不能有路径分隔符和\0, 否则可以写到录制目录外面
+func CheckPathName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("wrong path name:%q", name)
+	}
+	return nil
+}
+
+// CheckPath vhost app stream都可以作为文件路径
+func (k StreamKey) CheckPath() error {
+	for _, name := range []string{k.Vhost, k.App, k.Stream} {
+		if err := CheckPathName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpandPath 展开路径模板里面的{vhost} {app} {stream}, vars是别的变量和值, 比如"{time}", "20060102-150405"
+// 展开之后还要在模板第一个变量之前的目录下面
+func ExpandPath(tmpl string, key StreamKey, vars ...string) (string, error) {
+	if err := key.CheckPath(); err != nil {
+		return "", err
+	}
+	for i := 1; i < len(vars); i += 2 {
+		if err := CheckPathName(vars[i]); err != nil {
+			return "", err
+		}
+	}
+	p := strings.NewReplacer(append([]string{
+		"{vhost}", key.Vhost,
+		"{app}", key.App,
+		"{stream}", key.Stream,
+	}, vars...)...).Replace(tmpl)
+
+	idx := strings.Index(tmpl, "{")
+	if idx < 0 {
+		return p, nil
+	}
+	root := tmpl[:idx]
+	if strings.HasSuffix(root, "/") || strings.HasSuffix(root, string(filepath.Separator)) {
+		root = filepath.Clean(root)
+	} else {
+		root = filepath.Dir(root)
+	}
+	if rel, err := filepath.Rel(root, filepath.Clean(p)); err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s out of %s", p, root)
+	}
+	return p, nil
+}
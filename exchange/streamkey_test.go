@@ -0,0 +1,105 @@
+package exchange
+
+import (
+	"testing"
+)
+
+func TestStreamKeyNoCollision(t *testing.T) {
+	k1, err := NewStreamKey("rtmp://a.com/live", "live", "a-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := NewStreamKey("rtmp://a.com/live-a", "live-a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.String() == k2.String() {
+		t.Fatalf("key collision:%s", k1)
+	}
+
+	k3, _ := NewStreamKey("rtmp://a.com/live", "live", "a/b")
+	k4, _ := NewStreamKey("rtmp://a.com/live/a", "live/a", "b")
+	if k3.String() == k4.String() {
+		t.Fatalf("key collision:%s", k3)
+	}
+}
+
+func TestStreamKeyArgsAndVhost(t *testing.T) {
+	AddVhost("Tenant.example.com")
+	key, err := NewStreamKey("rtmp://Tenant.example.com:1935/live?from=tc", "live", "t1?token=abc&expires=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Vhost != "tenant.example.com" || key.App != "live" || key.Stream != "t1" {
+		t.Fatalf("unexpected key:%s", key)
+	}
+	if key.Arg("token") != "abc" || key.Arg("expires") != "10" || key.Arg("from") != "tc" {
+		t.Fatalf("unexpected args:%v", key.Args)
+	}
+
+	// 不同的查询参数是同一路流
+	other, _ := NewStreamKey("rtmp://tenant.example.com/live", "live", "t1?token=def")
+	if other.String() != key.String() {
+		t.Fatalf("expect same key:%s %s", key, other)
+	}
+
+	key, _ = NewStreamKey("rtmp://127.0.0.1/live", "live", "t1")
+	if key.Vhost != DefaultVhost {
+		t.Fatalf("expect default vhost:%s", key.Vhost)
+	}
+	// 没有配置的域名和ip是同一路流
+	other, _ = NewStreamKey("rtmp://other.example.com/live", "live", "t1")
+	if other.String() != key.String() {
+		t.Fatalf("expect same key:%s %s", key, other)
+	}
+	AddVhost("b.com")
+	key, _ = NewStreamKey("rtmp://127.0.0.1/live", "live", "t1?vhost=B.com")
+	if key.Vhost != "b.com" {
+		t.Fatalf("expect vhost from args:%s", key.Vhost)
+	}
+	// 没有配置的vhost参数不用, 还是tcUrl的vhost
+	key, _ = NewStreamKey("rtmp://tenant.example.com/live", "live", "t1?vhost=nosuch.com")
+	if key.Vhost != "tenant.example.com" {
+		t.Fatalf("expect vhost from tcUrl:%s", key.Vhost)
+	}
+	key, _ = NewStreamKey("rtmp://127.0.0.1/live", "live", "t1?vhost=nosuch.com")
+	if key.Vhost != DefaultVhost {
+		t.Fatalf("expect default vhost:%s", key.Vhost)
+	}
+
+	key, err = ParseStreamUrl("rtmp://a.com/live/sub/t1?token=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.App != "live/sub" || key.Stream != "t1" || key.Arg("token") != "abc" {
+		t.Fatalf("unexpected key:%s %v", key, key.Args)
+	}
+
+	if _, err = NewStreamKey("rtmp://a.com/live", "live", ""); err == nil {
+		t.Fatal("expect error for empty stream")
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	key := StreamKey{Vhost: DefaultVhost, App: "live", Stream: "s"}
+	p, err := ExpandPath("/data/{vhost}/{app}/{stream}-{time}.flv", key, "{time}", "20200101-000000")
+	if err != nil || p != "/data/"+DefaultVhost+"/live/s-20200101-000000.flv" {
+		t.Fatalf("unexpected path %s:%v", p, err)
+	}
+
+	// 客户端给的名字不能跑到模板的目录外面
+	for _, bad := range []StreamKey{
+		{Vhost: DefaultVhost, App: "live/../../..", Stream: "s"},
+		{Vhost: "..", App: "live", Stream: "s"},
+		{Vhost: DefaultVhost, App: "live", Stream: `..\s`},
+		{Vhost: DefaultVhost, App: "live", Stream: "s\x00"},
+		{Vhost: DefaultVhost, App: "", Stream: "s"},
+	} {
+		if p, err := ExpandPath("/data/{vhost}/{app}/{stream}.flv", bad); err == nil {
+			t.Fatalf("%q should be rejected:%s", bad.String(), p)
+		}
+	}
+	if p, err := ExpandPath("/data/x{stream}/../../{app}.flv", key); err == nil {
+		t.Fatalf("%s out of template root", p)
+	}
+}
@@ -0,0 +1,166 @@
+package exchange
+
+import (
+	"log"
+	"time"
+)
+
+/*
+	推流的时间戳整理, 在source的协程里面执行
+	rtmp和flv的时间戳是32位毫秒，49.7天回绕，编码器重启或者时钟跳变时间戳也会突然回退或者跳很远
+	1. 每个track和上一个时间戳的差值按照int32计算，回绕之后就自然延续到64位
+	2. 差值超过MaxJump(前进或者后退)认为是跳变，调整整个source的offset，接着上一帧继续
+	   offset是source共享的，音视频一起跳的时候另一个track不会再调整一次
+	3. 小的回退直接等于上一帧，保证每个track单调递增
+	4. 同一个track的时间戳持续是0(至少wallClockFrames帧并且wallClockDuration), 改用收到的时间
+	   推流的时间戳重新开始增长之后换回推流的时间, 切换的时候和跳变一样接着上一帧走
+*/
+
+const (
+	// 开始的时候几帧音频的时间戳是0很常见, 不能因为这个丢掉推流的时间
+	wallClockFrames   = 10
+	wallClockDuration = time.Second
+)
+
+type trackTimestamp struct {
+	started   bool
+	lastRaw   uint32
+	unwrapped int64 // 回绕处理之后的输入时间戳
+	lastOut   int64
+	lastDelta int64     // 跳变的时候用上一帧的间隔接着走
+	zeros     int       // 连续的0时间戳个数
+	zeroStart time.Time // 第一个0时间戳收到的时间
+	pubRaw    uint32    // 推流的原始时间戳, 用收到的时间的时候判断推流的时间戳有没有开始增长
+}
+
+type timestampNormalizer struct {
+	config    TimestampConfig
+	offset    int64
+	wallClock bool // 推流的时间戳都是0
+	rebase    bool // 刚切换了时间来源, 下一帧接着上一帧走
+	startTime time.Time
+	now       func() time.Time // 测试的时候替换
+	audio     trackTimestamp
+	video     trackTimestamp
+	lastOut   int64 // 所有track最新的时间戳, sequence header和metadata使用
+}
+
+func newTimestampNormalizer(config TimestampConfig) *timestampNormalizer {
+	return &timestampNormalizer{
+		config: config,
+		now:    time.Now,
+	}
+}
+
+func (n *timestampNormalizer) normalize(m *ExData) {
+	if n.config.Disabled {
+		return
+	}
+	now := n.now()
+	if n.startTime.IsZero() {
+		n.startTime = now
+	}
+
+	var track *trackTimestamp
+	switch m.DataType {
+	case DataTypeAudio:
+		track = &n.audio
+	case DataTypeVideo, DataTypeVideoKeyFrame, DataTypeVideoNonKeyFrame:
+		track = &n.video
+	default:
+		// sequence header和metadata放在当前时间
+		m.Timestamp = uint64(n.lastOut)
+		return
+	}
+
+	raw := uint32(m.Timestamp)
+	n.checkWallClock(track, raw, now)
+	if n.wallClock {
+		raw = uint32(now.Sub(n.startTime) / time.Millisecond)
+	}
+
+	first := !track.started
+	if first {
+		track.started = true
+		track.unwrapped = int64(raw)
+	} else {
+		track.unwrapped += int64(int32(raw - track.lastRaw))
+	}
+	track.lastRaw = raw
+
+	out := track.unwrapped + n.offset
+	if !first {
+		delta := out - track.lastOut
+		maxJump := int64(n.config.MaxJump)
+		if n.rebase || maxJump > 0 && (delta > maxJump || delta < -maxJump) {
+			log.Println("timestamp jump:", delta, "rebase from", track.lastOut)
+			n.rebase = false
+			n.offset = track.lastOut + track.lastDelta - track.unwrapped
+			out = track.lastOut + track.lastDelta
+		} else if delta < 0 {
+			out = track.lastOut
+		} else {
+			track.lastDelta = delta
+		}
+	}
+	if out < 0 {
+		out = 0
+	}
+
+	track.lastOut = out
+	if out > n.lastOut {
+		n.lastOut = out
+	}
+	m.Timestamp = uint64(out)
+}
+
+// checkWallClock 同一个track的时间戳持续是0改用收到的时间, 推流的时间戳开始增长之后换回来
+func (n *timestampNormalizer) checkWallClock(track *trackTimestamp, raw uint32, now time.Time) {
+	if raw != 0 {
+		if n.wallClock && raw > track.pubRaw {
+			log.Println("publisher timestamp is increasing, use publisher time")
+			n.wallClock = false
+			n.rebase = true
+		}
+		track.zeros = 0
+		track.pubRaw = raw
+		return
+	}
+
+	if track.zeros == 0 {
+		track.zeroStart = now
+	}
+	track.zeros++
+	track.pubRaw = 0
+	if !n.wallClock && track.zeros >= wallClockFrames && now.Sub(track.zeroStart) >= wallClockDuration {
+		log.Println("publisher timestamp is always 0, use wall clock")
+		n.wallClock = true
+		n.rebase = true
+	}
+}
+
+// current 当前的时间，生成的metadata使用
+func (n *timestampNormalizer) current() uint64 {
+	return uint64(n.lastOut)
+}
+
+// sinkTimestampRebase 每个观看者的时间戳从0开始, 在sink的协程里面执行
+type sinkTimestampRebase struct {
+	started bool
+	base    uint64
+}
+
+func (r *sinkTimestampRebase) rebase(m *ExData) {
+	switch m.DataType {
+	case DataTypeAudio, DataTypeVideo, DataTypeVideoKeyFrame, DataTypeVideoNonKeyFrame:
+		if !r.started {
+			r.started = true
+			r.base = m.Timestamp
+		}
+	}
+	if !r.started || m.Timestamp < r.base {
+		m.Timestamp = 0
+		return
+	}
+	m.Timestamp -= r.base
+}
@@ -0,0 +1,113 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+)
+
+func normalizeTs(n *timestampNormalizer, dataType uint8, ts uint64) uint64 {
+	m := &ExData{DataType: dataType, Timestamp: ts}
+	n.normalize(m)
+	return m.Timestamp
+}
+
+func TestTimestampRollover(t *testing.T) {
+	n := newTimestampNormalizer(TimestampConfig{MaxJump: 10000})
+
+	normalizeTs(n, DataTypeVideoKeyFrame, 0xFFFFFF00)
+	if ts := normalizeTs(n, DataTypeVideoNonKeyFrame, 0x00000010); ts != 0xFFFFFF00+0x110 {
+		t.Fatalf("rollover:%x", ts)
+	}
+	if ts := normalizeTs(n, DataTypeVideoNonKeyFrame, 0x00000050); ts != 0x100000050 {
+		t.Fatalf("after rollover:%x", ts)
+	}
+}
+
+func TestTimestampDiscontinuity(t *testing.T) {
+	n := newTimestampNormalizer(TimestampConfig{MaxJump: 10000})
+
+	normalizeTs(n, DataTypeVideoKeyFrame, 100000)
+	normalizeTs(n, DataTypeAudio, 100010)
+	normalizeTs(n, DataTypeVideoNonKeyFrame, 100040)
+	normalizeTs(n, DataTypeAudio, 100033)
+
+	// 编码器重启，时间戳从0开始，接着上一帧走，音视频一起调整
+	if ts := normalizeTs(n, DataTypeVideoKeyFrame, 0); ts != 100080 {
+		t.Fatalf("video rebase:%d", ts)
+	}
+	if ts := normalizeTs(n, DataTypeAudio, 10); ts != 100090 {
+		t.Fatalf("audio rebase:%d", ts)
+	}
+	if ts := normalizeTs(n, DataTypeVideoNonKeyFrame, 40); ts != 100120 {
+		t.Fatalf("video after rebase:%d", ts)
+	}
+
+	// 小的回退保持单调
+	if ts := normalizeTs(n, DataTypeVideoNonKeyFrame, 30); ts != 100120 {
+		t.Fatalf("expect monotonic:%d", ts)
+	}
+
+	// sequence header使用当前时间
+	if ts := normalizeTs(n, DataTypeVideoConfig, 0); ts != 100120 {
+		t.Fatalf("config timestamp:%d", ts)
+	}
+}
+
+func TestTimestampWallClock(t *testing.T) {
+	n := newTimestampNormalizer(TimestampConfig{MaxJump: 10000})
+	now := time.Now()
+	n.now = func() time.Time { return now }
+
+	// 开始的几帧音频是0不切换
+	normalizeTs(n, DataTypeAudio, 0)
+	normalizeTs(n, DataTypeAudio, 0)
+	if ts := normalizeTs(n, DataTypeAudio, 23); n.wallClock || ts != 23 {
+		t.Fatalf("wall clock:%v %d", n.wallClock, ts)
+	}
+
+	// 持续1秒都是0才切换
+	var ts uint64
+	for i := 0; i < 26; i++ {
+		ts = normalizeTs(n, DataTypeVideoKeyFrame, 0)
+		if i < 25 && n.wallClock {
+			t.Fatalf("wall clock after %d frames", i+1)
+		}
+		now = now.Add(40 * time.Millisecond)
+	}
+	if !n.wallClock {
+		t.Fatal("expect wall clock")
+	}
+	if next := normalizeTs(n, DataTypeVideoNonKeyFrame, 0); next != ts+40 {
+		t.Fatalf("wall clock timestamp:%d after %d", next, ts)
+	}
+	now = now.Add(40 * time.Millisecond)
+	ts = normalizeTs(n, DataTypeVideoNonKeyFrame, 0)
+
+	// 推流的时间戳开始增长之后换回来, 接着上一帧走
+	if next := normalizeTs(n, DataTypeVideoNonKeyFrame, 5000); n.wallClock || next != ts+40 {
+		t.Fatalf("publisher time:%v %d after %d", n.wallClock, next, ts)
+	}
+	if next := normalizeTs(n, DataTypeVideoNonKeyFrame, 5040); next != ts+80 {
+		t.Fatalf("publisher time:%d after %d", next, ts)
+	}
+}
+
+func TestSinkTimestampRebase(t *testing.T) {
+	r := &sinkTimestampRebase{}
+	for _, c := range []struct {
+		dataType uint8
+		in, out  uint64
+	}{
+		{DataTypeDataAMF0, 0, 0},
+		{DataTypeVideoConfig, 5000, 0},
+		{DataTypeVideoKeyFrame, 5000, 0},
+		{DataTypeAudio, 5010, 10},
+		{DataTypeVideoNonKeyFrame, 5040, 40},
+	} {
+		m := &ExData{DataType: c.dataType, Timestamp: c.in}
+		r.rebase(m)
+		if m.Timestamp != c.out {
+			t.Fatalf("rebase %d expect:%d but:%d", c.in, c.out, m.Timestamp)
+		}
+	}
+}
@@ -7,7 +7,12 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/chinasarft/golive/app/hls"
+	"github.com/chinasarft/golive/app/record"
+	"github.com/chinasarft/golive/app/relay"
 	"github.com/chinasarft/golive/app/rtmpserver"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/protocol/httpflv"
 )
 
 func printNumGoroutine() {
@@ -36,6 +41,25 @@ func startRTMPS() {
 	}
 }
 
+// startHTTP 对外的http播放端口, 和上面内部控制用的分开
+// m3u8和ts是hls, 别的是http-flv
+func startHTTP() {
+	flvHandler := httpflv.NewHandler(exchange.GetExchanger())
+	hlsServer := hls.NewServer(exchange.GetExchanger())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if hls.IsHlsPath(r.URL.Path) {
+			hlsServer.ServeHTTP(w, r)
+			return
+		}
+		flvHandler.ServeHTTP(w, r)
+	})
+	err := http.ListenAndServe(":8080", mux)
+	if err != nil {
+		log.Println("fail to start http:", err)
+	}
+}
+
 func main() {
 	//目前这个http服务只是为了观察运行时情况
 	// 打算是启动一个内部http端口做一些控制
@@ -48,6 +72,16 @@ func main() {
 	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
 	log.Println("rtmp server starting...")
 
+	// 配置了Origins的app作为边缘节点回源, 配置了Forward.Urls的app转推
+	exchange.SetPuller(relay.NewPuller(exchange.GetExchanger()))
+	exchange.SetForwarder(relay.NewForwarder(exchange.GetExchanger()))
+
+	// 配置了Record.Enabled的app录制, 单独的流用/record/start和/record/stop控制
+	recorder := record.NewRecorder(exchange.GetExchanger())
+	exchange.SetRecorder(recorder)
+	http.Handle("/record/", recorder)
+
 	go startRTMP()
+	go startHTTP()
 	startRTMPS()
 }
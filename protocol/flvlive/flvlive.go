@@ -5,19 +5,13 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"regexp"
+	"net"
 	"strings"
 
 	"github.com/chinasarft/golive/exchange"
 	"github.com/chinasarft/golive/utils/amf"
 )
 
-var gRe *regexp.Regexp
-
-func init() {
-	gRe = regexp.MustCompile(`\/(\w{1,})\/(\w{1,})`)
-}
-
 type Config struct {
 	MagicNumber uint8
 }
@@ -27,8 +21,8 @@ type FlvLiveHandler struct {
 	pad    exchange.Pad
 	config Config
 
-	appStreamKey string
-	inited       bool
+	streamKey exchange.StreamKey
+	inited    bool
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -66,29 +60,27 @@ func (f *FlvLiveHandler) Start() error {
 			}
 		default:
 			if f.putData == nil {
+				d.Release()
 				return fmt.Errorf("source not registered")
 			}
 
-			f.putData(d)
+			if err = f.putData(d); err != nil {
+				return err
+			}
 		}
 	}
 }
 
-func (f *FlvLiveHandler) GetAppStreamKey() string {
-	return f.appStreamKey
+func (f *FlvLiveHandler) GetStreamKey() exchange.StreamKey {
+	return f.streamKey
 }
 
-func getAppStreamKey(rtmpUrl string) (string, error) {
+func getStreamKey(rtmpUrl string) (exchange.StreamKey, error) {
 	if strings.Index(rtmpUrl, "rtmp://") != 0 {
-		return "", fmt.Errorf("wrong url:%s", rtmpUrl)
-	}
-
-	matches := gRe.FindAllStringSubmatch(rtmpUrl, -1)
-	if matches == nil || len(matches) < 0 || len(matches[0]) < 3 {
-		return "", fmt.Errorf("wrong url:%s", rtmpUrl)
+		return exchange.StreamKey{}, fmt.Errorf("wrong url:%s", rtmpUrl)
 	}
 
-	return matches[0][1] + "-" + matches[0][2], nil
+	return exchange.ParseStreamUrl(rtmpUrl)
 }
 
 func (f *FlvLiveHandler) handleScriptData(d *exchange.ExData) error {
@@ -105,12 +97,17 @@ func (f *FlvLiveHandler) handleScriptData(d *exchange.ExData) error {
 			return fmt.Errorf("url not a string")
 		}
 
-		f.appStreamKey, err = getAppStreamKey(rtmpUrl)
+		if f.streamKey, err = getStreamKey(rtmpUrl); err != nil {
+			return err
+		}
 
 		isPublish, ok := objRead["publish"].(bool)
 		if !ok {
 			return fmt.Errorf("publish is not bool")
 		}
+		if err = f.authorize(rtmpUrl, objRead, isPublish); err != nil {
+			return err
+		}
 		if isPublish {
 			if f.putData, err = f.pad.OnSourceDetermined(f, f.ctx); err != nil {
 				return err
@@ -127,6 +124,23 @@ func (f *FlvLiveHandler) handleScriptData(d *exchange.ExData) error {
 	return nil
 }
 
+// authorize flvlive没有状态回复，不允许就直接断开
+func (f *FlvLiveHandler) authorize(rtmpUrl string, obj amf.Object, isPublish bool) error {
+	req := &exchange.AuthRequest{
+		Action:     exchange.AuthActionPlay,
+		ConnectCmd: obj,
+		TcUrl:      rtmpUrl,
+		Key:        f.streamKey,
+	}
+	if isPublish {
+		req.Action = exchange.AuthActionPublish
+	}
+	if c, ok := f.rw.(interface{ RemoteAddr() net.Addr }); ok {
+		req.RemoteAddr = c.RemoteAddr().String()
+	}
+	return exchange.Authorize(req)
+}
+
 func (f *FlvLiveHandler) WriteData(m *exchange.ExData) error {
 	return fmt.Errorf("flv live must be source")
 }
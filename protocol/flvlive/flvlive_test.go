@@ -2,38 +2,45 @@ package flvlive
 
 import (
 	"testing"
+
+	"github.com/chinasarft/golive/exchange"
 )
 
-func Test_getAppStreamKey(t *testing.T) {
-	key, err := getAppStreamKey("rtmp://a.b.c/app/name")
+func Test_getStreamKey(t *testing.T) {
+	exchange.AddVhost("a.b.c")
+	key, err := getStreamKey("rtmp://a.b.c/app/name")
 	if err != nil {
 		t.Fatalf("fail:%s\n", err.Error())
 	}
-	if key != "app-name" {
+	if key.Vhost != "a.b.c" || key.App != "app" || key.Stream != "name" {
 		t.Fatalf("unpected key:%s\n", key)
 	}
 
-	key, err = getAppStreamKey("rtmp://a.b.c/app/name?token=abc")
+	key, err = getStreamKey("rtmp://a.b.c/app/name?token=abc")
 	if err != nil {
 		t.Fatalf("fail:%s\n", err.Error())
 	}
-	if key != "app-name" {
-		t.Fatalf("unpected key:%s\n", key)
+	if key.App != "app" || key.Stream != "name" || key.Arg("token") != "abc" {
+		t.Fatalf("unpected key:%s %v\n", key, key.Args)
 	}
 
-	key, err = getAppStreamKey("rtmp://a.b.c/app/name?token=abc&/app2/name2")
+	key, err = getStreamKey("rtmp://a.b.c/app/name?token=abc&/app2/name2")
 	if err != nil {
 		t.Fatalf("fail:%s\n", err.Error())
 	}
-	if key != "app-name" {
+	if key.App != "app" || key.Stream != "name" || key.Arg("token") != "abc" {
 		t.Fatalf("unpected key:%s\n", key)
 	}
 
-	key, err = getAppStreamKey("rtmp://a.b.c/app/name?token=abc&/app2/name2&debug=true")
+	key, err = getStreamKey("rtmp://a.b.c/app/name?token=abc&/app2/name2&debug=true")
 	if err != nil {
 		t.Fatalf("fail:%s\n", err.Error())
 	}
-	if key != "app-name" {
+	if key.App != "app" || key.Stream != "name" || key.Arg("debug") != "true" {
 		t.Fatalf("unpected key:%s\n", key)
 	}
+
+	if _, err = getStreamKey("http://a.b.c/app/name"); err == nil {
+		t.Fatalf("expect error for non rtmp url")
+	}
 }
@@ -14,6 +14,10 @@ func GetNextExData(r io.Reader) (d *exchange.ExData, err error) {
 		return
 	}
 
+	if (tag.TagType == flv.FlvTagAudio || tag.TagType == flv.FlvTagVideo) && len(tag.Data) < 2 {
+		return nil, fmt.Errorf("flv tag too short:%d", len(tag.Data))
+	}
+
 	switch tag.TagType {
 	case flv.FlvTagAudio:
 		d, err = getAudioExData(tag)
@@ -24,7 +28,7 @@ func GetNextExData(r io.Reader) (d *exchange.ExData, err error) {
 	case flv.FlvTagAMF3:
 		d, err = getScriptExData(tag, exchange.DataTypeDataAMF3)
 	default:
-		err = fmt.Errorf("not supported flv type:%d", d.DataType)
+		err = fmt.Errorf("not supported flv type:%d", tag.TagType)
 	}
 
 	return
@@ -42,13 +46,11 @@ func getAudioExData(tag *flv.FlvTag) (d *exchange.ExData, err error) {
 		aType = exchange.DataTypeAudioConfig
 	}
 
-	d = &exchange.ExData{
-		Timestamp:      uint64(tag.Timestamp),
-		DataType:       aType,
-		AvFormat:       exchange.AvFormatAAC,
-		OriginProtocol: exchange.ProtocolFLVLIVE,
-		Payload:        tag.Data,
-	}
+	d = exchange.NewPooledExData(tag.Data)
+	d.Timestamp = uint64(tag.Timestamp)
+	d.DataType = aType
+	d.AvFormat = exchange.AvFormatAAC
+	d.OriginProtocol = exchange.ProtocolFLVLIVE
 
 	return
 }
@@ -68,13 +70,12 @@ func getVideoExData(tag *flv.FlvTag) (d *exchange.ExData, err error) {
 		vType = exchange.DataTypeVideoKeyFrame
 	}
 
-	d = &exchange.ExData{
-		Timestamp:      uint64(tag.Timestamp),
-		DataType:       vType,
-		AvFormat:       exchange.AvFormatAVC,
-		OriginProtocol: exchange.ProtocolFLVLIVE,
-		Payload:        tag.Data,
-	}
+	d = exchange.NewPooledExData(tag.Data)
+	d.Timestamp = uint64(tag.Timestamp)
+	d.DataType = vType
+	d.AvFormat = exchange.AvFormatAVC
+	d.CompositionTime = exchange.ParseCompositionTime(tag.Data)
+	d.OriginProtocol = exchange.ProtocolFLVLIVE
 
 	return
 }
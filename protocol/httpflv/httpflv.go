@@ -0,0 +1,232 @@
+package httpflv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chinasarft/golive/container/flv"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/utils/websocket"
+)
+
+/*
+	http-flv播放
+	1. GET /app/stream.flv?args, Host作为vhost, 和rtmp一样可以用?vhost=指定
+	2. 作为sink注册到exchange, metadata, sequence header和gop缓冲和rtmp的观看者一样由source先发送
+	3. 第一个数据来的时候才回复200和flv头, 等待推流超时回复404
+	4. 客户端断开的时候request的context结束, 注销sink
+	5. 带websocket握手的GET是websocket-flv, 见websocket.go
+	6. POST/PUT是推流, 见publish.go
+*/
+
+const flvExt = ".flv"
+
+var ErrPlayerClosed = errors.New("http flv player closed")
+
+type Handler struct {
+	pad exchange.Pad
+
+	PingInterval time.Duration // websocket发送ping的间隔
+}
+
+func NewHandler(pad exchange.Pad) *Handler {
+	return &Handler{
+		pad:          pad,
+		PingInterval: defaultWsPingInterval,
+	}
+}
+
+// StreamKeyFromRequest /app/stream.flv, 最后一段是stream, 前面的是app
+func StreamKeyFromRequest(r *http.Request, ext string) (exchange.StreamKey, error) {
+	if !strings.HasSuffix(r.URL.Path, ext) {
+		return exchange.StreamKey{}, fmt.Errorf("wrong path:%s", r.URL.Path)
+	}
+	rawurl := "http://" + r.Host + strings.TrimSuffix(r.URL.Path, ext)
+	if r.URL.RawQuery != "" {
+		rawurl += "?" + r.URL.RawQuery
+	}
+	return exchange.ParseStreamUrl(rawurl)
+}
+
+// Authorize http没有connect命令, ConnectCmd是nil
+func Authorize(r *http.Request, action string, key exchange.StreamKey) error {
+	return exchange.Authorize(&exchange.AuthRequest{
+		Action:     action,
+		TcUrl:      "http://" + r.Host + r.URL.RequestURI(),
+		Key:        key,
+		RemoteAddr: r.RemoteAddr,
+	})
+}
+
+// SetCorsHeader 网页播放器跨域请求, 鉴权用url里面的参数, 不需要带cookie
+func SetCorsHeader(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", "Range, Content-Type")
+	h.Set("Access-Control-Expose-Headers", "Content-Length, Content-Range")
+}
+
+// authErrorStatus 鉴权失败对应的http状态码
+func authErrorStatus(err error) int {
+	if _, ok := err.(*exchange.AuthError); ok {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	SetCorsHeader(w)
+	// 网页上也可以用POST/PUT推流
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if websocket.IsUpgrade(r) {
+			s.playWebSocket(w, r)
+		} else {
+			s.play(w, r)
+		}
+	case http.MethodPost, http.MethodPut:
+		s.publish(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Handler) play(w http.ResponseWriter, r *http.Request) {
+	key, err := StreamKeyFromRequest(r, flvExt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err = Authorize(r, exchange.AuthActionPlay, key); err != nil {
+		log.Println(key.String(), err)
+		http.Error(w, err.Error(), authErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+	p := newPlayer(r.Context(), key, w)
+	if err = s.pad.OnSinkDetermined(p, p.ctx); err != nil {
+		log.Println(key.String(), "http flv play:", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	<-p.ctx.Done()
+	s.pad.OnDestroySink(p)
+	if written, notFound := p.close(); !written && notFound {
+		http.Error(w, exchange.ErrStreamNotFound.Error(), http.StatusNotFound)
+	}
+	log.Println(key.String(), "http flv play quit")
+}
+
+// FlvWriter 把ExData写成flv tag, websocket也用它
+type FlvWriter struct {
+	w             io.Writer
+	headerWritten bool
+}
+
+func NewFlvWriter(w io.Writer) *FlvWriter {
+	return &FlvWriter{
+		w: w,
+	}
+}
+
+// tagType ExData的Payload就是tag data
+func tagType(d *exchange.ExData) uint8 {
+	switch d.DataType {
+	case exchange.DataTypeAudio, exchange.DataTypeAudioConfig:
+		return flv.FlvTagAudio
+	case exchange.DataTypeDataAMF0:
+		return flv.FlvTagAMF0
+	case exchange.DataTypeDataAMF3:
+		return flv.FlvTagAMF3
+	}
+	return flv.FlvTagVideo
+}
+
+// WriteData 第一个tag之前写flv头, 这个时候还不知道有没有音频视频, 都设置上
+func (fw *FlvWriter) WriteData(d *exchange.ExData) error {
+	if !fw.headerWritten {
+		if err := flv.WriteFileHeader(fw.w, true, true); err != nil {
+			return err
+		}
+		fw.headerWritten = true
+	}
+	_, err := flv.WriteTag(fw.w, tagType(d), uint32(d.Timestamp), d.Payload)
+	return err
+}
+
+// player 一个http-flv观看者
+type player struct {
+	key     exchange.StreamKey
+	ctx     context.Context
+	cancel  context.CancelFunc
+	flusher http.Flusher
+	fw      *FlvWriter
+
+	lock     sync.Mutex // WriteData在sink的协程, 结束的时候在ServeHTTP的协程
+	closed   bool
+	written  bool
+	notFound bool
+}
+
+func newPlayer(ctx context.Context, key exchange.StreamKey, w http.ResponseWriter) *player {
+	p := &player{
+		key: key,
+		fw:  NewFlvWriter(w),
+	}
+	p.flusher, _ = w.(http.Flusher)
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	return p
+}
+
+func (p *player) GetStreamKey() exchange.StreamKey {
+	return p.key
+}
+
+func (p *player) Cancel() {
+	p.cancel()
+}
+
+// OnStreamNotFound 等待推流超时, 之后会Cancel
+func (p *player) OnStreamNotFound() {
+	p.lock.Lock()
+	p.notFound = true
+	p.lock.Unlock()
+}
+
+func (p *player) WriteData(d *exchange.ExData) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return ErrPlayerClosed
+	}
+	p.written = true
+	if err := p.fw.WriteData(d); err != nil {
+		return err
+	}
+	if p.flusher != nil {
+		p.flusher.Flush()
+	}
+	return nil
+}
+
+// close 之后不能再写ResponseWriter, 返回是否已经回复过
+func (p *player) close() (written, notFound bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	return p.written, p.notFound
+}
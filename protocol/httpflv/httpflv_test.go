@@ -0,0 +1,168 @@
+package httpflv
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chinasarft/golive/container/flv"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/exchange/exchangetest"
+)
+
+func TestHttpFlvPlay(t *testing.T) {
+	pub, put := exchangetest.Publish(t, exchange.GetExchanger(), "httpflv")
+	defer pub.Unpublish()
+	go exchangetest.PutFrames(pub.Context(), put, false, 10*time.Millisecond)
+
+	srv := httptest.NewServer(NewHandler(exchange.GetExchanger()))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/httpflv/s.flv?token=abc", nil)
+	req.Header.Set("Origin", "http://player.example.com")
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "video/x-flv" {
+		t.Fatalf("status:%d content type:%s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "*" || resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("cors:%s", origin)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	if _, _, err = flv.ParseFileHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	// sequence header先到, 然后从关键帧开始
+	tag, err := flv.ParseTag(r)
+	if err != nil || tag.TagType != flv.FlvTagVideo || tag.Data[1] != 0 {
+		t.Fatalf("first tag:%v %v", tag, err)
+	}
+	for tag.TagType != flv.FlvTagVideo || tag.Data[1] != 1 {
+		if tag, err = flv.ParseTag(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tag.Data[0] != 0x17 {
+		t.Fatalf("first frame not key frame:%x", tag.Data[0])
+	}
+	last := tag.Timestamp
+	for i := 0; i < 5; i++ {
+		if tag, err = flv.ParseTag(r); err != nil {
+			t.Fatal(err)
+		}
+		if tag.Timestamp != last+40 {
+			t.Fatalf("timestamp:%d last:%d", tag.Timestamp, last)
+		}
+		last = tag.Timestamp
+	}
+
+	// 客户端断开之后sink注销
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for len(exchange.GetExchanger().GetSinkStats(pub.GetStreamKey())) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sink not removed after client disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHttpFlvNotFound(t *testing.T) {
+	config := exchange.DefaultAppConfig()
+	config.PlayWait.RejectNotPublished = true
+	exchange.SetAppConfig("httpflvreject", config)
+	config.PlayWait = exchange.PlayWaitConfig{Timeout: 50 * time.Millisecond}
+	exchange.SetAppConfig("httpflvwait", config)
+
+	srv := httptest.NewServer(NewHandler(exchange.GetExchanger()))
+	defer srv.Close()
+
+	for _, path := range []string{"/httpflvreject/s.flv", "/httpflvwait/s.flv", "/httpflv/s.mp4"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s status:%d", path, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest("OPTIONS", srv.URL+"/httpflv/s.flv", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("preflight status:%d", resp.StatusCode)
+	}
+	if methods := resp.Header.Get("Access-Control-Allow-Methods"); methods != "GET, POST, PUT, OPTIONS" {
+		t.Fatalf("preflight methods:%s", methods)
+	}
+}
+
+func TestHttpFlvSourceQuit(t *testing.T) {
+	pub, put := exchangetest.Publish(t, exchange.GetExchanger(), "httpflvquit")
+	go exchangetest.PutFrames(pub.Context(), put, false, 10*time.Millisecond)
+
+	srv := httptest.NewServer(NewHandler(exchange.GetExchanger()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/httpflvquit/s.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if _, _, err = flv.ParseFileHeader(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// 推流结束之后响应也结束
+	pub.Unpublish()
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := flv.ParseTag(r); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("response not finished after source quit")
+	}
+}
+
+func TestHttpSignedUrl(t *testing.T) {
+	config := exchange.DefaultAppConfig()
+	config.Sign.PlaySecret = "play"
+	exchange.SetAppConfig("httpsigned", config)
+
+	expires := time.Now().Add(time.Minute).Unix()
+	for _, ext := range []string{".flv", ".m3u8"} {
+		signed, err := exchange.SignStreamUrl("http://127.0.0.1:8080/httpsigned/s"+ext+"?x=1", "play", expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", signed, nil)
+		key, err := StreamKeyFromRequest(req, ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Authorize(req, exchange.AuthActionPlay, key); err != nil {
+			t.Fatal(signed, err)
+		}
+	}
+}
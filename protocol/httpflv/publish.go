@@ -0,0 +1,130 @@
+package httpflv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/chinasarft/golive/container/flv"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/protocol/flvlive"
+)
+
+/*
+	http-flv推流, POST或者PUT /app/stream.flv, body是chunked的flv
+	1. 标准的flv文件头可以有也可以没有, 没有的时候和flvlive一样直接是tag
+	2. tag用flvlive.GetNextExData解析, script data里面的onMetaData交给source
+	3. 鉴权失败403, 已经有人推流409, 推流结束(body读完)之后回复200
+*/
+
+// publisher 一个http-flv推流
+type publisher struct {
+	key    exchange.StreamKey
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (p *publisher) GetStreamKey() exchange.StreamKey {
+	return p.key
+}
+
+func (p *publisher) Cancel() {
+	p.cancel()
+}
+
+func (p *publisher) WriteData(m *exchange.ExData) error {
+	return fmt.Errorf("http flv publisher must be source")
+}
+
+// publishErrorStatus 注册source失败对应的http状态码
+func publishErrorStatus(err error) int {
+	switch e := err.(type) {
+	case *exchange.AuthError:
+		if e.Code == exchange.AuthDenyBadName {
+			return http.StatusBadRequest
+		}
+		return http.StatusForbidden
+	}
+	if err == exchange.ErrStreamAlreadyPublished {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// skipFileHeader 有flv文件头的时候跳过文件头和PreviousTagSize0
+func skipFileHeader(r *bufio.Reader) error {
+	sig, err := r.Peek(3)
+	if err != nil {
+		return err
+	}
+	if string(sig) != "FLV" {
+		return nil
+	}
+	_, _, err = flv.ParseFileHeader(r)
+	return err
+}
+
+func (s *Handler) publish(w http.ResponseWriter, r *http.Request) {
+	key, err := StreamKeyFromRequest(r, flvExt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err = Authorize(r, exchange.AuthActionPublish, key); err != nil {
+		log.Println(key.String(), err)
+		http.Error(w, err.Error(), publishErrorStatus(err))
+		return
+	}
+
+	p := &publisher{key: key}
+	p.ctx, p.cancel = context.WithCancel(r.Context())
+	defer p.Cancel()
+
+	put, err := s.pad.OnSourceDetermined(p, p.ctx)
+	if err != nil {
+		log.Println(key.String(), "http flv publish:", err)
+		http.Error(w, err.Error(), publishErrorStatus(err))
+		return
+	}
+	defer s.pad.OnDestroySource(p)
+
+	err = p.readTags(bufio.NewReader(r.Body), put)
+	log.Println(key.String(), "http flv publish quit:", err)
+	switch {
+	case err == io.EOF:
+		w.WriteHeader(http.StatusOK)
+	case err == exchange.ErrStreamAlreadyPublished:
+		// 被新的推流抢了
+		http.Error(w, err.Error(), http.StatusConflict)
+	case p.ctx.Err() != nil:
+		// 客户端断开, 不用回复了
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// readTags body读完返回io.EOF
+func (p *publisher) readTags(r *bufio.Reader, put exchange.PutData) error {
+	if err := skipFileHeader(r); err != nil {
+		return err
+	}
+	for {
+		d, err := flvlive.GetNextExData(r)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				log.Println(p.key.String(), "http flv publish incomplete tag")
+				return io.EOF
+			}
+			return err
+		}
+		if d.DataType == exchange.DataTypeDataAMF3 {
+			continue
+		}
+		if err = put(d); err != nil {
+			return err
+		}
+	}
+}
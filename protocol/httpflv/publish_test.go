@@ -0,0 +1,167 @@
+package httpflv
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chinasarft/golive/container/flv"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/utils/amf"
+)
+
+// writePublishTags onMetaData, sequence header, 然后每40毫秒一帧
+func writePublishTags(w io.Writer, frames int) error {
+	meta, err := amf.WriteArrayAsSiblingButElemArrayAsObject([]interface{}{"onMetaData", amf.Object{"width": 480.0}})
+	if err != nil {
+		return err
+	}
+	if _, err = flv.WriteTag(w, flv.FlvTagAMF0, 0, meta); err != nil {
+		return err
+	}
+	if _, err = flv.WriteTag(w, flv.FlvTagVideo, 0, []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xc0, 0x15}); err != nil {
+		return err
+	}
+	for i := 0; i < frames; i++ {
+		data := []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 1, 0x41}
+		if i%25 == 0 {
+			data[0] = 0x17
+		}
+		if _, err = flv.WriteTag(w, flv.FlvTagVideo, uint32(i*40), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestHttpFlvPublish(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(exchange.GetExchanger()))
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	result := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(srv.URL+"/httpflvpub/s.flv", "video/x-flv", pr)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- resp
+	}()
+
+	// 标准的flv文件头
+	if err := flv.WriteFileHeader(pw, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePublishTags(pw, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 推流注册之后可以播放
+	key, _ := exchange.NewStreamKey("rtmp://127.0.0.1/httpflvpub", "httpflvpub", "s")
+	deadline := time.Now().Add(time.Second)
+	for exchange.GetExchanger().GetPublishStats(key) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("http flv publish not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err := http.Get(srv.URL + "/httpflvpub/s.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// 重复推流
+	dup, err := http.Post(srv.URL+"/httpflvpub/s.flv", "video/x-flv", bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup.Body.Close()
+	if dup.StatusCode != http.StatusConflict {
+		t.Fatalf("duplicate publish status:%d", dup.StatusCode)
+	}
+
+	go writePublishTags(pw, 50)
+	r := bufio.NewReader(resp.Body)
+	if _, _, err = flv.ParseFileHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	gotMeta, gotFrame := false, false
+	for !gotMeta || !gotFrame {
+		tag, err := flv.ParseTag(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case tag.TagType == flv.FlvTagAMF0:
+			gotMeta = true
+		case tag.TagType == flv.FlvTagVideo && tag.Data[1] == 1:
+			gotFrame = true
+		}
+	}
+
+	// body结束之后推流结束, 回复200
+	pw.Close()
+	pubResp := <-result
+	if pubResp == nil || pubResp.StatusCode != http.StatusOK {
+		t.Fatalf("publish response:%v", pubResp)
+	}
+	pubResp.Body.Close()
+	if exchange.GetExchanger().GetPublishStats(key) != nil {
+		t.Fatal("source not removed after publish finished")
+	}
+}
+
+func TestHttpFlvPublishReject(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(exchange.GetExchanger()))
+	defer srv.Close()
+
+	a, _ := exchange.NewStaticAuthorizer(exchange.StaticAuthConfig{PublishAddrs: []string{"10.0.0.1"}})
+	exchange.SetAuthorizer(a)
+	resp, err := http.Post(srv.URL+"/httpflvdeny/s.flv", "video/x-flv", bytes.NewReader(nil))
+	exchange.SetAuthorizer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("publish denied status:%d", resp.StatusCode)
+	}
+
+	// 不支持的编码
+	var body bytes.Buffer
+	flv.WriteTag(&body, flv.FlvTagVideo, 0, []byte{0x1c, 0, 0, 0, 0})
+	resp, err = http.Post(srv.URL+"/httpflvbad/s.flv", "video/x-flv", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad codec status:%d", resp.StatusCode)
+	}
+}
+
+func TestSkipFileHeader(t *testing.T) {
+	// 和flvlive一样没有文件头的也可以
+	var raw bytes.Buffer
+	writePublishTags(&raw, 1)
+	r := bufio.NewReader(bytes.NewReader(raw.Bytes()))
+	if err := skipFileHeader(r); err != nil || r.Buffered() != raw.Len() {
+		t.Fatalf("raw tags:%v %d", err, r.Buffered())
+	}
+
+	var withHeader bytes.Buffer
+	flv.WriteFileHeader(&withHeader, true, true)
+	withHeader.Write(raw.Bytes())
+	r = bufio.NewReader(&withHeader)
+	if err := skipFileHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := flv.ParseTag(r); err != nil || tag.TagType != flv.FlvTagAMF0 {
+		t.Fatalf("first tag:%v %v", tag, err)
+	}
+}
@@ -0,0 +1,172 @@
+package httpflv
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/utils/websocket"
+)
+
+/*
+	websocket-flv播放, ws://host/app/stream.flv
+	1. 和http-flv一样的flv数据, 每个tag一个binary消息, flv头和第一个tag在一起
+	2. 定时发送ping, 超过3个周期没有收到任何数据(pong)认为客户端已经断开
+	3. 推流结束的时候发送close, 等客户端回复之后断开
+*/
+
+// 推流不存在, 应用自定义的close code
+const wsCloseStreamNotFound = 4404
+
+const (
+	defaultWsPingInterval = 10 * time.Second
+	wsCloseTimeout        = time.Second
+	wsWriteTimeout        = 10 * time.Second
+)
+
+// wsPlayer 一个websocket-flv观看者
+type wsPlayer struct {
+	key    exchange.StreamKey
+	ctx    context.Context
+	cancel context.CancelFunc
+	conn   *websocket.Conn
+	ping   time.Duration
+	buf    bytes.Buffer
+	fw     *FlvWriter
+
+	lock     sync.Mutex
+	notFound bool
+}
+
+func newWsPlayer(ctx context.Context, key exchange.StreamKey, conn *websocket.Conn, ping time.Duration) *wsPlayer {
+	p := &wsPlayer{
+		key:  key,
+		conn: conn,
+		ping: ping,
+	}
+	p.fw = NewFlvWriter(&p.buf)
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	return p
+}
+
+func (p *wsPlayer) GetStreamKey() exchange.StreamKey {
+	return p.key
+}
+
+func (p *wsPlayer) Cancel() {
+	p.cancel()
+}
+
+// OnStreamNotFound 等待推流超时, 之后会Cancel
+func (p *wsPlayer) OnStreamNotFound() {
+	p.lock.Lock()
+	p.notFound = true
+	p.lock.Unlock()
+}
+
+// WriteData 只在sink的协程里面调用, buf不用加锁, 发送close之后返回websocket.ErrClosed
+func (p *wsPlayer) WriteData(d *exchange.ExData) error {
+	p.buf.Reset()
+	if err := p.fw.WriteData(d); err != nil {
+		return err
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return p.conn.WriteMessage(websocket.OpBinary, p.buf.Bytes())
+}
+
+// readLoop 客户端不会发数据, 只处理ping pong close
+func (p *wsPlayer) readLoop(done chan<- error) {
+	p.conn.SetReadDeadline(time.Now().Add(3 * p.ping))
+	p.conn.PongHandler = func([]byte) error {
+		return p.conn.SetReadDeadline(time.Now().Add(3 * p.ping))
+	}
+	for {
+		if _, _, err := p.conn.ReadMessage(); err != nil {
+			done <- err
+			return
+		}
+		p.conn.SetReadDeadline(time.Now().Add(3 * p.ping))
+	}
+}
+
+func (s *Handler) playWebSocket(w http.ResponseWriter, r *http.Request) {
+	key, err := StreamKeyFromRequest(r, flvExt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err = Authorize(r, exchange.AuthActionPlay, key); err != nil {
+		log.Println(key.String(), err)
+		http.Error(w, err.Error(), authErrorStatus(err))
+		return
+	}
+
+	// 握手之后就不能用ResponseWriter了, 跨域的头放到101响应里面
+	conn, err := websocket.Upgrade(w, r, w.Header())
+	if err != nil {
+		log.Println(key.String(), "websocket upgrade:", err)
+		return
+	}
+	defer conn.Close()
+
+	p := newWsPlayer(r.Context(), key, conn, s.PingInterval)
+	readDone := make(chan error, 1)
+	go p.readLoop(readDone)
+
+	if err = s.pad.OnSinkDetermined(p, p.ctx); err != nil {
+		log.Println(key.String(), "websocket flv play:", err)
+		conn.WriteClose(wsCloseStreamNotFound, err.Error())
+		p.waitClose(readDone)
+		return
+	}
+
+	ticker := time.NewTicker(p.ping)
+	defer ticker.Stop()
+	var readErr error
+loop:
+	for {
+		select {
+		case <-p.ctx.Done():
+			break loop
+		case readErr = <-readDone:
+			// 客户端断开或者发送了close
+			p.Cancel()
+			break loop
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err = conn.WriteMessage(websocket.OpPing, nil); err != nil {
+				p.Cancel()
+				break loop
+			}
+		}
+	}
+
+	s.pad.OnDestroySink(p)
+	if readErr == nil {
+		// 推流结束或者等待推流超时, 主动close
+		p.lock.Lock()
+		notFound := p.notFound
+		p.lock.Unlock()
+		if notFound {
+			conn.WriteClose(wsCloseStreamNotFound, exchange.ErrStreamNotFound.Error())
+		} else {
+			conn.WriteClose(websocket.CloseNormal, "stream unpublished")
+		}
+		p.waitClose(readDone)
+	}
+	log.Println(key.String(), "websocket flv play quit:", readErr)
+}
+
+// waitClose 发送close之后等客户端回复, readLoop收到回复之后返回
+func (p *wsPlayer) waitClose(readDone <-chan error) {
+	t := time.NewTimer(wsCloseTimeout)
+	defer t.Stop()
+	select {
+	case <-readDone:
+	case <-t.C:
+	}
+}
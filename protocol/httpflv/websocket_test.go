@@ -0,0 +1,129 @@
+package httpflv
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chinasarft/golive/container/flv"
+	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/exchange/exchangetest"
+	"github.com/chinasarft/golive/utils/websocket"
+)
+
+func dialWebSocket(t *testing.T, srv *httptest.Server, path string) *websocket.Conn {
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestWebSocketFlvPlay(t *testing.T) {
+	pub, put := exchangetest.Publish(t, exchange.GetExchanger(), "wsflv")
+	go exchangetest.PutFrames(pub.Context(), put, false, 10*time.Millisecond)
+
+	h := NewHandler(exchange.GetExchanger())
+	h.PingInterval = 50 * time.Millisecond
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn := dialWebSocket(t, srv, "/wsflv/s.flv")
+	defer conn.Close()
+	pings := make(chan struct{}, 10)
+	conn.PingHandler = func(data []byte) error {
+		pings <- struct{}{}
+		return conn.WriteMessage(websocket.OpPong, data)
+	}
+
+	// 第一个消息是flv头加sequence header, 之后一个消息一个tag
+	opcode, data, err := conn.ReadMessage()
+	if err != nil || opcode != websocket.OpBinary {
+		t.Fatalf("first message:%d %v", opcode, err)
+	}
+	r := bytes.NewReader(data)
+	if _, _, err = flv.ParseFileHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := flv.ParseTag(r); err != nil || tag.Data[1] != 0 || r.Len() != 0 {
+		t.Fatalf("sequence header:%v %v", tag, err)
+	}
+	for i := 0; i < 5; i++ {
+		_, data, err = conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+		if tag, err := flv.ParseTag(r); err != nil || tag.TagType != flv.FlvTagVideo || r.Len() != 0 {
+			t.Fatalf("tag:%v %v", tag, err)
+		}
+	}
+
+	// 定时ping, 客户端读的时候回复pong
+	for len(pings) == 0 {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 推流结束之后服务端发送close
+	pub.Unpublish()
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.CloseNormal {
+		t.Fatalf("close:%v", err)
+	}
+}
+
+func TestWebSocketFlvClientClose(t *testing.T) {
+	pub, put := exchangetest.Publish(t, exchange.GetExchanger(), "wsflvclose")
+	defer pub.Unpublish()
+	go exchangetest.PutFrames(pub.Context(), put, false, 10*time.Millisecond)
+
+	srv := httptest.NewServer(NewHandler(exchange.GetExchanger()))
+	defer srv.Close()
+
+	conn := dialWebSocket(t, srv, "/wsflvclose/s.flv")
+	defer conn.Close()
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 客户端close之后服务端回复并且注销sink
+	conn.WriteClose(websocket.CloseNormal, "")
+	var err error
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	if _, ok := err.(*websocket.CloseError); !ok {
+		t.Fatalf("close reply:%v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(exchange.GetExchanger().GetSinkStats(pub.GetStreamKey())) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sink not removed after websocket closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketFlvNotFound(t *testing.T) {
+	config := exchange.DefaultAppConfig()
+	config.PlayWait.RejectNotPublished = true
+	exchange.SetAppConfig("wsflvreject", config)
+
+	srv := httptest.NewServer(NewHandler(exchange.GetExchanger()))
+	defer srv.Close()
+
+	conn := dialWebSocket(t, srv, "/wsflvreject/s.flv")
+	defer conn.Close()
+	_, _, err := conn.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != wsCloseStreamNotFound {
+		t.Fatalf("close:%v", err)
+	}
+}
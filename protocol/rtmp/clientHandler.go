@@ -29,6 +29,8 @@ type RtmpClientHandler struct {
 	rw                 io.ReadWriter
 	txMsgChan          chan *Message
 	connectResult      chan bool
+	published          chan struct{} // 推流成功之后close
+	done               chan struct{} // Start返回的时候close
 	ctx                context.Context
 	rtmpUrl            *RtmpUrl
 	status             int
@@ -55,7 +57,9 @@ func NewRtmpClientHandler(rw io.ReadWriter, url, role string, player Play) (*Rtm
 		chunkPacker:   NewChunkPacker(),
 		rw:            rw,
 		txMsgChan:     make(chan *Message),
-		connectResult: make(chan bool),
+		connectResult: make(chan bool, 1), // play的时候没有人读
+		published:     make(chan struct{}),
+		done:          make(chan struct{}),
 		status:        rtmp_state_init,
 		transactionId: 1,
 		player:        player,
@@ -68,9 +72,13 @@ func NewRtmpClientHandler(rw io.ReadWriter, url, role string, player Play) (*Rtm
 
 func (h *RtmpClientHandler) Start(ctx context.Context) {
 	var err error
+	defer close(h.done)
 	defer func() {
 		if h.status != rtmp_state_publish_success {
-			h.connectResult <- false
+			select {
+			case h.connectResult <- false:
+			default:
+			}
 		}
 		if err != nil {
 			if h.role == ROLE_PLAY {
@@ -111,6 +119,7 @@ CONNOK:
 			}
 			//log.Println("ststus:", h.status)
 			if h.status == rtmp_state_publish_success {
+				close(h.published)
 				h.connectResult <- true
 				break CONNOK
 			}
@@ -502,32 +511,37 @@ func (h *RtmpClientHandler) WriteMessage(m *Message) error {
 }
 
 func (h *RtmpClientHandler) SendAudioMessage(data []byte, timestamp uint32) error {
-	if h.status != rtmp_state_publish_success {
-		return fmt.Errorf("not in publish start state")
-	}
-	message := &Message{
-		MessageType: TYPE_AUDIO,
-		Timestamp:   timestamp,
-		StreamID:    0,
-		Payload:     data,
-	}
-
-	h.txMsgChan <- message
-	return nil
+	return h.send(TYPE_AUDIO, data, timestamp)
 }
 
 func (h *RtmpClientHandler) SendVideoMessage(data []byte, timestamp uint32) error {
-	if h.status != rtmp_state_publish_success {
+	// TODO 分析封装flv tag body(only body) known as rtmp message
+	return h.send(TYPE_VIDEO, data, timestamp)
+}
+
+// SendDataMessage amf0的data消息, 比如@setDataFrame
+func (h *RtmpClientHandler) SendDataMessage(data []byte, timestamp uint32) error {
+	return h.send(TYPE_DATA_AMF0, data, timestamp)
+}
+
+// send 在调用者的协程里面, 不能读status, 用published和done判断状态
+func (h *RtmpClientHandler) send(messageType uint8, data []byte, timestamp uint32) error {
+	select {
+	case <-h.published:
+	default:
 		return fmt.Errorf("not in publish start state")
 	}
 	message := &Message{
-		MessageType: TYPE_VIDEO,
+		MessageType: messageType,
 		Timestamp:   timestamp,
 		StreamID:    0,
 		Payload:     data,
 	}
-	// TODO 分析封装flv tag body(only body) known as rtmp message
 
-	h.txMsgChan <- message
-	return nil
+	select {
+	case h.txMsgChan <- message:
+		return nil
+	case <-h.done:
+		return fmt.Errorf("rtmp client stopped")
+	}
 }
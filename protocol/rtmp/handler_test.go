@@ -6,8 +6,10 @@ import (
 	"encoding/hex"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/chinasarft/golive/exchange"
+	"github.com/chinasarft/golive/utils/amf"
 )
 
 var (
@@ -158,3 +160,106 @@ func TestRtmpReceiver(t *testing.T) {
 		t.Fatalf("connect response msg not equal:")
 	}
 }
+
+func TestRtmpPublishBadName(t *testing.T) {
+	a, _ := exchange.NewStaticAuthorizer(exchange.StaticAuthConfig{PublishStreams: []string{"other/*"}})
+	exchange.SetAuthorizer(a)
+	defer exchange.SetAuthorizer(nil)
+
+	msg := testc0c1c2 + connectMsg + setChunkSizeMsg + releaseStreamMsg + fcPublishMsg + createStreamMsg +
+		publishMsg + setDataFrameMsg
+	msgByte := make([]byte, len(msg)/2)
+	if _, err := hex.Decode(msgByte, []byte(msg)); err != nil {
+		t.Fatalf("hex decode msg fail:%s", err)
+	}
+
+	rw := newTestHandler(msgByte)
+	handler := NewRtmpHandler(rw, rw, 03)
+	err := handler.Start()
+	if _, ok := err.(*exchange.AuthError); !ok {
+		t.Fatal("expect auth error but:", err)
+	}
+	if !bytes.Contains(rw.writeBuf.Bytes(), []byte("NetStream.Publish.BadName")) {
+		t.Fatal("expect NetStream.Publish.BadName")
+	}
+	if bytes.Contains(rw.writeBuf.Bytes(), []byte("NetStream.Publish.Start")) {
+		t.Fatal("unexpected NetStream.Publish.Start")
+	}
+}
+
+func TestDvrRequest(t *testing.T) {
+	for _, c := range []struct {
+		stream string
+		start  int
+		offset time.Duration
+		dvr    bool
+	}{
+		{"s", -2, 0, false},
+		// librtmp直播也是start=0
+		{"s", 0, 0, false},
+		{"s", 30, 30 * time.Second, true},
+		{"s?dvr_offset=0", 0, 0, true},
+		{"s?dvr_offset=1.5", -2, 1500 * time.Millisecond, true},
+		{"s?dvr_offset=abc", 30, 0, false},
+	} {
+		key, _ := exchange.NewStreamKey("rtmp://127.0.0.1/live", "live", c.stream)
+		h := &RtmpHandler{streamKey: key, playCmdObj: PlayCmdParam{Start: c.start}}
+		req := h.DvrRequest()
+		if (req != nil) != c.dvr || req != nil && req.Offset != c.offset {
+			t.Fatalf("%s start:%d dvr:%+v", c.stream, c.start, req)
+		}
+	}
+}
+
+// notFoundPad 和RejectNotPublished一样, 没有推流直接返回ErrStreamNotFound
+type notFoundPad struct {
+	*testHandler
+}
+
+func (p notFoundPad) OnSinkDetermined(h exchange.StreamHandler, ctx context.Context) error {
+	return exchange.ErrStreamNotFound
+}
+
+// newPlayMsg chunk stream 8, message stream 1的play命令
+func newPlayMsg(stream string) string {
+	var body bytes.Buffer
+	amf.WriteValue(&body, "play")
+	amf.WriteValue(&body, float64(4))
+	amf.WriteNull(&body)
+	amf.WriteValue(&body, stream)
+	header := []byte{0x08, 0, 0, 0, 0, 0, byte(body.Len()), 0x14, 1, 0, 0, 0}
+	return hex.EncodeToString(append(header, body.Bytes()...))
+}
+
+func TestRtmpPlayStreamNotFound(t *testing.T) {
+	msg := testc0c1c2 + connectMsg + setChunkSizeMsg + createStreamMsg + newPlayMsg("t1")
+	msgByte := make([]byte, len(msg)/2)
+	if _, err := hex.Decode(msgByte, []byte(msg)); err != nil {
+		t.Fatalf("hex decode msg fail:%s", err)
+	}
+
+	rw := newTestHandler(msgByte)
+	handler := NewRtmpHandler(rw, notFoundPad{rw}, 03)
+	if err := handler.Start(); err != exchange.ErrStreamNotFound {
+		t.Fatal("expect stream not found but:", err)
+	}
+	// 不能先回复Play.Start再回复StreamNotFound
+	if !bytes.Contains(rw.writeBuf.Bytes(), []byte("NetStream.Play.StreamNotFound")) {
+		t.Fatal("expect NetStream.Play.StreamNotFound")
+	}
+	for _, code := range []string{"NetStream.Play.Reset", "NetStream.Play.Start"} {
+		if bytes.Contains(rw.writeBuf.Bytes(), []byte(code)) {
+			t.Fatal("unexpected", code)
+		}
+	}
+
+	// 流存在的时候正常回复Play.Start
+	rw = newTestHandler(msgByte)
+	handler = NewRtmpHandler(rw, rw, 03)
+	if err := handler.Start(); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(rw.writeBuf.Bytes(), []byte("NetStream.Play.Start")) {
+		t.Fatal("expect NetStream.Play.Start")
+	}
+}
@@ -343,6 +343,37 @@ func NewPlayPublishNotifyMessage(stremid uint32) (*Message, error) {
 		"NetStream.Play.PublishNotify", "status", "Started playing notify.")
 }
 
+func NewPlayStreamNotFoundMessage(stremid uint32) (*Message, error) {
+
+	return NewNetStreamOnStatusMessageWithCodeLevelDesc(stremid,
+		"NetStream.Play.StreamNotFound", "error", "Stream not found.")
+}
+
+func NewPauseNotifyMessage(stremid uint32) (*Message, error) {
+
+	return NewNetStreamOnStatusMessageWithCodeLevelDesc(stremid,
+		"NetStream.Pause.Notify", "status", "Paused stream.")
+}
+
+func NewUnpauseNotifyMessage(stremid uint32) (*Message, error) {
+
+	return NewNetStreamOnStatusMessageWithCodeLevelDesc(stremid,
+		"NetStream.Unpause.Notify", "status", "Unpaused stream.")
+}
+
+func NewPublishBadNameMessage(stremid uint32, desc string) (*Message, error) {
+
+	return NewNetStreamOnStatusMessageWithCodeLevelDesc(stremid,
+		"NetStream.Publish.BadName", "error", desc)
+}
+
+// NewConnectRejectedMessage 鉴权在publish/play的时候才做，所以也是onStatus
+func NewConnectRejectedMessage(stremid uint32, desc string) (*Message, error) {
+
+	return NewNetStreamOnStatusMessageWithCodeLevelDesc(stremid,
+		"NetConnection.Connect.Rejected", "error", desc)
+}
+
 func NewNetStreamOnStatusMessageWithCodeLevelDesc(stremid uint32, code, level, desc string) (*Message, error) {
 
 	message := &Message{
@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"reflect"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/chinasarft/golive/exchange"
 	"github.com/chinasarft/golive/utils/amf"
@@ -40,7 +44,7 @@ type RtmpHandler struct {
 	connetCmdObj  map[string]interface{}
 	publishCmdObj ConnectCmdParam
 	playCmdObj    PlayCmdParam
-	appStreamKey  string
+	streamKey     exchange.StreamKey
 
 	avInfo             amf.Object
 	videoCodecID       int
@@ -57,10 +61,14 @@ type RtmpHandler struct {
 	putMsg exchange.PutData
 
 	status int // 做一个状态机？
+
+	writeLock sync.Mutex          // 时移播放的协程和回复pause的时候都会写
+	dvrPlayer *exchange.DvrPlayer // 时移播放才有, pause命令用
 }
 
 func NewRtmpHandler(rw io.ReadWriter, pad exchange.Pad, firstByte byte) *RtmpHandler {
 	return &RtmpHandler{
+		playCmdObj:    PlayCmdParam{Start: -2, Duration: -1},
 		chunkUnpacker: NewChunkUnpacker(),
 		chunkPacker:   NewChunkPacker(),
 		rw:            rw,
@@ -116,8 +124,52 @@ func (h *RtmpHandler) Start() error {
 
 }
 
-func (h *RtmpHandler) GetAppStreamKey() string {
-	return h.appStreamKey
+func (h *RtmpHandler) GetStreamKey() exchange.StreamKey {
+	return h.streamKey
+}
+
+// tcUrl里面的host作为vhost, stream后面的查询参数放到Args里面
+func (h *RtmpHandler) newStreamKey(stream string) (exchange.StreamKey, error) {
+	app, _ := h.connetCmdObj["app"].(string)
+	tcUrl, _ := h.connetCmdObj["tcUrl"].(string)
+	return exchange.NewStreamKey(tcUrl, app, stream)
+}
+
+// PublishType 实现exchange.PublishTypeSource, publish命令没有带类型的时候是live
+func (h *RtmpHandler) PublishType() string {
+	if h.publishCmdObj.PublishType == "" {
+		return exchange.PublishTypeLive
+	}
+	return h.publishCmdObj.PublishType
+}
+
+// DvrRequest 实现exchange.DvrSink, play的start大于0或者流名带了dvr_offset参数(秒)就是时移播放
+// librtmp的播放器(ffplay没有live=1, 很多机顶盒)直播也发start=0, 不能当成时移
+func (h *RtmpHandler) DvrRequest() *exchange.DvrRequest {
+	var offset time.Duration
+	if v := h.streamKey.Args.Get("dvr_offset"); v != "" {
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil || seconds < 0 {
+			log.Println("wrong dvr_offset:", v)
+			return nil
+		}
+		offset = time.Duration(seconds * float64(time.Second))
+	} else if h.playCmdObj.Start > 0 {
+		offset = time.Duration(h.playCmdObj.Start) * time.Second
+	} else {
+		return nil
+	}
+
+	req := &exchange.DvrRequest{Offset: offset}
+	if h.playCmdObj.Duration > 0 {
+		req.Duration = time.Duration(h.playCmdObj.Duration) * time.Second
+	}
+	return req
+}
+
+// OnDvrStart 实现exchange.DvrSink, 在OnSinkDetermined里面回调, 之后处理pause命令
+func (h *RtmpHandler) OnDvrStart(p *exchange.DvrPlayer) {
+	h.dvrPlayer = p
 }
 
 func (h *RtmpHandler) GetFunctionalStreamId() uint32 {
@@ -139,6 +191,58 @@ func (h *RtmpHandler) Cancel() {
 	h.cancel()
 }
 
+// OnStreamNotFound 等待推流超时, 回复StreamNotFound之后关闭连接, Start的读循环就会退出
+func (h *RtmpHandler) OnStreamNotFound() {
+	h.writeStreamNotFound()
+	if c, ok := h.rw.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (h *RtmpHandler) writeStreamNotFound() {
+	msg, err := NewPlayStreamNotFoundMessage(h.GetFunctionalStreamId())
+	if err != nil {
+		return
+	}
+	if err = h.WriteMessage(msg); err != nil {
+		log.Println("write StreamNotFound:", err)
+	}
+}
+
+// authorize 鉴权失败回复错误状态, 返回的错误会让Start退出并断开连接
+func (h *RtmpHandler) authorize(action string) error {
+	tcUrl, _ := h.connetCmdObj["tcUrl"].(string)
+	req := &exchange.AuthRequest{
+		Action:     action,
+		ConnectCmd: h.connetCmdObj,
+		TcUrl:      tcUrl,
+		Key:        h.streamKey,
+	}
+	if c, ok := h.rw.(interface{ RemoteAddr() net.Addr }); ok {
+		req.RemoteAddr = c.RemoteAddr().String()
+	}
+
+	err := exchange.Authorize(req)
+	authErr, ok := err.(*exchange.AuthError)
+	if !ok {
+		return err
+	}
+	log.Println(h.streamKey.String(), err)
+
+	var msg *Message
+	if action == exchange.AuthActionPublish && authErr.Code == exchange.AuthDenyBadName {
+		msg, _ = NewPublishBadNameMessage(h.GetFunctionalStreamId(), authErr.Reason)
+	} else {
+		msg, _ = NewConnectRejectedMessage(h.GetFunctionalStreamId(), authErr.Reason)
+	}
+	if msg != nil {
+		if e := h.WriteMessage(msg); e != nil {
+			log.Println("write auth status:", e)
+		}
+	}
+	return err
+}
+
 func (h *RtmpHandler) handleProtocolControlMessaage(m *ProtocolControlMessaage) error {
 
 	switch m.MessageType {
@@ -218,6 +322,9 @@ func (h *RtmpHandler) handleCommandMessage(m *CommandMessage) (err error) {
 						h.status = rtmp_state_publish_fail
 					}
 					return
+				case "pause":
+					log.Println("receive pause command")
+					err = h.handlePauseCommand(r)
 				case "deleteStream":
 					// 7.2.2.3 The server does not send any response.
 					log.Println("receive deleteStream command")
@@ -225,8 +332,7 @@ func (h *RtmpHandler) handleCommandMessage(m *CommandMessage) (err error) {
 					log.Println("receive play command")
 					err = h.handlePlayCommand(r, m)
 					if err == nil {
-						err = h.pad.OnSinkDetermined(h, h.ctx)
-						h.role = "sink"
+						err = h.startPlay(m.StreamID)
 					}
 					if err == nil {
 						h.status = rtmp_state_play_start
@@ -543,7 +649,9 @@ func (h *RtmpHandler) handlePublishCommand(r amf.Reader) error {
 		case 2:
 			if str, ok := v.(string); ok {
 				h.publishCmdObj.PublishName = str
-				h.appStreamKey = h.connetCmdObj["app"].(string) + "-" + str
+				if h.streamKey, e = h.newStreamKey(str); e != nil {
+					return e
+				}
 			} else {
 				panic("publish name not strig")
 			}
@@ -556,6 +664,10 @@ func (h *RtmpHandler) handlePublishCommand(r amf.Reader) error {
 		}
 	}
 
+	if err := h.authorize(exchange.AuthActionPublish); err != nil {
+		return err
+	}
+
 	w := &bytes.Buffer{}
 
 	// NetConnection 需要回复transactionid, netstream tid都设置为0 7.2.2
@@ -600,17 +712,52 @@ func (h *RtmpHandler) handlePlayCommand(r amf.Reader, m *CommandMessage) error {
 		case 2: //stream name
 			if str, ok := v.(string); ok {
 				h.playCmdObj.StreamName = str
-				h.appStreamKey = h.connetCmdObj["app"].(string) + "-" + str
+				if h.streamKey, e = h.newStreamKey(str); e != nil {
+					return e
+				}
 			} else {
 				panic("stream name not strig")
 			}
+		case 3: // 7.2.2.1 start, 秒, -2直播或者录像, -1只播直播
+			if start, ok := v.(float64); ok {
+				h.playCmdObj.Start = int(start)
+			}
+		case 4: // duration, 秒, -1播放到结束
+			if duration, ok := v.(float64); ok {
+				h.playCmdObj.Duration = int(duration)
+			}
+		case 5:
+			if reset, ok := v.(bool); ok {
+				h.playCmdObj.Reset = reset
+			}
 		}
 	}
 
-	w := &bytes.Buffer{}
 	h.functionalStreamId = m.StreamID
+	return h.authorize(exchange.AuthActionPlay)
+}
+
+// startPlay 先注册sink, 流不存在的时候只回复StreamNotFound, 不能先回复Play.Start再失败
+// 注册之后source的数据可能马上就来, 拿着writeLock等Play.Start这些状态写完
+func (h *RtmpHandler) startPlay(streamID uint32) error {
+	h.writeLock.Lock()
+	err := h.pad.OnSinkDetermined(h, h.ctx)
+	h.role = "sink"
+	if err == nil {
+		err = h.writePlayStart(streamID)
+	}
+	h.writeLock.Unlock()
+	if err == exchange.ErrStreamNotFound {
+		h.writeStreamNotFound()
+	}
+	return err
+}
 
-	streamIsRecordedMsg := NewUserControlCommandStreamIsRecorded(h.functionalStreamId) // 这个streamid 应该没啥用
+// writePlayStart 回复play成功的状态, 调用的时候要拿着writeLock
+func (h *RtmpHandler) writePlayStart(streamID uint32) error {
+	w := &bytes.Buffer{}
+
+	streamIsRecordedMsg := NewUserControlCommandStreamIsRecorded(streamID) // 这个streamid 应该没啥用
 	chunkArray, err := h.chunkPacker.MessageToChunk(streamIsRecordedMsg)
 	if err != nil {
 		return err
@@ -620,7 +767,7 @@ func (h *RtmpHandler) handlePlayCommand(r amf.Reader, m *CommandMessage) error {
 		return err
 	}
 
-	streamBeginMsg := NewUserControlCommandStreamBegin(m.StreamID) // 这个streamid 应该也没啥用
+	streamBeginMsg := NewUserControlCommandStreamBegin(streamID) // 这个streamid 应该也没啥用
 	chunkArray, err = h.chunkPacker.MessageToChunk(streamBeginMsg)
 	if err != nil {
 		return err
@@ -630,7 +777,7 @@ func (h *RtmpHandler) handlePlayCommand(r amf.Reader, m *CommandMessage) error {
 		return err
 	}
 
-	playResetMsg, _ := NewPlayResetMessage(m.StreamID) // 这个streamid 应该也没啥用
+	playResetMsg, _ := NewPlayResetMessage(streamID) // 这个streamid 应该也没啥用
 	chunkArray, err = h.chunkPacker.MessageToChunk(playResetMsg)
 	if err != nil {
 		return err
@@ -646,7 +793,7 @@ func (h *RtmpHandler) handlePlayCommand(r amf.Reader, m *CommandMessage) error {
 	}
 
 	w.Reset()
-	playStartMsg, _ := NewPlayStartMessage(m.StreamID)
+	playStartMsg, _ := NewPlayStartMessage(streamID)
 	chunkArray, err = h.chunkPacker.MessageToChunk(playStartMsg)
 	if err != nil {
 		return err
@@ -662,7 +809,7 @@ func (h *RtmpHandler) handlePlayCommand(r amf.Reader, m *CommandMessage) error {
 	}
 
 	w.Reset()
-	dataStartMsg, _ := NewDataStartMessage(m.StreamID)
+	dataStartMsg, _ := NewDataStartMessage(streamID)
 	chunkArray, err = h.chunkPacker.MessageToChunk(dataStartMsg)
 	if err != nil {
 		return err
@@ -678,7 +825,7 @@ func (h *RtmpHandler) handlePlayCommand(r amf.Reader, m *CommandMessage) error {
 	}
 
 	w.Reset()
-	playPublishNotifyStartMsg, _ := NewPlayPublishNotifyMessage(m.StreamID)
+	playPublishNotifyStartMsg, _ := NewPlayPublishNotifyMessage(streamID)
 	chunkArray, err = h.chunkPacker.MessageToChunk(playPublishNotifyStartMsg)
 	if err != nil {
 		return err
@@ -698,9 +845,53 @@ func (h *RtmpHandler) handlePlayCommand(r amf.Reader, m *CommandMessage) error {
 
 func (h *RtmpHandler) WriteMessage(m *Message) error {
 	m.StreamID = h.GetFunctionalStreamId()
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
 	return h.chunkPacker.WriteMessage(h.rw, m)
 }
 
+// handlePauseCommand 7.2.2.8 pause, 只有时移播放可以暂停, 直播忽略
+func (h *RtmpHandler) handlePauseCommand(r amf.Reader) error {
+	pause := false
+	for i := 0; ; i++ {
+		v, e := amf.ReadValue(r)
+		if e != nil {
+			if e == io.EOF {
+				break
+			}
+			return e
+		}
+		switch i {
+		case 0: // transactionId 0
+		case 1: // command object null
+		case 2:
+			if b, ok := v.(bool); ok {
+				pause = b
+			}
+		case 3: // 暂停或者恢复的时候的播放位置, 毫秒, 从读的位置继续就行
+		}
+	}
+
+	if h.dvrPlayer == nil {
+		log.Println(h.streamKey.String(), "pause live stream ignored")
+		return nil
+	}
+
+	var msg *Message
+	var err error
+	if pause {
+		h.dvrPlayer.Pause()
+		msg, err = NewPauseNotifyMessage(h.GetFunctionalStreamId())
+	} else {
+		h.dvrPlayer.Resume()
+		msg, err = NewUnpauseNotifyMessage(h.GetFunctionalStreamId())
+	}
+	if err != nil {
+		return err
+	}
+	return h.WriteMessage(msg)
+}
+
 func (h *RtmpHandler) handleSetDataFrame(r amf.Reader, m *DataMessage) error {
 
 	log.Println("@setDataFrame")
@@ -761,11 +952,15 @@ func (h *RtmpHandler) handleSetDataFrame(r amf.Reader, m *DataMessage) error {
 }
 
 func (h *RtmpHandler) rtmpMessageToExData(m *Message) error {
-	d := &exchange.ExData{
-		Timestamp:      uint64(m.Timestamp),
-		OriginProtocol: exchange.ProtocolRTMP,
-		Payload:        m.Payload,
-	}
+	return h.putMsg(MessageToExData(m))
+}
+
+// MessageToExData 音视频和data消息转成ExData, 回源拉流也用这个
+func MessageToExData(m *Message) *exchange.ExData {
+	// payload从exchange的内存池分配，m.Payload之后就可以回收了
+	d := exchange.NewPooledExData(m.Payload)
+	d.Timestamp = uint64(m.Timestamp)
+	d.OriginProtocol = exchange.ProtocolRTMP
 
 	switch m.MessageType {
 	case 8:
@@ -792,6 +987,7 @@ func (h *RtmpHandler) rtmpMessageToExData(m *Message) error {
 		} else {
 			d.AvFormat = exchange.AvFormatHEVC
 		}
+		d.CompositionTime = exchange.ParseCompositionTime(m.Payload)
 	case 15:
 		d.AvFormat = exchange.AvFormatData
 		d.DataType = exchange.DataTypeDataAMF3
@@ -801,8 +997,7 @@ func (h *RtmpHandler) rtmpMessageToExData(m *Message) error {
 	default:
 		panic("no such message type")
 	}
-
-	return h.putMsg(d)
+	return d
 }
 
 func (h *RtmpHandler) WriteData(d *exchange.ExData) error {
@@ -824,11 +1019,13 @@ func (h *RtmpHandler) WriteData(d *exchange.ExData) error {
 	case exchange.DataTypeVideoConfig:
 		m.MessageType = TYPE_VIDEO
 	case exchange.DataTypeDataAMF0:
-		m.MessageType = TYPE_CMDMSG_AMF0
+		m.MessageType = TYPE_DATA_AMF0
 	case exchange.DataTypeDataAMF3:
-		m.MessageType = TYPE_CMDMSG_AMF3
+		m.MessageType = TYPE_DATA_AMF3
 	default:
 		panic("no such data type")
 	}
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
 	return h.chunkPacker.WriteMessage(h.rw, m)
 }
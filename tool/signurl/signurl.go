@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/chinasarft/golive/exchange"
+)
+
+/*
+	生成带签名的推流和播放url, 见exchange/sign.go
+	signurl -secret pubkey -play-secret playkey -ttl 2h rtmp://host/live/stream
+	http-flv和hls的播放地址也可以签名: signurl -secret key http://host:8080/live/stream.flv
+*/
+
+func main() {
+	secret := flag.String("secret", "", "publish secret")
+	playSecret := flag.String("play-secret", "", "play secret, default same as publish secret")
+	ttl := flag.Duration("ttl", time.Hour, "url valid duration")
+	flag.Parse()
+
+	if flag.NArg() != 1 || *secret == "" {
+		fmt.Println("usage as:", os.Args[0], "-secret key [-play-secret key] [-ttl 1h] rtmp://host/app/stream")
+		os.Exit(1)
+	}
+	if *playSecret == "" {
+		*playSecret = *secret
+	}
+
+	expires := time.Now().Add(*ttl).Unix()
+	publishUrl, err := exchange.SignStreamUrl(flag.Arg(0), *secret, expires)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	playUrl, err := exchange.SignStreamUrl(flag.Arg(0), *playSecret, expires)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("publish:", publishUrl)
+	fmt.Println("play:", playUrl)
+}
@@ -0,0 +1,405 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	rfc6455 websocket, 只实现了播放需要的部分
+	1. 不支持扩展(permessage-deflate)和子协议
+	2. 每个消息一个frame发送, 读的时候分片的消息合并起来
+	3. 控制帧(ping pong close)在ReadMessage里面处理, 调用者只需要一直读
+*/
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseNoStatus      = 1005
+	CloseMessageTooBig = 1009
+	defaultMaxPayload  = 1024 * 1024
+	maxControlPayload  = 125
+	websocketGUID      = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	websocketVersion   = "13"
+)
+
+var (
+	ErrNotWebSocket = errors.New("not websocket request")
+	ErrClosed       = errors.New("websocket closed")
+)
+
+// CloseError 收到对方的close帧
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed:%d %s", e.Code, e.Reason)
+}
+
+type Conn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	isClient bool // 客户端发送的帧要加掩码
+
+	MaxPayload  int64
+	PingHandler func(data []byte) error // nil的时候回复pong
+	PongHandler func(data []byte) error
+
+	writeLock sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, r *bufio.Reader, isClient bool) *Conn {
+	return &Conn{
+		conn:       conn,
+		r:          r,
+		isClient:   isClient,
+		MaxPayload: defaultMaxPayload,
+	}
+}
+
+// IsUpgrade 是否是websocket握手请求
+func IsUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Upgrade 服务端握手, 失败的时候已经回复了http错误
+// header是101响应里面额外的头, 比如跨域
+func Upgrade(w http.ResponseWriter, r *http.Request, header http.Header) (*Conn, error) {
+	if r.Method != http.MethodGet || !IsUpgrade(r) {
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if r.Header.Get("Sec-Websocket-Version") != websocketVersion {
+		w.Header().Set("Sec-Websocket-Version", websocketVersion)
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported websocket version:%s", r.Header.Get("Sec-Websocket-Version"))
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response can not hijack")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	for k, vs := range header {
+		for _, v := range vs {
+			resp += k + ": " + v + "\r\n"
+		}
+	}
+	resp += "\r\n"
+	if _, err = conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, rw.Reader, false), nil
+}
+
+// Dial 客户端握手, ws://host/path
+func Dial(rawurl string, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("unsupported scheme:%s", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":80"
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := "GET " + u.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: " + websocketVersion + "\r\n\r\n"
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake status:%d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake wrong accept key")
+	}
+	conn.SetDeadline(time.Time{})
+	return newConn(conn, br, true), nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// WriteMessage 一个消息一帧, 可以在多个协程里面调用
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == OpClose {
+		c.closeSent = true
+	}
+	return c.writeFrame(opcode, data)
+}
+
+func (c *Conn) writeFrame(opcode int, data []byte) error {
+	var hdr [14]byte
+	hdr[0] = 0x80 | byte(opcode) // FIN
+	n := 2
+	switch l := len(data); {
+	case l <= 125:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n += 8
+	}
+
+	if !c.isClient {
+		// 服务端不加掩码, 头和数据一起写, 少一次系统调用
+		buf := make([]byte, n+len(data))
+		copy(buf, hdr[:n])
+		copy(buf[n:], data)
+		_, err := c.conn.Write(buf)
+		return err
+	}
+
+	hdr[1] |= 0x80
+	var mask [4]byte
+	rand.Read(mask[:])
+	buf := make([]byte, n+4+len(data))
+	copy(buf, hdr[:n])
+	copy(buf[n:], mask[:])
+	for i, b := range data {
+		buf[n+4+i] = b ^ mask[i%4]
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// WriteClose 发送close帧, 之后不能再发送
+func (c *Conn) WriteClose(code int, reason string) error {
+	data := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(data, uint16(code))
+	copy(data[2:], reason)
+	if len(data) > maxControlPayload {
+		data = data[:maxControlPayload]
+	}
+	return c.WriteMessage(OpClose, data)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+type frame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+func (c *Conn) readFrame() (*frame, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.r, hdr[:2]); err != nil {
+		return nil, err
+	}
+	f := &frame{
+		fin:    hdr[0]&0x80 != 0,
+		opcode: int(hdr[0] & 0x0f),
+	}
+	if hdr[0]&0x70 != 0 {
+		return nil, fmt.Errorf("websocket rsv bits set")
+	}
+	masked := hdr[1]&0x80 != 0
+	if masked == c.isClient {
+		// 客户端必须加掩码, 服务端不能加
+		return nil, fmt.Errorf("websocket wrong mask bit")
+	}
+
+	length := int64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(c.r, hdr[:2]); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.r, hdr[:8]); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(hdr[:8]))
+	}
+	if f.opcode >= OpClose && (length > maxControlPayload || !f.fin) {
+		return nil, fmt.Errorf("websocket wrong control frame")
+	}
+	if length < 0 || length > c.MaxPayload {
+		return nil, fmt.Errorf("websocket frame too big:%d", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+	return f, nil
+}
+
+// ReadMessage 返回文本或者二进制消息, 收到close回复close之后返回*CloseError
+func (c *Conn) ReadMessage() (opcode int, data []byte, err error) {
+	var msgOpcode int
+	var msg []byte
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case OpPing:
+			if c.PingHandler != nil {
+				err = c.PingHandler(f.payload)
+			} else {
+				err = c.WriteMessage(OpPong, f.payload)
+			}
+			if err != nil && err != ErrClosed {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			if c.PongHandler != nil {
+				if err = c.PongHandler(f.payload); err != nil {
+					return 0, nil, err
+				}
+			}
+			continue
+		case OpClose:
+			closeErr := &CloseError{Code: CloseNoStatus}
+			if len(f.payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(f.payload))
+				closeErr.Reason = string(f.payload[2:])
+			}
+			// 对方先发的close要回复状态码, 自己先发的就是对方的回复
+			reply := f.payload
+			if len(reply) > 2 {
+				reply = reply[:2]
+			}
+			c.WriteMessage(OpClose, reply)
+			return 0, nil, closeErr
+		case OpText, OpBinary:
+			if msg != nil {
+				return 0, nil, fmt.Errorf("websocket new message before fin")
+			}
+			msgOpcode = f.opcode
+			msg = f.payload
+		case OpContinuation:
+			if msg == nil {
+				return 0, nil, fmt.Errorf("websocket continuation without message")
+			}
+			if int64(len(msg)+len(f.payload)) > c.MaxPayload {
+				return 0, nil, fmt.Errorf("websocket message too big")
+			}
+			msg = append(msg, f.payload...)
+		default:
+			return 0, nil, fmt.Errorf("websocket unknown opcode:%d", f.opcode)
+		}
+		if f.fin {
+			return msgOpcode, msg, nil
+		}
+	}
+}
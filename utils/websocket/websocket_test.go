@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// rfc6455 1.3的例子
+	if key := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept key:%s", key)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	pings := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, http.Header{"Access-Control-Allow-Origin": {"*"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.PingHandler = func(data []byte) error {
+			pings <- data
+			return conn.WriteMessage(OpPong, data)
+		}
+		for {
+			opcode, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = conn.WriteMessage(opcode, data); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	if resp, err := http.Get(srv.URL); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain http:%v %v", resp, err)
+	}
+
+	conn, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/echo", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pongs := make(chan []byte, 1)
+	conn.PongHandler = func(data []byte) error {
+		pongs <- data
+		return nil
+	}
+
+	// 不同长度的编码
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		if err = conn.WriteMessage(OpBinary, data); err != nil {
+			t.Fatal(err)
+		}
+		opcode, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != OpBinary || !bytes.Equal(got, data) {
+			t.Fatalf("size %d echo:%d %d", size, opcode, len(got))
+		}
+	}
+
+	// ping pong在ReadMessage里面处理
+	conn.WriteMessage(OpPing, []byte("hi"))
+	conn.WriteMessage(OpText, []byte("text"))
+	if opcode, got, err := conn.ReadMessage(); err != nil || opcode != OpText || string(got) != "text" {
+		t.Fatalf("text echo:%d %s %v", opcode, got, err)
+	}
+	if p := <-pings; string(p) != "hi" {
+		t.Fatalf("ping:%s", p)
+	}
+	if p := <-pongs; string(p) != "hi" {
+		t.Fatalf("pong:%s", p)
+	}
+
+	// 服务端回复close
+	if err = conn.WriteClose(CloseNormal, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadMessage()
+	if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != CloseNormal {
+		t.Fatalf("close:%v", err)
+	}
+	if err = conn.WriteMessage(OpBinary, nil); err != ErrClosed {
+		t.Fatalf("write after close:%v", err)
+	}
+}